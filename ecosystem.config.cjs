@@ -51,6 +51,9 @@ module.exports = {
         PORT: 3334,
       },
       max_memory_restart: '500M',
+      // The relay drains writes and flushes its search index on SIGINT;
+      // give it longer than its 10s shutdown_timeout before SIGKILL.
+      kill_timeout: 15000,
       error_file: './logs/relay-error.log',
       out_file: './logs/relay-out.log',
       ...commonSettings,
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// nip98Kind is the NIP-98 HTTP Auth event kind.
+const nip98Kind = nostr.Kind(27235)
+
+// nip98MaxSkew is how far an auth event's created_at may be from now.
+const nip98MaxSkew = 60 * time.Second
+
+// maxAdminBody bounds how much of a request body we buffer to check the
+// NIP-98 payload hash.
+const maxAdminBody = 1 << 20
+
+// requireAdmin restricts next to the pubkeys in admin.pubkeys, authenticated
+// with a NIP-98 Authorization header. The key list is read from the live
+// config on every request, so adding or revoking an admin is a reload away.
+func (lc *liveConfig) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admins := lc.Load().Admin.Pubkeys
+		if len(admins) == 0 {
+			writeJSONError(w, http.StatusNotFound, "admin API is disabled")
+			return
+		}
+		pk, err := verifyNIP98(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Nostr")
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		for _, a := range admins {
+			if apk, err := nostr.PubKeyFromHex(a); err == nil && apk == pk {
+				next(w, r)
+				return
+			}
+		}
+		writeJSONError(w, http.StatusForbidden, "pubkey is not an admin")
+	}
+}
+
+// verifyNIP98 checks a `Authorization: Nostr <base64 event>` header against
+// the request and returns the signer. The `u` tag must name this request's
+// path and query (the host is not compared, since the relay normally sits
+// behind Caddy and sees its own address), and if the event carries a
+// `payload` tag it must be the SHA-256 of the body. The body is restored so
+// next can read it.
+func verifyNIP98(r *http.Request) (nostr.PubKey, error) {
+	var zero nostr.PubKey
+
+	header := r.Header.Get("Authorization")
+	encoded, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		return zero, errors.New("missing NIP-98 Authorization header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return zero, errors.New("authorization header is not valid base64")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return zero, errors.New("authorization header is not a nostr event")
+	}
+
+	if evt.Kind != nip98Kind {
+		return zero, fmt.Errorf("auth event must be kind %d", nip98Kind)
+	}
+	skew := time.Since(time.Unix(int64(evt.CreatedAt), 0))
+	if skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return zero, errors.New("auth event created_at is too far from now")
+	}
+	if !evt.CheckID() || !evt.VerifySignature() {
+		return zero, errors.New("auth event has an invalid id or signature")
+	}
+
+	if tag := evt.Tags.Find("method"); tag == nil || !strings.EqualFold(tag[1], r.Method) {
+		return zero, errors.New("auth event method tag does not match request")
+	}
+	tag := evt.Tags.Find("u")
+	if tag == nil {
+		return zero, errors.New("auth event is missing the u tag")
+	}
+	u, err := url.Parse(tag[1])
+	if err != nil || u.Path != r.URL.Path || u.RawQuery != r.URL.RawQuery {
+		return zero, errors.New("auth event u tag does not match request URL")
+	}
+
+	if tag := evt.Tags.Find("payload"); tag != nil && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+		if err != nil {
+			return zero, errors.New("failed to read request body")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold(tag[1], hex.EncodeToString(sum[:])) {
+			return zero, errors.New("auth event payload hash does not match body")
+		}
+	}
+
+	return evt.PubKey, nil
+}
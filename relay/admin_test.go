@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// nip98Header signs evt with sk and encodes it as a NIP-98 Authorization
+// header.
+func nip98Header(t *testing.T, sk nostr.SecretKey, evt nostr.Event) string {
+	t.Helper()
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestVerifyNIP98(t *testing.T) {
+	sk := nostr.Generate()
+	now := nostr.Now()
+	const target = "https://relay.example.com/admin/reload?dry=1"
+	body := `{"reason":"test"}`
+	sum := sha256.Sum256([]byte(body))
+	payload := hex.EncodeToString(sum[:])
+	edited := nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}
+	edited.Sign(sk)
+	edited.Tags[1][1] = "GET"
+	editedRaw, _ := json.Marshal(edited)
+
+	tests := []struct {
+		name string
+		// evt is signed into the header; header is used as is otherwise.
+		evt     *nostr.Event
+		header  string
+		body    string
+		wantErr string
+	}{
+		{name: "valid", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}},
+		{name: "method case", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "post"}}}},
+		{name: "other host", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", "http://127.0.0.1:3334/admin/reload?dry=1"}, {"method", "POST"}}}},
+		{name: "payload", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}, {"payload", payload}}}, body: body},
+		{name: "payload upper case", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}, {"payload", strings.ToUpper(payload)}}}, body: body},
+		{name: "missing", wantErr: "missing NIP-98"},
+		{name: "not base64", header: "Nostr %%%", wantErr: "not valid base64"},
+		{name: "not an event", header: "Nostr " + base64.StdEncoding.EncodeToString([]byte("[]")), wantErr: "not a nostr event"},
+		{name: "wrong kind", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}, wantErr: "must be kind 27235"},
+		{name: "too old", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now - 120, Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}, wantErr: "too far from now"},
+		{name: "too new", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now + 120, Tags: nostr.Tags{{"u", target}, {"method", "POST"}}}, wantErr: "too far from now"},
+		{name: "other method", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "GET"}}}, wantErr: "method tag"},
+		{name: "no method", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}}}, wantErr: "method tag"},
+		{name: "no u tag", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"method", "POST"}}}, wantErr: "missing the u tag"},
+		{name: "other path", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", "https://relay.example.com/admin/other?dry=1"}, {"method", "POST"}}}, wantErr: "u tag does not match"},
+		{name: "other query", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", "https://relay.example.com/admin/reload"}, {"method", "POST"}}}, wantErr: "u tag does not match"},
+		{name: "wrong payload", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: now, Tags: nostr.Tags{{"u", target}, {"method", "POST"}, {"payload", payload}}}, body: `{"reason":"other"}`, wantErr: "payload hash"},
+		{name: "edited after signing", header: "Nostr " + base64.StdEncoding.EncodeToString(editedRaw), wantErr: "invalid id or signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/admin/reload?dry=1", strings.NewReader(tt.body))
+			header := tt.header
+			if tt.evt != nil {
+				header = nip98Header(t, sk, *tt.evt)
+			}
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			pk, err := verifyNIP98(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pk != sk.Public() {
+				t.Errorf("pubkey = %s, want %s", pk.Hex(), sk.Public().Hex())
+			}
+			// the body is still there for the handler
+			if got, _ := io.ReadAll(r.Body); string(got) != tt.body {
+				t.Errorf("body after verification = %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	admin, other := nostr.Generate(), nostr.Generate()
+	tests := []struct {
+		name       string
+		admins     []string
+		sk         *nostr.SecretKey
+		wantStatus int
+	}{
+		{name: "disabled", sk: &admin, wantStatus: http.StatusNotFound},
+		{name: "no auth", admins: []string{admin.Public().Hex()}, wantStatus: http.StatusUnauthorized},
+		{name: "not an admin", admins: []string{admin.Public().Hex()}, sk: &other, wantStatus: http.StatusForbidden},
+		{name: "admin", admins: []string{"not hex", admin.Public().Hex()}, sk: &admin, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Admin.Pubkeys = tt.admins
+			lc := newLiveConfig("", cfg, nil, nil)
+			h := lc.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			if tt.sk != nil {
+				r.Header.Set("Authorization", nip98Header(t, *tt.sk, nostr.Event{
+					Kind:      nip98Kind,
+					CreatedAt: nostr.Now(),
+					Tags:      nostr.Tags{{"u", "http://localhost/admin/reload"}, {"method", "POST"}},
+				}))
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.wantStatus)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Nostr" {
+				t.Error("401 without WWW-Authenticate: Nostr")
+			}
+		})
+	}
+}
+
+func TestReloadAdminsChanged(t *testing.T) {
+	admin := nostr.Generate().Public().Hex()
+	tests := []struct {
+		name          string
+		before, after []string
+		want          bool
+	}{
+		{"unchanged", []string{admin}, []string{admin}, false},
+		{"revoked", []string{admin}, nil, true},
+		{"added", nil, []string{admin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := defaultConfig()
+			old.Admin.Pubkeys = tt.before
+			lc := newLiveConfig("", old, nil, nil)
+			called := false
+			lc.adminsChanged = func() { called = true }
+			next := defaultConfig()
+			next.Admin.Pubkeys = tt.after
+			lc.apply(&next, &old)
+			if called != tt.want {
+				t.Errorf("adminsChanged called = %v, want %v", called, tt.want)
+			}
+		})
+	}
+}
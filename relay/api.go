@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// defaultAPISearchLimit is the page size when ?limit is not given.
+const defaultAPISearchLimit = 20
+
+// stationAPI serves station lookups over plain HTTP for consumers that can't
+// hold a websocket open (the SEO pre-renderer, the Tauri widget, embeds).
+// Every response carries the signed events exactly as stored, so clients can
+// verify them the same way they would over a REQ.
+type stationAPI struct {
+	db      eventstore.Store
+	history eventstore.Store
+	search  *stationSearch
+	live    *liveConfig
+}
+
+func newStationAPI(db, history eventstore.Store, search *stationSearch, live *liveConfig) *stationAPI {
+	return &stationAPI{db: db, history: history, search: search, live: live}
+}
+
+// handleSearch is GET /api/stations/search?q=&genre=&country=&limit=&offset=.
+// genre and country may be repeated or comma-separated; values of the same
+// parameter are ORed, different parameters are ANDed. Without q the results
+// are ordered newest first. With highlight=true the response also maps each
+// event ID to its highlight fragments (see stationSearch.Highlights); with
+// collapse=true only the best station of each duplicate cluster is listed.
+func (a *stationAPI) handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := stationQuery{
+		Text:      params.Get("q"),
+		Genres:    queryList(params["genre"]),
+		Countries: queryList(params["country"]),
+	}
+
+	maxLimit := a.live.Load().Limits.MaxSearchLimit
+	limit, err := queryInt(params.Get("limit"), defaultAPISearchLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	limit = min(limit, maxLimit)
+	offset, err := queryInt(params.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	highlight, _ := strconv.ParseBool(params.Get("highlight"))
+	q.Collapse, _ = strconv.ParseBool(params.Get("collapse"))
+
+	events, total, err := a.search.Find(q, offset, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	resp := map[string]any{
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+		"events": events,
+	}
+	if highlight {
+		ids := make([]string, len(events))
+		for i, evt := range events {
+			ids[i] = evt.ID.Hex()
+		}
+		highlights, err := a.search.Highlights(q, ids)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		resp["highlights"] = highlights
+	}
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStation is GET /api/stations/{pubkey}/{d}: the current version.
+func (a *stationAPI) handleStation(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	evt, found := fetchAddress(a.db, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, evt)
+}
+
+// handleHistory is GET /api/stations/{pubkey}/{d}/history: the current
+// version followed by every archived one, newest first. A station whose
+// current version is gone (deleted) has no history either, so a NIP-09
+// deletion also hides what was archived before it.
+func (a *stationAPI) handleHistory(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	current, found := fetchAddress(a.db, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+
+	maxLimit := a.live.Load().Limits.MaxQueryLimit
+	events := []nostr.Event{current}
+	for evt := range a.history.QueryEvents(addressFilter(indexedKind, pk, d), maxLimit) {
+		if evt.ID != current.ID && evt.CreatedAt <= current.CreatedAt {
+			events = append(events, evt)
+		}
+	}
+	slices.SortStableFunc(events, func(x, y nostr.Event) int {
+		return int(y.CreatedAt) - int(x.CreatedAt)
+	})
+	if len(events) > maxLimit {
+		events = events[:maxLimit]
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
+
+// stationPathParams reads {pubkey} and {d}, writing a 400 if the pubkey is
+// not 64-char hex.
+func stationPathParams(w http.ResponseWriter, r *http.Request) (nostr.PubKey, string, bool) {
+	pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "pubkey must be 64-char hex")
+		return pk, "", false
+	}
+	return pk, r.PathValue("d"), true
+}
+
+// queryList flattens repeated and comma-separated query values.
+func queryList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func queryInt(raw string, def int) (int, error) {
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.Atoi(raw)
+}
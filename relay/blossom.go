@@ -0,0 +1,558 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"fiatjaf.com/nostr"
+)
+
+// blossomAuthKind is the Blossom authorization event kind (BUD-01).
+const blossomAuthKind = nostr.Kind(24242)
+
+// blobTransferTimeout replaces the server's 2s read/write deadlines for
+// uploads and downloads, which can be tens of megabytes.
+const blobTransferTimeout = 10 * time.Minute
+
+var (
+	blobsBucket  = []byte("blobs")
+	ownersBucket = []byte("owners")
+)
+
+// blobMeta is what the index keeps per blob. Uploaded is the first upload;
+// each owner's own upload time is in the owners bucket.
+type blobMeta struct {
+	Size     int64  `json:"size"`
+	Type     string `json:"type"`
+	Uploaded int64  `json:"uploaded"`
+	Owners   int    `json:"owners"`
+}
+
+// blobDescriptor is the BUD-02 JSON description of a blob.
+type blobDescriptor struct {
+	URL      string `json:"url"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+// blobStore is a Blossom (BUD-01/BUD-02) blob server on the local
+// filesystem. Blobs live at <dir>/<first two hex chars>/<sha256>; a bbolt
+// index next to them records each blob's size and type and which pubkeys
+// uploaded it. A blob is removed from disk once its last owner deletes it.
+type blobStore struct {
+	dir  string
+	db   *bolt.DB
+	live *liveConfig
+}
+
+func openBlobStore(dir string, live *liveConfig) (*blobStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "index.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening blob index: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blobsBucket, ownersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing blob index: %w", err)
+	}
+	return &blobStore{dir: dir, db: db, live: live}, nil
+}
+
+func (s *blobStore) Close() error { return s.db.Close() }
+
+func (s *blobStore) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{blob}", s.enabled(s.handleGet))
+	mux.HandleFunc("PUT /upload", s.enabled(s.handleUpload))
+	mux.HandleFunc("GET /list/{pubkey}", s.enabled(s.handleList))
+	mux.HandleFunc("DELETE /{blob}", s.enabled(s.handleDelete))
+}
+
+// enabled answers 404 while blossom.enabled is off, so the switch can be
+// flipped with a reload.
+func (s *blobStore) enabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.live.Load().Blossom.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *blobStore) path(sha string) string {
+	return filepath.Join(s.dir, sha[:2], sha)
+}
+
+// blobError writes a Blossom error: clients show the X-Reason header.
+func blobError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("X-Reason", reason)
+	writeJSONError(w, status, reason)
+}
+
+// parseBlobPath reads "<sha256>" or "<sha256>.<ext>" from a path segment.
+func parseBlobPath(segment string) (string, bool) {
+	sha, _, _ := strings.Cut(segment, ".")
+	sha = strings.ToLower(sha)
+	if len(sha) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(sha); err != nil {
+		return "", false
+	}
+	return sha, true
+}
+
+// blobExtensions are the file extensions used in blob URLs for the types
+// WaveFunc expects; anything else falls back to the mime package.
+var blobExtensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/webp":    ".webp",
+	"image/gif":     ".gif",
+	"image/avif":    ".avif",
+	"image/svg+xml": ".svg",
+	"audio/mpeg":    ".mp3",
+	"audio/ogg":     ".ogg",
+	"audio/opus":    ".opus",
+	"audio/aac":     ".aac",
+	"audio/flac":    ".flac",
+	"audio/wav":     ".wav",
+	"audio/mp4":     ".m4a",
+}
+
+func blobExtension(contentType string) string {
+	if ext, ok := blobExtensions[contentType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+func (s *blobStore) descriptor(r *http.Request, sha string, meta blobMeta) blobDescriptor {
+	base := s.live.Load().Blossom.URL
+	if base == "" {
+		base = requestBaseURL(r)
+	}
+	return blobDescriptor{
+		URL:      strings.TrimRight(base, "/") + "/" + sha + blobExtension(meta.Type),
+		SHA256:   sha,
+		Size:     meta.Size,
+		Type:     meta.Type,
+		Uploaded: meta.Uploaded,
+	}
+}
+
+func (s *blobStore) meta(sha string) (blobMeta, bool) {
+	key, _ := hex.DecodeString(sha)
+	var meta blobMeta
+	found := false
+	s.db.View(func(tx *bolt.Tx) error {
+		if raw := tx.Bucket(blobsBucket).Get(key); raw != nil {
+			found = json.Unmarshal(raw, &meta) == nil
+		}
+		return nil
+	})
+	return meta, found
+}
+
+// handleGet is GET/HEAD /<sha256>[.ext] (BUD-01). Range requests are
+// answered by http.ServeContent.
+func (s *blobStore) handleGet(w http.ResponseWriter, r *http.Request) {
+	sha, ok := parseBlobPath(r.PathValue("blob"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	meta, found := s.meta(sha)
+	if !found {
+		blobError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	f, err := os.Open(s.path(sha))
+	if err != nil {
+		slog.Error("blob is indexed but unreadable", "sha256", sha, "err", err)
+		blobError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	defer f.Close()
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(blobTransferTimeout))
+	w.Header().Set("Content-Type", meta.Type)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", strconv.Quote(sha))
+	// uploads are user content: never let a browser run them as a page
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	http.ServeContent(w, r, "", time.Unix(meta.Uploaded, 0), f)
+}
+
+// handleUpload is PUT /upload (BUD-02). The auth event must have t=upload
+// and an x tag with the body's SHA-256.
+func (s *blobStore) handleUpload(w http.ResponseWriter, r *http.Request) {
+	cfg := s.live.Load().Blossom
+	auth, err := verifyBlossomAuth(r, "upload")
+	if err != nil {
+		blobError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if r.ContentLength > int64(cfg.MaxUploadSize) {
+		blobError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs are limited to %d bytes", cfg.MaxUploadSize))
+		return
+	}
+	quota := cfg.quotaFor(auth.PubKey)
+	used := s.usage(auth.PubKey)
+	if quota > 0 && r.ContentLength > 0 && used+r.ContentLength > quota && !s.ownsAny(auth) {
+		blobError(w, http.StatusRequestEntityTooLarge, "upload would exceed your storage quota")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(blobTransferTimeout))
+	rc.SetWriteDeadline(time.Now().Add(blobTransferTimeout))
+
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "upload-*")
+	if err != nil {
+		slog.Error("failed to create upload file", "err", err)
+		blobError(w, http.StatusInternalServerError, "failed to store blob")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// read one byte past the limit to tell "exactly at" from "over"
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r.Body, int64(cfg.MaxUploadSize)+1))
+	if err != nil {
+		blobError(w, http.StatusBadRequest, "failed to read upload")
+		return
+	}
+	if size > int64(cfg.MaxUploadSize) {
+		blobError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs are limited to %d bytes", cfg.MaxUploadSize))
+		return
+	}
+	if size == 0 {
+		blobError(w, http.StatusBadRequest, "empty upload")
+		return
+	}
+	sha := hex.EncodeToString(hash.Sum(nil))
+	if !authCoversBlob(auth, sha) {
+		blobError(w, http.StatusForbidden, "auth event has no x tag for this blob")
+		return
+	}
+
+	contentType, err := uploadType(r, tmp)
+	if err != nil || !cfg.allowsType(contentType) {
+		blobError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("type %q is not accepted", contentType))
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		blobError(w, http.StatusInternalServerError, "failed to store blob")
+		return
+	}
+
+	meta, err := s.put(auth.PubKey, sha, tmp.Name(), blobMeta{Size: size, Type: contentType, Uploaded: time.Now().Unix()}, quota)
+	if errors.Is(err, errQuotaExceeded) {
+		blobError(w, http.StatusRequestEntityTooLarge, "upload would exceed your storage quota")
+		return
+	}
+	if err != nil {
+		slog.Error("failed to store blob", "sha256", sha, "err", err)
+		blobError(w, http.StatusInternalServerError, "failed to store blob")
+		return
+	}
+	slog.Info("blob uploaded", "sha256", sha, "size", size, "type", contentType, "pubkey", auth.PubKey.Hex())
+	writeJSON(w, http.StatusOK, s.descriptor(r, sha, meta))
+}
+
+// uploadType is the declared Content-Type, or a sniffed one when the client
+// didn't say. Parameters are dropped.
+func uploadType(r *http.Request, f *os.File) (string, error) {
+	if declared, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && declared != "application/octet-stream" {
+		return strings.ToLower(declared), nil
+	}
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return sniffed, nil
+}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// put records pk as an owner of the blob, moving tmp into place if the blob
+// is new. It runs in one bbolt transaction so a concurrent delete of the same
+// blob can't remove the file after we've linked it. The quota is checked
+// again here, now that the size is known.
+func (s *blobStore) put(pk nostr.PubKey, sha, tmp string, meta blobMeta, quota int64) (blobMeta, error) {
+	key, _ := hex.DecodeString(sha)
+	uploaded := meta.Uploaded
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		blobs, owners := tx.Bucket(blobsBucket), tx.Bucket(ownersBucket)
+		ownerKey := append(pk[:], key...)
+		raw := blobs.Get(key)
+		if raw != nil {
+			var existing blobMeta
+			if err := json.Unmarshal(raw, &existing); err != nil {
+				return err
+			}
+			if owners.Get(ownerKey) != nil {
+				// already theirs: nothing to move or charge
+				meta = existing
+				return nil
+			}
+			// the first uploader's type sticks
+			meta.Type, meta.Uploaded, meta.Owners = existing.Type, existing.Uploaded, existing.Owners
+		}
+		if quota > 0 && usageIn(tx, pk)+meta.Size > quota {
+			return errQuotaExceeded
+		}
+		if raw == nil {
+			if err := os.MkdirAll(filepath.Dir(s.path(sha)), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, s.path(sha)); err != nil {
+				return err
+			}
+		}
+		meta.Owners++
+		encoded, _ := json.Marshal(meta)
+		if err := blobs.Put(key, encoded); err != nil {
+			return err
+		}
+		return owners.Put(ownerKey, binary.BigEndian.AppendUint64(nil, uint64(uploaded)))
+	})
+	return meta, err
+}
+
+// ownsAny reports whether auth's signer already owns a blob one of its x
+// tags names. Uploading that blob again costs nothing, so the early quota
+// check lets it through and put decides.
+func (s *blobStore) ownsAny(auth nostr.Event) bool {
+	owned := false
+	s.db.View(func(tx *bolt.Tx) error {
+		owners := tx.Bucket(ownersBucket)
+		for tag := range auth.Tags.FindAll("x") {
+			if key, err := hex.DecodeString(tag[1]); err == nil && owners.Get(append(auth.PubKey[:], key...)) != nil {
+				owned = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return owned
+}
+
+// usage is the total size of the blobs pk owns.
+func (s *blobStore) usage(pk nostr.PubKey) int64 {
+	var used int64
+	s.db.View(func(tx *bolt.Tx) error {
+		used = usageIn(tx, pk)
+		return nil
+	})
+	return used
+}
+
+func usageIn(tx *bolt.Tx, pk nostr.PubKey) int64 {
+	var used int64
+	blobs := tx.Bucket(blobsBucket)
+	c := tx.Bucket(ownersBucket).Cursor()
+	for k, _ := c.Seek(pk[:]); k != nil && strings.HasPrefix(string(k), string(pk[:])); k, _ = c.Next() {
+		var meta blobMeta
+		if json.Unmarshal(blobs.Get(k[len(pk):]), &meta) == nil {
+			used += meta.Size
+		}
+	}
+	return used
+}
+
+// handleList is GET /list/<pubkey>?since=&until= (BUD-02), newest first.
+func (s *blobStore) handleList(w http.ResponseWriter, r *http.Request) {
+	pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+	if err != nil {
+		blobError(w, http.StatusBadRequest, "pubkey must be 64-char hex")
+		return
+	}
+	since, err := queryInt(r.URL.Query().Get("since"), 0)
+	if err != nil {
+		blobError(w, http.StatusBadRequest, "since must be a unix timestamp")
+		return
+	}
+	until, err := queryInt(r.URL.Query().Get("until"), 0)
+	if err != nil {
+		blobError(w, http.StatusBadRequest, "until must be a unix timestamp")
+		return
+	}
+
+	list := []blobDescriptor{}
+	s.db.View(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(blobsBucket)
+		c := tx.Bucket(ownersBucket).Cursor()
+		for k, v := c.Seek(pk[:]); k != nil && strings.HasPrefix(string(k), string(pk[:])); k, v = c.Next() {
+			var meta blobMeta
+			if json.Unmarshal(blobs.Get(k[len(pk):]), &meta) != nil {
+				continue
+			}
+			// per-owner upload time, not the blob's first upload
+			meta.Uploaded = int64(binary.BigEndian.Uint64(v))
+			if (since > 0 && meta.Uploaded < int64(since)) || (until > 0 && meta.Uploaded > int64(until)) {
+				continue
+			}
+			list = append(list, s.descriptor(r, hex.EncodeToString(k[len(pk):]), meta))
+		}
+		return nil
+	})
+	slices.SortFunc(list, func(a, b blobDescriptor) int {
+		return cmp.Or(cmp.Compare(b.Uploaded, a.Uploaded), cmp.Compare(a.SHA256, b.SHA256))
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleDelete is DELETE /<sha256> (BUD-02). Only the signer's ownership is
+// dropped; the file goes once nobody owns it.
+func (s *blobStore) handleDelete(w http.ResponseWriter, r *http.Request) {
+	sha, ok := parseBlobPath(r.PathValue("blob"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	auth, err := verifyBlossomAuth(r, "delete")
+	if err != nil {
+		blobError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !authCoversBlob(auth, sha) {
+		blobError(w, http.StatusForbidden, "auth event has no x tag for this blob")
+		return
+	}
+
+	key, _ := hex.DecodeString(sha)
+	found, removed := false, false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		owners := tx.Bucket(ownersBucket)
+		ownerKey := append(auth.PubKey[:], key...)
+		if owners.Get(ownerKey) == nil {
+			return nil
+		}
+		found = true
+		if err := owners.Delete(ownerKey); err != nil {
+			return err
+		}
+		blobs := tx.Bucket(blobsBucket)
+		var meta blobMeta
+		if err := json.Unmarshal(blobs.Get(key), &meta); err != nil {
+			return err
+		}
+		if meta.Owners--; meta.Owners > 0 {
+			raw, _ := json.Marshal(meta)
+			return blobs.Put(key, raw)
+		}
+		removed = true
+		if err := blobs.Delete(key); err != nil {
+			return err
+		}
+		if err := os.Remove(s.path(sha)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to delete blob", "sha256", sha, "err", err)
+		blobError(w, http.StatusInternalServerError, "failed to delete blob")
+		return
+	}
+	if !found {
+		blobError(w, http.StatusNotFound, "you have no blob with this hash")
+		return
+	}
+	slog.Info("blob deleted", "sha256", sha, "pubkey", auth.PubKey.Hex(), "removed_from_disk", removed)
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyBlossomAuth checks a `Authorization: Nostr <base64 event>` header
+// carrying a kind-24242 event for action ("upload", "delete", ...): valid
+// signature, created in the past, an expiration in the future and a
+// matching t tag.
+func verifyBlossomAuth(r *http.Request, action string) (nostr.Event, error) {
+	var evt nostr.Event
+	encoded, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return evt, errors.New("missing Blossom Authorization header")
+	}
+	encoded = strings.TrimSpace(encoded)
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		// some clients send base64url
+		if raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+			return evt, errors.New("authorization header is not valid base64")
+		}
+	}
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return evt, errors.New("authorization header is not a nostr event")
+	}
+
+	if evt.Kind != blossomAuthKind {
+		return evt, fmt.Errorf("auth event must be kind %d", blossomAuthKind)
+	}
+	now := nostr.Now()
+	if evt.CreatedAt > now+nostr.Timestamp(nip98MaxSkew.Seconds()) {
+		return evt, errors.New("auth event created_at is in the future")
+	}
+	tag := evt.Tags.Find("expiration")
+	if tag == nil {
+		return evt, errors.New("auth event is missing the expiration tag")
+	}
+	if exp, err := strconv.ParseInt(tag[1], 10, 64); err != nil || nostr.Timestamp(exp) <= now {
+		return evt, errors.New("auth event has expired")
+	}
+	if tag := evt.Tags.Find("t"); tag == nil || tag[1] != action {
+		return evt, fmt.Errorf("auth event t tag must be %q", action)
+	}
+	if !evt.CheckID() || !evt.VerifySignature() {
+		return evt, errors.New("auth event has an invalid id or signature")
+	}
+	return evt, nil
+}
+
+// authCoversBlob reports whether one of the auth event's x tags is sha.
+func authCoversBlob(evt nostr.Event, sha string) bool {
+	for tag := range evt.Tags.FindAll("x") {
+		if len(tag) > 1 && strings.EqualFold(tag[1], sha) {
+			return true
+		}
+	}
+	return false
+}
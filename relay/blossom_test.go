@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+// signBlossomAuth signs evt with sk.
+func signBlossomAuth(t *testing.T, sk nostr.SecretKey, evt nostr.Event) nostr.Event {
+	t.Helper()
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func authHeader(t *testing.T, evt nostr.Event, enc *base64.Encoding) string {
+	t.Helper()
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Nostr " + enc.EncodeToString(raw)
+}
+
+func TestVerifyBlossomAuth(t *testing.T) {
+	sk := nostr.Generate()
+	now := int64(nostr.Now())
+	created := nostr.Timestamp(now)
+	exp := strconv.FormatInt(now+60, 10)
+	valid := signBlossomAuth(t, sk, nostr.Event{Kind: blossomAuthKind, CreatedAt: created, Tags: nostr.Tags{{"t", "upload"}, {"expiration", exp}}})
+	edited, badSig, otherSigner := valid, valid, valid
+	edited.Content = "edited"
+	badSig.Sig[0] ^= 1
+	otherSigner.PubKey = nostr.Generate().Public()
+
+	tests := []struct {
+		name string
+		// evt is signed into the header; header is used as is otherwise.
+		evt     *nostr.Event
+		header  string
+		wantErr string
+	}{
+		{name: "valid", header: authHeader(t, valid, base64.StdEncoding)},
+		{name: "base64url", header: authHeader(t, valid, base64.RawURLEncoding)},
+		{name: "missing", header: "", wantErr: "missing"},
+		{name: "other scheme", header: "Bearer abc", wantErr: "missing"},
+		{name: "not base64", header: "Nostr !!!", wantErr: "not valid base64"},
+		{name: "not an event", header: "Nostr " + base64.StdEncoding.EncodeToString([]byte(`{"kind":`)), wantErr: "not a nostr event"},
+		{name: "wrong kind", evt: &nostr.Event{Kind: nip98Kind, CreatedAt: created, Tags: nostr.Tags{{"t", "upload"}, {"expiration", exp}}}, wantErr: "must be kind 24242"},
+		{name: "from the future", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created + 3600, Tags: nostr.Tags{{"t", "upload"}, {"expiration", exp}}}, wantErr: "in the future"},
+		{name: "slight clock skew", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created + 10, Tags: nostr.Tags{{"t", "upload"}, {"expiration", exp}}}},
+		{name: "no expiration", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created, Tags: nostr.Tags{{"t", "upload"}}}, wantErr: "missing the expiration"},
+		{name: "expired", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created, Tags: nostr.Tags{{"t", "upload"}, {"expiration", strconv.FormatInt(now-1, 10)}}}, wantErr: "expired"},
+		{name: "bad expiration", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created, Tags: nostr.Tags{{"t", "upload"}, {"expiration", "soon"}}}, wantErr: "expired"},
+		{name: "other action", evt: &nostr.Event{Kind: blossomAuthKind, CreatedAt: created, Tags: nostr.Tags{{"t", "delete"}, {"expiration", exp}}}, wantErr: `t tag must be "upload"`},
+		{name: "edited after signing", header: authHeader(t, edited, base64.StdEncoding), wantErr: "invalid id or signature"},
+		{name: "bad signature", header: authHeader(t, badSig, base64.StdEncoding), wantErr: "invalid id or signature"},
+		{name: "other signer", header: authHeader(t, otherSigner, base64.StdEncoding), wantErr: "invalid id or signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/upload", nil)
+			header := tt.header
+			if tt.evt != nil {
+				header = authHeader(t, signBlossomAuth(t, sk, *tt.evt), base64.StdEncoding)
+			}
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			evt, err := verifyBlossomAuth(r, "upload")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if evt.PubKey != sk.Public() {
+					t.Errorf("pubkey = %s, want %s", evt.PubKey.Hex(), sk.Public().Hex())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthCoversBlob(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	evt := nostr.Event{Tags: nostr.Tags{{"x", strings.Repeat("cd", 32)}, {"x", strings.ToUpper(sha)}, {"x"}}}
+	if !authCoversBlob(evt, sha) {
+		t.Error("x tag in upper case was not accepted")
+	}
+	if authCoversBlob(evt, strings.Repeat("ef", 32)) {
+		t.Error("blob without an x tag was accepted")
+	}
+}
+
+func newTestBlobStore(t *testing.T, cfg Config) (*blobStore, http.Handler) {
+	t.Helper()
+	s, err := openBlobStore(t.TempDir(), newLiveConfig("", cfg, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	mux := http.NewServeMux()
+	s.register(mux)
+	return s, mux
+}
+
+func blobRequest(t *testing.T, h http.Handler, method string, sk nostr.SecretKey, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	sum := sha256.Sum256(body)
+	sha := hex.EncodeToString(sum[:])
+	target, action := "/upload", "upload"
+	if method == http.MethodDelete {
+		target, action = "/"+sha, "delete"
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "image/png")
+	auth := signBlossomAuth(t, sk, nostr.Event{
+		Kind:      blossomAuthKind,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"t", action},
+			{"expiration", strconv.FormatInt(int64(nostr.Now())+60, 10)},
+			{"x", sha},
+		},
+	})
+	r.Header.Set("Authorization", authHeader(t, auth, base64.StdEncoding))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestBlobOwners(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Blossom.Enabled = true
+	s, h := newTestBlobStore(t, cfg)
+	alice, bob := nostr.Generate(), nostr.Generate()
+	blob := []byte("station logo")
+	sum := sha256.Sum256(blob)
+	sha := hex.EncodeToString(sum[:])
+
+	steps := []struct {
+		name       string
+		method     string
+		sk         nostr.SecretKey
+		wantStatus int
+		wantOwners int // 0: gone from the index and disk
+		aliceUsage int64
+		bobUsage   int64
+	}{
+		{"alice uploads", http.MethodPut, alice, http.StatusOK, 1, 12, 0},
+		{"alice uploads again", http.MethodPut, alice, http.StatusOK, 1, 12, 0},
+		{"bob uploads the same blob", http.MethodPut, bob, http.StatusOK, 2, 12, 12},
+		{"alice deletes", http.MethodDelete, alice, http.StatusOK, 1, 0, 12},
+		{"alice deletes again", http.MethodDelete, alice, http.StatusNotFound, 1, 0, 12},
+		{"bob deletes", http.MethodDelete, bob, http.StatusOK, 0, 0, 0},
+		{"alice uploads it back", http.MethodPut, alice, http.StatusOK, 1, 12, 0},
+	}
+	for _, step := range steps {
+		w := blobRequest(t, h, step.method, step.sk, blob)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status %d (%s), want %d", step.name, w.Code, w.Header().Get("X-Reason"), step.wantStatus)
+		}
+		meta, found := s.meta(sha)
+		if step.wantOwners == 0 {
+			if found {
+				t.Errorf("%s: blob still indexed with %d owners", step.name, meta.Owners)
+			}
+			if _, err := os.Stat(s.path(sha)); !os.IsNotExist(err) {
+				t.Errorf("%s: blob file still on disk (%v)", step.name, err)
+			}
+		} else {
+			if !found || meta.Owners != step.wantOwners {
+				t.Errorf("%s: owners = %d (indexed %v), want %d", step.name, meta.Owners, found, step.wantOwners)
+			}
+			if _, err := os.Stat(s.path(sha)); err != nil {
+				t.Errorf("%s: blob file missing: %v", step.name, err)
+			}
+		}
+		if got := s.usage(alice.Public()); got != step.aliceUsage {
+			t.Errorf("%s: alice's usage = %d, want %d", step.name, got, step.aliceUsage)
+		}
+		if got := s.usage(bob.Public()); got != step.bobUsage {
+			t.Errorf("%s: bob's usage = %d, want %d", step.name, got, step.bobUsage)
+		}
+	}
+}
+
+func TestBlobQuota(t *testing.T) {
+	alice, bob := nostr.Generate(), nostr.Generate()
+	cfg := defaultConfig()
+	cfg.Blossom.Enabled = true
+	cfg.Blossom.Quota = 20
+	cfg.Blossom.Quotas = map[string]ByteSize{alice.Public().Hex(): 100}
+	s, h := newTestBlobStore(t, cfg)
+	tests := []struct {
+		name       string
+		sk         nostr.SecretKey
+		body       string
+		wantStatus int
+	}{
+		{"within the default quota", bob, "0123456789", http.StatusOK},
+		{"up to the default quota", bob, "abcdefghij", http.StatusOK},
+		{"over the default quota", bob, "x", http.StatusRequestEntityTooLarge},
+		{"a blob bob already owns", bob, "0123456789", http.StatusOK},
+		{"a per-pubkey quota", alice, strings.Repeat("a", 60), http.StatusOK},
+		{"over the per-pubkey quota", alice, strings.Repeat("b", 60), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if w := blobRequest(t, h, http.MethodPut, tt.sk, []byte(tt.body)); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d (%s), want %d", tt.name, w.Code, w.Header().Get("X-Reason"), tt.wantStatus)
+		}
+	}
+	if got := s.usage(bob.Public()); got != 20 {
+		t.Errorf("bob's usage = %d, want 20", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var clicksBucket = []byte("clicks")
+
+// clickWindow is how long one IP's click on a station suppresses further
+// clicks from the same IP, matching Radio Browser's once-a-day rule.
+const clickWindow = 24 * time.Hour
+
+// clickStore counts station plays reported through the Radio Browser
+// /json/url endpoint, keyed by station address. Counts live in a small bbolt
+// file next to LMDB; the per-IP dedupe window is in memory only, so a
+// restart at worst lets a listener count twice in one day.
+type clickStore struct {
+	db *bolt.DB
+
+	mu        sync.Mutex
+	recent    map[string]time.Time
+	lastSweep time.Time
+}
+
+func openClickStore(path string) (*clickStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening click counts: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(clicksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing click counts: %w", err)
+	}
+	return &clickStore{db: db, recent: make(map[string]time.Time)}, nil
+}
+
+func (c *clickStore) Close() error { return c.db.Close() }
+
+// Click records a play of addr from ip and reports whether it was counted.
+func (c *clickStore) Click(addr, ip string) (bool, error) {
+	if !c.firstToday(addr, ip) {
+		return false, nil
+	}
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(clicksBucket)
+		return b.Put([]byte(addr), encodeCount(decodeCount(b.Get([]byte(addr)))+1))
+	})
+	return err == nil, err
+}
+
+func (c *clickStore) firstToday(addr, ip string) bool {
+	now := time.Now()
+	key := ip + "|" + addr
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > time.Hour {
+		for k, t := range c.recent {
+			if now.Sub(t) > clickWindow {
+				delete(c.recent, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if t, ok := c.recent[key]; ok && now.Sub(t) < clickWindow {
+		return false
+	}
+	c.recent[key] = now
+	return true
+}
+
+// Count returns the click count of each address; unknown ones are 0.
+func (c *clickStore) Count(addrs ...string) map[string]uint64 {
+	out := make(map[string]uint64, len(addrs))
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(clicksBucket)
+		for _, addr := range addrs {
+			out[addr] = decodeCount(b.Get([]byte(addr)))
+		}
+		return nil
+	})
+	return out
+}
+
+type addressCount struct {
+	Address string
+	Count   uint64
+}
+
+// Top returns the n most-clicked addresses, most clicks first.
+func (c *clickStore) Top(n int) []addressCount {
+	var all []addressCount
+	c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(clicksBucket).ForEach(func(k, v []byte) error {
+			all = append(all, addressCount{Address: string(k), Count: decodeCount(v)})
+			return nil
+		})
+	})
+	slices.SortFunc(all, func(a, b addressCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Address, b.Address))
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func encodeCount(n uint64) []byte { return binary.BigEndian.AppendUint64(nil, n) }
+
+func decodeCount(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
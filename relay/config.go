@@ -0,0 +1,757 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// Config is everything the relay needs to know at startup. Values are layered
+// in this order, later layers winning:
+//
+//  1. defaultConfig()
+//  2. the TOML file passed via --config (or RELAY_CONFIG)
+//  3. RELAY_* environment variables (see applyEnv)
+//  4. command-line flags that were explicitly set
+//
+// The result is checked by Validate before anything is opened, so a typo in
+// a staging config fails the boot instead of silently advertising defaults.
+type Config struct {
+	Listen   ListenConfig   `toml:"listen"`
+	Info     InfoConfig     `toml:"info"`
+	Storage  StorageConfig  `toml:"storage"`
+	Limits   LimitsConfig   `toml:"limits"`
+	Log      LogConfig      `toml:"log"`
+	Policy   PolicyConfig   `toml:"policy"`
+	Admin    AdminConfig    `toml:"admin"`
+	Health   HealthConfig   `toml:"health"`
+	Web      WebConfig      `toml:"web"`
+	NIP05    NIP05Config    `toml:"nip05"`
+	Blossom  BlossomConfig  `toml:"blossom"`
+	Logos    LogosConfig    `toml:"logos"`
+	Trending TrendingConfig `toml:"trending"`
+	// Genres is the genre taxonomy, keyed by canonical genre name. The
+	// built-in genres (see defaultGenres) are merged with the file's;
+	// a [genres."name"] table replaces the built-in genre of that name.
+	Genres map[string]GenreConfig `toml:"genres"`
+}
+
+type ListenConfig struct {
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+	// ShutdownTimeout bounds how long SIGINT/SIGTERM waits for in-flight
+	// writes before flushing the index and exiting.
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+}
+
+// InfoConfig is the NIP-11 relay information document.
+type InfoConfig struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	PubKey      string `toml:"pubkey"`
+	Contact     string `toml:"contact"`
+	Icon        string `toml:"icon"`
+	Banner      string `toml:"banner"`
+}
+
+type StorageConfig struct {
+	DBPath     string `toml:"db_path"`
+	SearchPath string `toml:"search_path"`
+	// HistoryPath holds superseded versions of station events, which the
+	// main LMDB drops when a replaceable event is replaced.
+	HistoryPath string `toml:"history_path"`
+	// ClicksPath is the bbolt file holding Radio Browser click counts.
+	ClicksPath string `toml:"clicks_path"`
+	// CountsPath is the bbolt file holding NIP-45 HyperLogLog registers.
+	CountsPath string `toml:"counts_path"`
+	// KeyPath is the relay's own secret key, created on first start.
+	KeyPath string `toml:"key_path"`
+	// BlobsPath holds Blossom blobs and their ownership index.
+	BlobsPath string `toml:"blobs_path"`
+	// LogosPath holds mirrored, resized station logos.
+	LogosPath string `toml:"logos_path"`
+}
+
+type LimitsConfig struct {
+	// MaxQueryLimit caps how many events a single LMDB-backed REQ returns.
+	MaxQueryLimit int `toml:"max_query_limit"`
+	// MaxSearchLimit caps how many hits a single NIP-50 REQ returns.
+	MaxSearchLimit int `toml:"max_search_limit"`
+	// MaxCountScan caps how many LMDB events a COUNT fallback will iterate.
+	MaxCountScan int `toml:"max_count_scan"`
+	// CountCacheSize is how many COUNT results are kept by filter (0
+	// disables the cache); CountCacheTTL bounds how long one is trusted.
+	CountCacheSize int      `toml:"count_cache_size"`
+	CountCacheTTL  Duration `toml:"count_cache_ttl"`
+	// MaxContentLength and MaxEventTags reject oversized events (0 = no limit).
+	MaxContentLength int `toml:"max_content_length"`
+	MaxEventTags     int `toml:"max_event_tags"`
+}
+
+type LogConfig struct {
+	Format      string   `toml:"format"`
+	Level       string   `toml:"level"`
+	QuerySample float64  `toml:"query_sample"`
+	SlowQuery   Duration `toml:"slow_query"`
+}
+
+// PolicyConfig controls which events the relay accepts.
+type PolicyConfig struct {
+	// TrustedKeys bypass the kind allow-list and the rate limit. The catalog
+	// and observer keys belong here.
+	TrustedKeys []string `toml:"trusted_keys"`
+	// BlockedPubkeys are rejected outright.
+	BlockedPubkeys []string `toml:"blocked_pubkeys"`
+	// AllowedKinds, if non-empty, is the complete list of kinds accepted from
+	// untrusted authors.
+	AllowedKinds []int `toml:"allowed_kinds"`
+	// EventsPerMinute is the sustained per-IP write rate for untrusted
+	// authors, with bursts of up to EventBurst (0 disables rate limiting).
+	EventsPerMinute float64 `toml:"events_per_minute"`
+	EventBurst      int     `toml:"event_burst"`
+}
+
+// AdminConfig lists the pubkeys allowed to call the /admin HTTP endpoints.
+// Requests authenticate with a NIP-98 Authorization header. With no keys
+// configured the admin endpoints are disabled.
+type AdminConfig struct {
+	Pubkeys []string `toml:"pubkeys"`
+}
+
+// HealthConfig tunes /readyz and /stats.
+type HealthConfig struct {
+	// StatsInterval is how often the per-kind event counts, otherwise kept
+	// up to date by writes, are checked against a full LMDB scan.
+	StatsInterval Duration `toml:"stats_interval"`
+	// MaxIndexDrift is the fraction of LMDB stations that may be missing
+	// from the search index before /readyz reports not ready.
+	MaxIndexDrift float64 `toml:"max_index_drift"`
+}
+
+// WebConfig describes the public web app, which feeds and pages link to.
+type WebConfig struct {
+	// URL is the SPA's base URL; stations live at <url>/station/<naddr>.
+	URL string `toml:"url"`
+}
+
+// NIP05Config tunes the /.well-known/nostr.json registry.
+type NIP05Config struct {
+	// Relays are advertised for names whose registration lists none.
+	Relays []string `toml:"relays"`
+}
+
+// BlossomConfig controls the BUD-01/BUD-02 blob server.
+type BlossomConfig struct {
+	Enabled bool `toml:"enabled"`
+	// URL is the base of the blob URLs handed out in descriptors. Empty
+	// means the host the upload came in on.
+	URL string `toml:"url"`
+	// MaxUploadSize bounds a single blob.
+	MaxUploadSize ByteSize `toml:"max_upload_size"`
+	// Quota is how much each pubkey may store (0 = unlimited); Quotas
+	// overrides it for individual pubkeys.
+	Quota  ByteSize            `toml:"quota"`
+	Quotas map[string]ByteSize `toml:"quotas"`
+	// AllowedTypes are MIME types ("image/png") or whole families
+	// ("image/*") accepted for upload.
+	AllowedTypes []string `toml:"allowed_types"`
+}
+
+// Duration lets TOML files say `slow_query = "250ms"`.
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// LogosConfig controls station logo mirroring at /img/{pubkey}/{d}/{size}.
+type LogosConfig struct {
+	Enabled bool `toml:"enabled"`
+	// FetchOnWrite mirrors a logo as soon as its station is stored;
+	// otherwise it is fetched on first request.
+	FetchOnWrite  bool     `toml:"fetch_on_write"`
+	FetchTimeout  Duration `toml:"fetch_timeout"`
+	MaxSourceSize ByteSize `toml:"max_source_size"`
+	// RetryAfter is how long a failed fetch is remembered before the
+	// origin is tried again.
+	RetryAfter Duration `toml:"retry_after"`
+	// AllowPrivateHosts permits origins on loopback and private addresses,
+	// for tests and local development.
+	AllowPrivateHosts bool `toml:"allow_private_hosts"`
+}
+
+// TrendingConfig controls the trending-stations engine and the ranking
+// events it publishes.
+type TrendingConfig struct {
+	Enabled bool `toml:"enabled"`
+	// HalfLife is how long it takes an interaction's weight to halve.
+	HalfLife Duration `toml:"half_life"`
+	// PublishInterval is how often the ranking is published as a
+	// relay-signed kind-31240 event; 0 turns publishing off.
+	PublishInterval Duration `toml:"publish_interval"`
+	// Size is how many stations the published ranking holds.
+	Size int `toml:"size"`
+	// What one author's interaction with a station is worth.
+	ReactionWeight float64 `toml:"reaction_weight"`
+	ZapWeight      float64 `toml:"zap_weight"`
+	FavoriteWeight float64 `toml:"favorite_weight"`
+	CommentWeight  float64 `toml:"comment_weight"`
+}
+
+// GenreConfig is one genre of the taxonomy: the spellings station tags use
+// for it, and the broader genre it belongs to.
+type GenreConfig struct {
+	Parent  string   `toml:"parent"`
+	Aliases []string `toml:"aliases"`
+}
+
+// ByteSize lets TOML files say `quota = "100MB"`. Units are binary (1KB is
+// 1024 bytes); a bare number is bytes.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if rest, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(rest), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a size like 512KB or 100MB", text)
+	}
+	*b = ByteSize(n * float64(unit))
+	return nil
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	for _, u := range byteUnits[:3] {
+		if b >= ByteSize(u.size) && int64(b)%u.size == 0 {
+			return []byte(strconv.FormatInt(int64(b)/u.size, 10) + u.suffix), nil
+		}
+	}
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ListenConfig{Host: "0.0.0.0", Port: 3334, ShutdownTimeout: Duration{10 * time.Second}},
+		Info: InfoConfig{
+			Name:        "WaveFunc Radio Relay",
+			Description: "A Nostr relay for internet radio stations with full-text search",
+			Icon:        "https://wavefunc.live/icons/logo.png",
+			Contact:     "https://github.com/schlaus/wavefunc-rewrite",
+		},
+		Storage: StorageConfig{
+			DBPath:      "./data/events",
+			SearchPath:  "./data/search",
+			HistoryPath: "./data/history",
+			ClicksPath:  "./data/clicks.db",
+			CountsPath:  "./data/counts.db",
+			KeyPath:     "./data/relay.key",
+			BlobsPath:   "./data/blobs",
+			LogosPath:   "./data/logos",
+		},
+		Limits: LimitsConfig{
+			MaxQueryLimit:  1000,
+			MaxSearchLimit: 100,
+			MaxCountScan:   200_000,
+			CountCacheSize: 10_000,
+			CountCacheTTL:  Duration{10 * time.Minute},
+		},
+		Log: LogConfig{
+			Format:      "text",
+			Level:       "info",
+			QuerySample: 1.0,
+			SlowQuery:   Duration{500 * time.Millisecond},
+		},
+		Health: HealthConfig{
+			StatsInterval: Duration{24 * time.Hour},
+			MaxIndexDrift: 0.05,
+		},
+		Web:   WebConfig{URL: "https://wavefunc.live"},
+		NIP05: NIP05Config{Relays: []string{"wss://relay.wavefunc.live"}},
+		Blossom: BlossomConfig{
+			Enabled:       true,
+			MaxUploadSize: 50 << 20,
+			Quota:         100 << 20,
+			AllowedTypes:  []string{"image/*", "audio/*"},
+		},
+		Logos: LogosConfig{
+			Enabled:       true,
+			FetchOnWrite:  true,
+			FetchTimeout:  Duration{10 * time.Second},
+			MaxSourceSize: 5 << 20,
+			RetryAfter:    Duration{6 * time.Hour},
+		},
+		Trending: TrendingConfig{
+			Enabled:         true,
+			HalfLife:        Duration{24 * time.Hour},
+			PublishInterval: Duration{15 * time.Minute},
+			Size:            50,
+			ReactionWeight:  1,
+			ZapWeight:       3,
+			FavoriteWeight:  4,
+			CommentWeight:   2,
+		},
+		Genres: defaultGenres(),
+	}
+}
+
+// loadConfig builds the effective configuration from defaults, the optional
+// TOML file at path, and the environment. Flags are applied by the caller.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		md, err := toml.DecodeFile(path, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return cfg, fmt.Errorf("config %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overlays RELAY_* variables. PORT is honoured as well because
+// that's what pm2 and deploy-remote.sh already export.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an integer", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v, ok := lookup(name); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = f
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	size := func(name string, dst *ByteSize) {
+		if v, ok := lookup(name); ok {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+	duration := func(name string, dst *Duration) {
+		if v, ok := lookup(name); ok {
+			if err := dst.UnmarshalText([]byte(strings.TrimSpace(v))); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", name, v))
+			}
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := lookup(name); ok {
+			*dst = splitList(v)
+		}
+	}
+	kinds := func(name string, dst *[]int) {
+		if v, ok := lookup(name); ok {
+			var out []int
+			for _, s := range splitList(v) {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %q is not a kind number", name, s))
+					return
+				}
+				out = append(out, n)
+			}
+			*dst = out
+		}
+	}
+
+	str("RELAY_HOST", &c.Listen.Host)
+	integer("PORT", &c.Listen.Port)
+	integer("RELAY_PORT", &c.Listen.Port)
+	duration("RELAY_SHUTDOWN_TIMEOUT", &c.Listen.ShutdownTimeout)
+
+	str("RELAY_NAME", &c.Info.Name)
+	str("RELAY_DESCRIPTION", &c.Info.Description)
+	str("RELAY_PUBKEY", &c.Info.PubKey)
+	str("RELAY_CONTACT", &c.Info.Contact)
+	str("RELAY_ICON", &c.Info.Icon)
+	str("RELAY_BANNER", &c.Info.Banner)
+
+	str("RELAY_DB_PATH", &c.Storage.DBPath)
+	str("RELAY_SEARCH_PATH", &c.Storage.SearchPath)
+	str("RELAY_HISTORY_PATH", &c.Storage.HistoryPath)
+	str("RELAY_CLICKS_PATH", &c.Storage.ClicksPath)
+	str("RELAY_COUNTS_PATH", &c.Storage.CountsPath)
+	str("RELAY_KEY_PATH", &c.Storage.KeyPath)
+	str("RELAY_BLOBS_PATH", &c.Storage.BlobsPath)
+	str("RELAY_LOGOS_PATH", &c.Storage.LogosPath)
+
+	integer("RELAY_MAX_QUERY_LIMIT", &c.Limits.MaxQueryLimit)
+	integer("RELAY_MAX_SEARCH_LIMIT", &c.Limits.MaxSearchLimit)
+	integer("RELAY_MAX_COUNT_SCAN", &c.Limits.MaxCountScan)
+	integer("RELAY_COUNT_CACHE_SIZE", &c.Limits.CountCacheSize)
+	duration("RELAY_COUNT_CACHE_TTL", &c.Limits.CountCacheTTL)
+	integer("RELAY_MAX_CONTENT_LENGTH", &c.Limits.MaxContentLength)
+	integer("RELAY_MAX_EVENT_TAGS", &c.Limits.MaxEventTags)
+
+	str("RELAY_LOG_FORMAT", &c.Log.Format)
+	str("RELAY_LOG_LEVEL", &c.Log.Level)
+	float("RELAY_QUERY_LOG_SAMPLE", &c.Log.QuerySample)
+	duration("RELAY_SLOW_QUERY", &c.Log.SlowQuery)
+
+	list("RELAY_TRUSTED_KEYS", &c.Policy.TrustedKeys)
+	list("RELAY_BLOCKED_PUBKEYS", &c.Policy.BlockedPubkeys)
+	kinds("RELAY_ALLOWED_KINDS", &c.Policy.AllowedKinds)
+	float("RELAY_EVENTS_PER_MINUTE", &c.Policy.EventsPerMinute)
+	integer("RELAY_EVENT_BURST", &c.Policy.EventBurst)
+
+	list("RELAY_ADMIN_PUBKEYS", &c.Admin.Pubkeys)
+
+	duration("RELAY_STATS_INTERVAL", &c.Health.StatsInterval)
+	float("RELAY_MAX_INDEX_DRIFT", &c.Health.MaxIndexDrift)
+
+	str("RELAY_WEB_URL", &c.Web.URL)
+
+	list("RELAY_NIP05_RELAYS", &c.NIP05.Relays)
+
+	boolean("RELAY_BLOSSOM_ENABLED", &c.Blossom.Enabled)
+	str("RELAY_BLOSSOM_URL", &c.Blossom.URL)
+	size("RELAY_BLOSSOM_MAX_UPLOAD_SIZE", &c.Blossom.MaxUploadSize)
+	size("RELAY_BLOSSOM_QUOTA", &c.Blossom.Quota)
+	list("RELAY_BLOSSOM_ALLOWED_TYPES", &c.Blossom.AllowedTypes)
+
+	boolean("RELAY_LOGOS_ENABLED", &c.Logos.Enabled)
+	boolean("RELAY_LOGOS_FETCH_ON_WRITE", &c.Logos.FetchOnWrite)
+	duration("RELAY_LOGOS_FETCH_TIMEOUT", &c.Logos.FetchTimeout)
+	size("RELAY_LOGOS_MAX_SOURCE_SIZE", &c.Logos.MaxSourceSize)
+	duration("RELAY_LOGOS_RETRY_AFTER", &c.Logos.RetryAfter)
+	boolean("RELAY_LOGOS_ALLOW_PRIVATE_HOSTS", &c.Logos.AllowPrivateHosts)
+
+	boolean("RELAY_TRENDING_ENABLED", &c.Trending.Enabled)
+	duration("RELAY_TRENDING_HALF_LIFE", &c.Trending.HalfLife)
+	duration("RELAY_TRENDING_PUBLISH_INTERVAL", &c.Trending.PublishInterval)
+	integer("RELAY_TRENDING_SIZE", &c.Trending.Size)
+	float("RELAY_TRENDING_REACTION_WEIGHT", &c.Trending.ReactionWeight)
+	float("RELAY_TRENDING_ZAP_WEIGHT", &c.Trending.ZapWeight)
+	float("RELAY_TRENDING_FAVORITE_WEIGHT", &c.Trending.FavoriteWeight)
+	float("RELAY_TRENDING_COMMENT_WEIGHT", &c.Trending.CommentWeight)
+
+	return errors.Join(errs...)
+}
+
+// splitList accepts comma- and/or whitespace-separated values.
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// Validate reports every problem at once rather than stopping at the first,
+// so fixing a config is one round trip.
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listen.Host != "" && net.ParseIP(c.Listen.Host) == nil && c.Listen.Host != "localhost" {
+		bad("listen.host: %q is not an IP address", c.Listen.Host)
+	}
+	if c.Listen.Port < 1 || c.Listen.Port > 65535 {
+		bad("listen.port: %d is out of range 1-65535", c.Listen.Port)
+	}
+	if c.Listen.ShutdownTimeout.Duration <= 0 {
+		bad("listen.shutdown_timeout: must be positive")
+	}
+
+	if strings.TrimSpace(c.Info.Name) == "" {
+		bad("info.name: must not be empty")
+	}
+	if c.Info.PubKey != "" {
+		if _, err := nostr.PubKeyFromHex(c.Info.PubKey); err != nil {
+			bad("info.pubkey: %q is not a 64-char hex pubkey", c.Info.PubKey)
+		}
+	}
+
+	if c.Storage.DBPath == "" {
+		bad("storage.db_path: must not be empty")
+	}
+	if c.Storage.SearchPath == "" {
+		bad("storage.search_path: must not be empty")
+	}
+	if c.Storage.HistoryPath == "" {
+		bad("storage.history_path: must not be empty")
+	}
+	if c.Storage.ClicksPath == "" {
+		bad("storage.clicks_path: must not be empty")
+	}
+	if c.Storage.CountsPath == "" {
+		bad("storage.counts_path: must not be empty")
+	}
+	if c.Storage.KeyPath == "" {
+		bad("storage.key_path: must not be empty")
+	}
+	if c.Storage.BlobsPath == "" {
+		bad("storage.blobs_path: must not be empty")
+	}
+	if c.Storage.LogosPath == "" {
+		bad("storage.logos_path: must not be empty")
+	}
+	if c.Storage.DBPath != "" && c.Storage.DBPath == c.Storage.SearchPath {
+		bad("storage: db_path and search_path must differ (both %q)", c.Storage.DBPath)
+	}
+	if c.Storage.HistoryPath != "" && (c.Storage.HistoryPath == c.Storage.DBPath || c.Storage.HistoryPath == c.Storage.SearchPath) {
+		bad("storage: history_path must differ from db_path and search_path (%q)", c.Storage.HistoryPath)
+	}
+
+	if c.Limits.MaxQueryLimit < 1 {
+		bad("limits.max_query_limit: must be at least 1, got %d", c.Limits.MaxQueryLimit)
+	}
+	if c.Limits.MaxSearchLimit < 1 {
+		bad("limits.max_search_limit: must be at least 1, got %d", c.Limits.MaxSearchLimit)
+	}
+	if c.Limits.MaxCountScan < 1 {
+		bad("limits.max_count_scan: must be at least 1, got %d", c.Limits.MaxCountScan)
+	}
+	if c.Limits.CountCacheSize < 0 {
+		bad("limits.count_cache_size: must not be negative")
+	}
+	if c.Limits.CountCacheTTL.Duration <= 0 {
+		bad("limits.count_cache_ttl: must be positive")
+	}
+	if c.Limits.MaxContentLength < 0 {
+		bad("limits.max_content_length: must not be negative")
+	}
+	if c.Limits.MaxEventTags < 0 {
+		bad("limits.max_event_tags: must not be negative")
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		bad("log.level: %v", err)
+	}
+	if _, err := newLogger(c.Log.Format, slog.LevelInfo); err != nil {
+		bad("log.format: %v", err)
+	}
+	if c.Log.QuerySample < 0 || c.Log.QuerySample > 1 {
+		bad("log.query_sample: must be between 0 and 1, got %v", c.Log.QuerySample)
+	}
+	if c.Log.SlowQuery.Duration < 0 {
+		bad("log.slow_query: must not be negative")
+	}
+
+	if err := c.Policy.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Health.StatsInterval.Duration < time.Second {
+		bad("health.stats_interval: must be at least 1s")
+	}
+	if c.Health.MaxIndexDrift < 0 || c.Health.MaxIndexDrift > 1 {
+		bad("health.max_index_drift: must be between 0 and 1, got %v", c.Health.MaxIndexDrift)
+	}
+	for i, k := range c.Admin.Pubkeys {
+		if _, err := nostr.PubKeyFromHex(k); err != nil {
+			bad("admin.pubkeys[%d]: %q is not a 64-char hex pubkey", i, k)
+		}
+	}
+	if u, err := url.Parse(c.Web.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		bad("web.url: %q is not an absolute http(s) URL", c.Web.URL)
+	}
+	for i, relay := range c.NIP05.Relays {
+		if u, err := url.Parse(relay); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			bad("nip05.relays[%d]: %q is not a ws(s) URL", i, relay)
+		}
+	}
+	if err := c.Blossom.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Logos.FetchTimeout.Duration <= 0 {
+		bad("logos.fetch_timeout: must be positive")
+	}
+	if c.Logos.MaxSourceSize < 1 {
+		bad("logos.max_source_size: must be positive")
+	}
+	if c.Logos.RetryAfter.Duration < 0 {
+		bad("logos.retry_after: must not be negative")
+	}
+	if c.Trending.HalfLife.Duration < time.Minute {
+		bad("trending.half_life: must be at least 1m")
+	}
+	if c.Trending.PublishInterval.Duration < 0 {
+		bad("trending.publish_interval: must not be negative")
+	}
+	if c.Trending.Size < 1 || c.Trending.Size > maxTrendingSize {
+		bad("trending.size: %d is out of range 1-%d", c.Trending.Size, maxTrendingSize)
+	}
+	if c.Trending.ReactionWeight < 0 {
+		bad("trending.reaction_weight: must not be negative")
+	}
+	if c.Trending.ZapWeight < 0 {
+		bad("trending.zap_weight: must not be negative")
+	}
+	if c.Trending.FavoriteWeight < 0 {
+		bad("trending.favorite_weight: must not be negative")
+	}
+	if c.Trending.CommentWeight < 0 {
+		bad("trending.comment_weight: must not be negative")
+	}
+	validateGenres(c.Genres, bad)
+
+	return errors.Join(errs...)
+}
+
+func (p PolicyConfig) validate() error {
+	var errs []error
+	for i, k := range p.TrustedKeys {
+		if _, err := nostr.PubKeyFromHex(k); err != nil {
+			errs = append(errs, fmt.Errorf("policy.trusted_keys[%d]: %q is not a 64-char hex pubkey", i, k))
+		}
+	}
+	for i, k := range p.BlockedPubkeys {
+		if _, err := nostr.PubKeyFromHex(k); err != nil {
+			errs = append(errs, fmt.Errorf("policy.blocked_pubkeys[%d]: %q is not a 64-char hex pubkey", i, k))
+		}
+	}
+	for i, k := range p.AllowedKinds {
+		if k < 0 || k > 65535 {
+			errs = append(errs, fmt.Errorf("policy.allowed_kinds[%d]: %d is not a valid kind", i, k))
+		}
+	}
+	if p.EventsPerMinute < 0 {
+		errs = append(errs, fmt.Errorf("policy.events_per_minute: must not be negative"))
+	}
+	if p.EventBurst < 0 {
+		errs = append(errs, fmt.Errorf("policy.event_burst: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (b BlossomConfig) validate() error {
+	var errs []error
+	if b.URL != "" {
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("blossom.url: %q is not an absolute http(s) URL", b.URL))
+		}
+	}
+	if b.MaxUploadSize < 1 {
+		errs = append(errs, fmt.Errorf("blossom.max_upload_size: must be positive"))
+	}
+	if b.Quota < 0 {
+		errs = append(errs, fmt.Errorf("blossom.quota: must not be negative"))
+	}
+	for k := range b.Quotas {
+		if _, err := nostr.PubKeyFromHex(k); err != nil {
+			errs = append(errs, fmt.Errorf("blossom.quotas: %q is not a 64-char hex pubkey", k))
+		}
+	}
+	for i, t := range b.AllowedTypes {
+		if family, sub, ok := strings.Cut(t, "/"); !ok || family == "" || sub == "" || strings.ContainsAny(t, " ;") {
+			errs = append(errs, fmt.Errorf("blossom.allowed_types[%d]: %q is not a MIME type like image/png or image/*", i, t))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// quotaFor is how many bytes pk may store, 0 meaning unlimited.
+func (b BlossomConfig) quotaFor(pk nostr.PubKey) int64 {
+	if q, ok := b.Quotas[pk.Hex()]; ok {
+		return int64(q)
+	}
+	return int64(b.Quota)
+}
+
+// allowsType reports whether uploads of MIME type t are accepted.
+func (b BlossomConfig) allowsType(t string) bool {
+	family, _, _ := strings.Cut(t, "/")
+	for _, allowed := range b.AllowedTypes {
+		if strings.EqualFold(allowed, t) || strings.EqualFold(allowed, family+"/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// relayPubKey returns the configured NIP-11 pubkey, or nil to omit it.
+func (c InfoConfig) relayPubKey() *nostr.PubKey {
+	if c.PubKey == "" {
+		return nil
+	}
+	pk, err := nostr.PubKeyFromHex(c.PubKey)
+	if err != nil {
+		return nil
+	}
+	return &pk
+}
+
+// relayInfo renders the NIP-11 document for this config.
+func (c Config) relayInfo() *nip11.RelayInformationDocument {
+	return &nip11.RelayInformationDocument{
+		Name:          c.Info.Name,
+		Description:   c.Info.Description,
+		PubKey:        c.Info.relayPubKey(),
+		Icon:          c.Info.Icon,
+		Banner:        c.Info.Banner,
+		Contact:       c.Info.Contact,
+		SupportedNIPs: []any{1, 9, 11, 12, 15, 16, 20, 22, 33, 40, 45, 50},
+		Limitation: &nip11.RelayLimitationDocument{
+			MaxLimit:         c.Limits.MaxQueryLimit,
+			MaxContentLength: c.Limits.MaxContentLength,
+			MaxEventTags:     c.Limits.MaxEventTags,
+		},
+	}
+}
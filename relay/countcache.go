@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// countCache remembers COUNT results by normalised filter, so the same
+// "comments on station X" count asked by every visitor costs one LMDB scan
+// until something changes it. Each stored, replaced or deleted event drops
+// exactly the entries whose filter it matches; search entries are dropped by
+// any station write that passes their kind, author and time constraints,
+// since whether the text matches isn't known without asking bleve.
+//
+// Events can also leave LMDB without passing through the relay's wrappers
+// (expiration), so entries additionally expire after a TTL.
+type countCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// byKind indexes entry keys by the kinds their filter names; entries
+	// with no kinds are under anyKind.
+	byKind map[nostr.Kind]map[string]struct{}
+	// versions counts invalidating events per kind, and total across all
+	// kinds, so a result computed while a matching event arrived isn't
+	// cached.
+	versions map[nostr.Kind]uint64
+	total    uint64
+}
+
+// anyKind stands for filters without a kinds constraint. Kind 65535 is
+// never a real event kind in practice.
+const anyKind = nostr.Kind(65535)
+
+type countEntry struct {
+	key     string
+	filter  nostr.Filter
+	count   uint32
+	expires time.Time
+}
+
+func newCountCache() *countCache {
+	return &countCache{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		byKind:   make(map[nostr.Kind]map[string]struct{}),
+		versions: make(map[nostr.Kind]uint64),
+	}
+}
+
+// countKey normalises filter: kinds, authors, IDs and tag values are sorted
+// and deduplicated and the search string is lower-cased with whitespace
+// collapsed, so equivalent filters share an entry. Limit is ignored, as
+// COUNT ignores it.
+func countKey(filter nostr.Filter) string {
+	var b strings.Builder
+	kinds := make([]int, len(filter.Kinds))
+	for i, k := range filter.Kinds {
+		kinds[i] = int(k)
+	}
+	slices.Sort(kinds)
+	b.WriteString("k=")
+	for _, k := range slices.Compact(kinds) {
+		b.WriteString(strconv.Itoa(k) + ",")
+	}
+	writeSorted := func(name string, values []string) {
+		b.WriteString(";" + name + "=")
+		values = slices.Clone(values)
+		slices.Sort(values)
+		b.WriteString(strings.Join(slices.Compact(values), ","))
+	}
+	authors := make([]string, len(filter.Authors))
+	for i, pk := range filter.Authors {
+		authors[i] = pk.Hex()
+	}
+	writeSorted("a", authors)
+	ids := make([]string, len(filter.IDs))
+	for i, id := range filter.IDs {
+		ids[i] = id.Hex()
+	}
+	writeSorted("i", ids)
+	names := make([]string, 0, len(filter.Tags))
+	for name := range filter.Tags {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		writeSorted("#"+name, filter.Tags[name])
+	}
+	b.WriteString(";s=" + strconv.FormatUint(uint64(filter.Since), 10))
+	b.WriteString(";u=" + strconv.FormatUint(uint64(filter.Until), 10))
+	b.WriteString(";q=" + strings.Join(strings.Fields(strings.ToLower(filter.Search)), " "))
+	return b.String()
+}
+
+// filterKinds is the byKind index a filter lives under.
+func filterKinds(filter nostr.Filter) []nostr.Kind {
+	if len(filter.Kinds) == 0 {
+		return []nostr.Kind{anyKind}
+	}
+	return filter.Kinds
+}
+
+// get returns the cached count under key, if any.
+func (c *countCache) get(key string) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := el.Value.(*countEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return 0, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.count, true
+}
+
+// version snapshots the invalidation counters for filter's kinds; put only
+// caches a count if they haven't moved since.
+func (c *countCache) version(filter nostr.Filter) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.versionLocked(filter)
+}
+
+func (c *countCache) versionLocked(filter nostr.Filter) uint64 {
+	if len(filter.Kinds) == 0 {
+		return c.total
+	}
+	var v uint64
+	for _, k := range filter.Kinds {
+		v += c.versions[k]
+	}
+	return v
+}
+
+// put caches count for filter unless an event that could change it was
+// observed after version was taken. size <= 0 disables the cache.
+func (c *countCache) put(key string, filter nostr.Filter, count uint32, version uint64, size int, ttl time.Duration) {
+	if size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versionLocked(filter) != version {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	entry := &countEntry{key: key, filter: filter, count: count, expires: time.Now().Add(ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	for _, k := range filterKinds(filter) {
+		if c.byKind[k] == nil {
+			c.byKind[k] = make(map[string]struct{})
+		}
+		c.byKind[k][key] = struct{}{}
+	}
+	for c.lru.Len() > size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops el; c.mu must be held.
+func (c *countCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*countEntry)
+	delete(c.entries, entry.key)
+	for _, k := range filterKinds(entry.filter) {
+		delete(c.byKind[k], entry.key)
+		if len(c.byKind[k]) == 0 {
+			delete(c.byKind, k)
+		}
+	}
+}
+
+// invalidate drops every entry whose count evt's arrival or removal
+// changes.
+func (c *countCache) invalidate(evt nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[evt.Kind]++
+	c.total++
+	for _, k := range []nostr.Kind{evt.Kind, anyKind} {
+		for key := range c.byKind[k] {
+			el := c.entries[key]
+			if countFilterMatches(el.Value.(*countEntry).filter, evt) {
+				c.remove(el)
+			}
+		}
+	}
+}
+
+// countFilterMatches is filter.Matches, except that for search filters the
+// text is assumed to match any station.
+func countFilterMatches(filter nostr.Filter, evt nostr.Event) bool {
+	if filter.Search == "" {
+		return filter.Matches(evt)
+	}
+	if evt.Kind != indexedKind {
+		return false
+	}
+	filter.Search = ""
+	filter.Tags = nil
+	return filter.Matches(evt)
+}
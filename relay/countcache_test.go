@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestCountKey(t *testing.T) {
+	alice, bob := nostr.Generate().Public(), nostr.Generate().Public()
+	tests := []struct {
+		name string
+		a, b nostr.Filter
+		same bool
+	}{
+		{
+			name: "kind order and duplicates",
+			a:    nostr.Filter{Kinds: []nostr.Kind{1, 7, 7}},
+			b:    nostr.Filter{Kinds: []nostr.Kind{7, 1}},
+			same: true,
+		},
+		{
+			name: "author order",
+			a:    nostr.Filter{Authors: []nostr.PubKey{alice, bob}},
+			b:    nostr.Filter{Authors: []nostr.PubKey{bob, alice, bob}},
+			same: true,
+		},
+		{
+			name: "tag value order",
+			a:    nostr.Filter{Tags: nostr.TagMap{"t": {"jazz", "rock"}, "a": {"x"}}},
+			b:    nostr.Filter{Tags: nostr.TagMap{"a": {"x"}, "t": {"rock", "jazz", "jazz"}}},
+			same: true,
+		},
+		{
+			name: "search case and spacing",
+			a:    nostr.Filter{Search: "Jazz  FM "},
+			b:    nostr.Filter{Search: "jazz fm"},
+			same: true,
+		},
+		{
+			name: "limit is ignored",
+			a:    nostr.Filter{Kinds: []nostr.Kind{7}, Limit: 10},
+			b:    nostr.Filter{Kinds: []nostr.Kind{7}},
+			same: true,
+		},
+		{
+			name: "different kinds",
+			a:    nostr.Filter{Kinds: []nostr.Kind{7}},
+			b:    nostr.Filter{Kinds: []nostr.Kind{1}},
+		},
+		{
+			name: "tag name matters",
+			a:    nostr.Filter{Tags: nostr.TagMap{"a": {"x"}}},
+			b:    nostr.Filter{Tags: nostr.TagMap{"e": {"x"}}},
+		},
+		{
+			name: "tag values are not merged across names",
+			a:    nostr.Filter{Tags: nostr.TagMap{"a": {"x", "y"}}},
+			b:    nostr.Filter{Tags: nostr.TagMap{"a": {"x"}, "e": {"y"}}},
+		},
+		{
+			name: "since and until",
+			a:    nostr.Filter{Since: 10},
+			b:    nostr.Filter{Until: 10},
+		},
+		{
+			name: "search words",
+			a:    nostr.Filter{Search: "jazz fm"},
+			b:    nostr.Filter{Search: "fm jazz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ka, kb := countKey(tt.a), countKey(tt.b)
+			if (ka == kb) != tt.same {
+				t.Errorf("keys %q and %q: same = %v, want %v", ka, kb, ka == kb, tt.same)
+			}
+		})
+	}
+}
+
+func TestCountCacheInvalidate(t *testing.T) {
+	alice, bob := nostr.Generate().Public(), nostr.Generate().Public()
+	station := "31237:" + alice.Hex() + ":station"
+	filters := map[string]nostr.Filter{
+		"reactions":       {Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {station}}},
+		"comments":        {Kinds: []nostr.Kind{1111}, Tags: nostr.TagMap{"a": {station}}},
+		"bob's reactions": {Kinds: []nostr.Kind{7}, Authors: []nostr.PubKey{bob}},
+		"old reactions":   {Kinds: []nostr.Kind{7}, Until: 100},
+		"anything tagged": {Tags: nostr.TagMap{"a": {station}}},
+		"station search":  {Kinds: []nostr.Kind{indexedKind}, Search: "jazz"},
+		"alice's search":  {Kinds: []nostr.Kind{indexedKind}, Authors: []nostr.PubKey{alice}, Search: "jazz"},
+	}
+	tests := []struct {
+		name    string
+		evt     nostr.Event
+		dropped []string
+	}{
+		{
+			name:    "reaction to the station",
+			evt:     nostr.Event{Kind: 7, PubKey: alice, CreatedAt: 500, Tags: nostr.Tags{{"a", station}}},
+			dropped: []string{"reactions", "anything tagged"},
+		},
+		{
+			name:    "bob's old reaction elsewhere",
+			evt:     nostr.Event{Kind: 7, PubKey: bob, CreatedAt: 50, Tags: nostr.Tags{{"a", "31237:other:x"}}},
+			dropped: []string{"bob's reactions", "old reactions"},
+		},
+		{
+			name:    "unrelated kind",
+			evt:     nostr.Event{Kind: 1, PubKey: alice, CreatedAt: 500},
+			dropped: nil,
+		},
+		{
+			// search text isn't checked, so any station may match
+			name:    "bob's station",
+			evt:     nostr.Event{Kind: indexedKind, PubKey: bob, CreatedAt: 500, Tags: nostr.Tags{{"d", "x"}}},
+			dropped: []string{"station search"},
+		},
+		{
+			name:    "alice's station",
+			evt:     nostr.Event{Kind: indexedKind, PubKey: alice, CreatedAt: 500, Tags: nostr.Tags{{"d", "x"}}},
+			dropped: []string{"station search", "alice's search"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCountCache()
+			for _, f := range filters {
+				key := countKey(f)
+				c.put(key, f, 1, c.version(f), 100, time.Hour)
+			}
+			c.invalidate(tt.evt)
+			for name, f := range filters {
+				_, cached := c.get(countKey(f))
+				want := true
+				for _, d := range tt.dropped {
+					if d == name {
+						want = false
+					}
+				}
+				if cached != want {
+					t.Errorf("%s: cached = %v, want %v", name, cached, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCountCachePut(t *testing.T) {
+	f := nostr.Filter{Kinds: []nostr.Kind{7}}
+	key := countKey(f)
+
+	t.Run("invalidated while counting", func(t *testing.T) {
+		c := newCountCache()
+		v := c.version(f)
+		c.invalidate(nostr.Event{Kind: 7})
+		c.put(key, f, 3, v, 100, time.Hour)
+		if _, ok := c.get(key); ok {
+			t.Error("stale count was cached")
+		}
+	})
+
+	t.Run("other kind while counting", func(t *testing.T) {
+		c := newCountCache()
+		v := c.version(f)
+		c.invalidate(nostr.Event{Kind: 1})
+		c.put(key, f, 3, v, 100, time.Hour)
+		if n, ok := c.get(key); !ok || n != 3 {
+			t.Errorf("get = %d, %v, want 3, true", n, ok)
+		}
+	})
+
+	t.Run("kindless filter sees every kind", func(t *testing.T) {
+		c := newCountCache()
+		kindless := nostr.Filter{Authors: []nostr.PubKey{nostr.Generate().Public()}}
+		v := c.version(kindless)
+		c.invalidate(nostr.Event{Kind: 1})
+		c.put(countKey(kindless), kindless, 3, v, 100, time.Hour)
+		if _, ok := c.get(countKey(kindless)); ok {
+			t.Error("stale count was cached")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := newCountCache()
+		c.put(key, f, 3, c.version(f), 100, -time.Second)
+		if _, ok := c.get(key); ok {
+			t.Error("expired count was returned")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newCountCache()
+		c.put(key, f, 3, c.version(f), 0, time.Hour)
+		if _, ok := c.get(key); ok {
+			t.Error("count was cached with size 0")
+		}
+	})
+
+	t.Run("least recently used goes first", func(t *testing.T) {
+		c := newCountCache()
+		fs := []nostr.Filter{{Kinds: []nostr.Kind{1}}, {Kinds: []nostr.Kind{2}}, {Kinds: []nostr.Kind{3}}}
+		c.put(countKey(fs[0]), fs[0], 1, 0, 2, time.Hour)
+		c.put(countKey(fs[1]), fs[1], 2, 0, 2, time.Hour)
+		c.get(countKey(fs[0]))
+		c.put(countKey(fs[2]), fs[2], 3, 0, 2, time.Hour)
+		for i, want := range []bool{true, false, true} {
+			if _, ok := c.get(countKey(fs[i])); ok != want {
+				t.Errorf("filter %d cached = %v, want %v", i, ok, want)
+			}
+		}
+		if len(c.byKind) != 2 {
+			t.Errorf("byKind has %d kinds, want 2", len(c.byKind))
+		}
+	})
+}
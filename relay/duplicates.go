@@ -0,0 +1,438 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	bleve "github.com/blevesearch/bleve/v2"
+	bleveSearch "github.com/blevesearch/bleve/v2/search"
+)
+
+const (
+	// collapseExtension with value "duplicates" collapses NIP-50 results
+	// by duplicate cluster.
+	collapseExtension = "collapse"
+
+	// collapseOverfetch is how many hits are read per result wanted when
+	// collapsing, since some will be dropped.
+	collapseOverfetch = 3
+	maxCollapseFetch  = 10_000
+
+	// maxDuplicateStreams bounds how many distinct stream keys the
+	// duplicates report looks at.
+	maxDuplicateStreams = 1_000_000
+	maxDuplicateReport  = 1_000
+
+	// duplicateReportInterval is how often the clusters behind
+	// /api/duplicates are recomputed.
+	duplicateReportInterval = 5 * time.Minute
+)
+
+// streamMirrorHosts maps hosts that serve the same streams under numbered
+// or regional names to one name, so a station listed with ice2.somafm.com
+// and one with ice6.somafm.com are recognised as the same broadcast.
+// Patterns are path.Match globs.
+var streamMirrorHosts = []struct{ pattern, host string }{
+	{"ice*.somafm.com", "somafm.com"},
+	{"*.live.streamtheworld.com", "live.streamtheworld.com"},
+	{"stream*.radioparadise.com", "radioparadise.com"},
+	{"icecast*.radiofrance.fr", "radiofrance.fr"},
+	{"stream*.zeno.fm", "zeno.fm"},
+}
+
+// streamTokenParams are query parameters that vary per listener or per
+// request (auth tokens, session and listener IDs, cache busters) rather
+// than naming the stream. Names ending in "*" match as prefixes.
+var streamTokenParams = []string{
+	"token", "auth", "authtoken", "access_token", "sid", "session", "sessionid",
+	"listenerid", "lid", "uid", "cb", "nocache", "_", "ts",
+	"utm_*", "aw_0_*", // AdsWizz targeting, as StreamTheWorld URLs carry
+}
+
+// streamKey normalises a stream URL to what identifies the broadcast:
+// lower-cased host without "www." or the default port, known mirror hosts
+// folded together, the path without trailing slashes or Shoutcast's ";",
+// and the query without streamTokenParams, sorted. Scheme and fragment are
+// dropped, since http and https versions are the same stream; the rest of
+// the query is kept, as "/play.php?id=1" and "?id=2" are different
+// stations. It returns "" for URLs without a host.
+func streamKey(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := streamHost(u.Hostname())
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	key := host + strings.TrimRight(u.EscapedPath(), "/;")
+	query := u.Query()
+	for name := range query {
+		if isStreamTokenParam(name) {
+			delete(query, name)
+		}
+	}
+	if len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	return key
+}
+
+func isStreamTokenParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range streamTokenParams {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// streamHost normalises a stream's host name as streamKey does: lower
+// case, no "www.", and mirror hosts folded together.
+func streamHost(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(host, ".")), "www.")
+	for _, m := range streamMirrorHosts {
+		if ok, _ := path.Match(m.pattern, host); ok {
+			return m.host
+		}
+	}
+	return host
+}
+
+// stationStreamHosts are the distinct normalised hosts of st's streams,
+// without ports.
+func stationStreamHosts(st station) []string {
+	var hosts []string
+	for _, s := range st.Streams {
+		u, err := url.Parse(strings.TrimSpace(s.URL))
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if h := streamHost(u.Hostname()); !slices.Contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// stationStreamKeys are the distinct stream keys of st's streams.
+func stationStreamKeys(st station) []string {
+	var keys []string
+	for _, s := range st.Streams {
+		if k := streamKey(s.URL); k != "" && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// hitStreams reads the stored "stream" field of a hit, which bleve returns
+// as a string for one value and a slice for several.
+func hitStreams(hit *bleveSearch.DocumentMatch) []string {
+	switch v := hit.Fields["stream"].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// collapseHits keeps the first hit of each duplicate cluster, in order: a
+// hit sharing a stream with one already kept is dropped. Hits without
+// streams are always kept. The hits must have been fetched with the
+// "stream" field.
+func collapseHits(hits bleveSearch.DocumentMatchCollection) bleveSearch.DocumentMatchCollection {
+	seen := make(map[string]bool)
+	kept := hits[:0:0]
+	for _, hit := range hits {
+		streams := hitStreams(hit)
+		if slices.ContainsFunc(streams, func(s string) bool { return seen[s] }) {
+			continue
+		}
+		for _, s := range streams {
+			seen[s] = true
+		}
+		kept = append(kept, hit)
+	}
+	return kept
+}
+
+// DuplicatesOf returns the event IDs of the other stations sharing a
+// stream with evt, a station event.
+func (s *stationSearch) DuplicatesOf(evt nostr.Event) ([]string, error) {
+	keys := stationStreamKeys(parseStation(evt))
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	q := bleve.NewBooleanQuery()
+	q.AddMust(keywordAnyOf("stream", keys, strings.TrimSpace))
+	q.AddMustNot(bleve.NewDocIDQuery([]string{evt.ID.Hex()}))
+	result, err := s.index.Search(bleve.NewSearchRequestOptions(q, maxDuplicateReport, 0, false))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(result.Hits))
+	for i, hit := range result.Hits {
+		ids[i] = hit.ID
+	}
+	return ids, nil
+}
+
+// observe reports a station just written whose streams other stations
+// already play: it is logged at info level and counted in /stats, so new
+// duplicates show up without waiting for the next rebuild. It costs one
+// term search per station write; other kinds are ignored.
+func (d *duplicateReport) observe(evt nostr.Event) {
+	if evt.Kind != indexedKind {
+		return
+	}
+	ids, err := d.search.DuplicatesOf(evt)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+	d.collisions.Add(1)
+	st := parseStation(evt)
+	slog.Info("station shares a stream with other stations", "address", st.Address(), "name", st.Name,
+		"duplicates", len(ids), "first", ids[0])
+}
+
+// duplicateCluster is a set of stations linked by shared streams: each
+// shares at least one stream key with another in the set.
+type duplicateCluster struct {
+	Streams []string
+	IDs     []string
+}
+
+// DuplicateClusters finds every stream key more than one station has and
+// groups the stations that share them, largest cluster first.
+func (s *stationSearch) DuplicateClusters() ([]duplicateCluster, error) {
+	terms, err := s.facet("stream", maxDuplicateStreams)
+	if err != nil {
+		return nil, err
+	}
+	var shared []string
+	isShared := make(map[string]bool)
+	for _, t := range terms {
+		if t.Count > 1 {
+			shared = append(shared, t.Term)
+			isShared[t.Term] = true
+		}
+	}
+	if len(shared) == 0 {
+		return nil, nil
+	}
+
+	req := bleve.NewSearchRequestOptions(keywordAnyOf("stream", shared, strings.TrimSpace), maxDirectoryStations, 0, false)
+	req.Fields = []string{"stream"}
+	result, err := s.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Union-find over stations, joined through the shared keys.
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+	owner := make(map[string]string) // shared key → a station with it
+	for _, hit := range result.Hits {
+		parent[hit.ID] = hit.ID
+	}
+	for _, hit := range result.Hits {
+		for _, key := range hitStreams(hit) {
+			if !isShared[key] {
+				continue
+			}
+			if other, ok := owner[key]; ok {
+				parent[find(hit.ID)] = find(other)
+			} else {
+				owner[key] = hit.ID
+			}
+		}
+	}
+
+	byRoot := make(map[string]*duplicateCluster)
+	for _, hit := range result.Hits {
+		root := find(hit.ID)
+		if byRoot[root] == nil {
+			byRoot[root] = &duplicateCluster{}
+		}
+		byRoot[root].IDs = append(byRoot[root].IDs, hit.ID)
+	}
+	for key, id := range owner {
+		c := byRoot[find(id)]
+		c.Streams = append(c.Streams, key)
+	}
+	clusters := make([]duplicateCluster, 0, len(byRoot))
+	for _, c := range byRoot {
+		slices.Sort(c.Streams)
+		slices.Sort(c.IDs)
+		clusters = append(clusters, *c)
+	}
+	slices.SortFunc(clusters, func(a, b duplicateCluster) int {
+		return cmp.Or(cmp.Compare(len(b.IDs), len(a.IDs)), strings.Compare(a.Streams[0], b.Streams[0]))
+	})
+	return clusters, nil
+}
+
+type duplicateStation struct {
+	Address string `json:"address"`
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+}
+
+// duplicateReport holds the duplicate clusters behind /api/duplicates.
+// Finding them facets every stream key and reads every station sharing
+// one, far too slow to redo per request, so run recomputes them in the
+// background every duplicateReportInterval.
+type duplicateReport struct {
+	db       eventstore.Store
+	search   *stationSearch
+	clusters atomic.Pointer[[]duplicateCluster]
+	// collisions counts station writes since startup that shared a stream
+	// with another station.
+	collisions atomic.Int64
+}
+
+func newDuplicateReport(db eventstore.Store, search *stationSearch) *duplicateReport {
+	return &duplicateReport{db: db, search: search}
+}
+
+// stats is the duplicates section of /stats. clusters and stations are
+// nil until the first rebuild finishes.
+func (d *duplicateReport) stats() map[string]any {
+	out := map[string]any{"collisions": d.collisions.Load(), "clusters": nil, "stations": nil}
+	if clusters := d.clusters.Load(); clusters != nil {
+		stations := 0
+		for _, c := range *clusters {
+			stations += len(c.IDs)
+		}
+		out["clusters"] = len(*clusters)
+		out["stations"] = stations
+	}
+	return out
+}
+
+func (d *duplicateReport) run(ctx context.Context) {
+	for {
+		d.rebuild()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(duplicateReportInterval):
+		}
+	}
+}
+
+func (d *duplicateReport) rebuild() {
+	start := time.Now()
+	clusters, err := d.search.DuplicateClusters()
+	if err != nil {
+		slog.Warn("failed to find duplicate stations", "err", err)
+		return
+	}
+	d.clusters.Store(&clusters)
+	slog.Debug("duplicate clusters rebuilt", "clusters", len(clusters), "took", time.Since(start).Round(time.Millisecond))
+}
+
+// handleDuplicates is GET /api/duplicates?limit=&offset=: the duplicate
+// clusters, largest first, each with the stream keys its stations share.
+// Until the first rebuild after startup finishes it answers 503.
+func (d *duplicateReport) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, err := queryInt(params.Get("limit"), defaultAPISearchLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	limit = min(limit, maxDuplicateReport)
+	offset, err := queryInt(params.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	snapshot := d.clusters.Load()
+	if snapshot == nil {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, "duplicate report is still being built")
+		return
+	}
+	clusters := *snapshot
+	type clusterJSON struct {
+		Streams  []string           `json:"streams"`
+		Stations []duplicateStation `json:"stations"`
+	}
+	page := []clusterJSON{}
+	for _, c := range clusters[min(offset, len(clusters)):min(offset+limit, len(clusters))] {
+		out := clusterJSON{Streams: c.Streams, Stations: []duplicateStation{}}
+		for _, id := range c.IDs {
+			if evt, found := fetchEvent(d.db, mustID(id)); found {
+				st := parseStation(evt)
+				out.Stations = append(out.Stations, duplicateStation{Address: st.Address(), Name: st.Name, ID: id})
+			}
+		}
+		page = append(page, out)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":    len(clusters),
+		"offset":   offset,
+		"limit":    limit,
+		"clusters": page,
+	})
+}
+
+// handleStationDuplicates is GET /api/stations/{pubkey}/{d}/duplicates: the
+// other stations playing one of this station's streams.
+func (a *stationAPI) handleStationDuplicates(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	evt, found := fetchAddress(a.db, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+	ids, err := a.search.DuplicatesOf(evt)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	events := []nostr.Event{}
+	for _, id := range ids {
+		if dup, found := fetchEvent(a.db, mustID(id)); found {
+			events = append(events, dup)
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	bleveSearch "github.com/blevesearch/bleve/v2/search"
+)
+
+func TestStreamKey(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"http://stream.example.com/live", "stream.example.com/live"},
+		{"https://stream.example.com/live", "stream.example.com/live"},
+		{"  https://Stream.Example.COM/live  ", "stream.example.com/live"},
+		{"http://www.example.com/live", "example.com/live"},
+		{"http://example.com./live", "example.com/live"},
+		{"http://example.com:80/live", "example.com/live"},
+		{"https://example.com:443/live", "example.com/live"},
+		{"http://example.com:8000/live", "example.com:8000/live"},
+		{"http://example.com/live/", "example.com/live"},
+		{"http://example.com:8000/;", "example.com:8000"},
+		{"http://example.com/live?token=abc#x", "example.com/live"},
+		{"http://example.com/live?Token=abc&SID=1&utm_source=x&aw_0_1st.playerid=y&_=123", "example.com/live"},
+		{"http://example.com/play.php?id=1", "example.com/play.php?id=1"},
+		{"http://example.com/play.php?id=2&token=abc", "example.com/play.php?id=2"},
+		{"http://example.com/play.php?station=b&id=2", "example.com/play.php?id=2&station=b"},
+		{"http://example.com/play.php?", "example.com/play.php"},
+		{"http://example.com/Live", "example.com/Live"},
+		{"http://example.com/my%20stream", "example.com/my%20stream"},
+		{"http://ice2.somafm.com/groovesalad-128-mp3", "somafm.com/groovesalad-128-mp3"},
+		{"https://ice6.somafm.com/groovesalad-128-mp3", "somafm.com/groovesalad-128-mp3"},
+		{"https://24223.live.streamtheworld.com/KINK.mp3", "live.streamtheworld.com/KINK.mp3"},
+		{"http://[2001:db8::1]:8000/live", "[2001:db8::1]:8000/live"},
+		{"example.com/live", ""},
+		{"/live", ""},
+		{"", ""},
+		{"http://%zz", ""},
+	}
+	for _, tt := range tests {
+		if got := streamKey(tt.raw); got != tt.want {
+			t.Errorf("streamKey(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestStreamHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"Example.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"example.com.", "example.com"},
+		{"ice1.somafm.com", "somafm.com"},
+		{"stream-uk1.radioparadise.com", "radioparadise.com"},
+		{"icecast.radiofrance.fr", "radiofrance.fr"},
+		{"stream.zeno.fm", "zeno.fm"},
+		// path.Match's * spans dots
+		{"a.b.live.streamtheworld.com", "live.streamtheworld.com"},
+		{"live.streamtheworld.com", "live.streamtheworld.com"},
+		{"somafm.com", "somafm.com"},
+	}
+	for _, tt := range tests {
+		if got := streamHost(tt.host); got != tt.want {
+			t.Errorf("streamHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestStationStreams(t *testing.T) {
+	st := station{Streams: []stationStream{
+		{URL: "https://ice2.somafm.com/groovesalad-256-mp3"},
+		{URL: "http://ice4.somafm.com/groovesalad-256-mp3"},
+		{URL: "http://ice4.somafm.com:8080/groovesalad-64-aac"},
+		{URL: "https://backup.example.com/gs"},
+		{URL: "not a url"},
+	}}
+	wantKeys := []string{"somafm.com/groovesalad-256-mp3", "somafm.com:8080/groovesalad-64-aac", "backup.example.com/gs"}
+	if got := stationStreamKeys(st); !slices.Equal(got, wantKeys) {
+		t.Errorf("stationStreamKeys = %q, want %q", got, wantKeys)
+	}
+	wantHosts := []string{"somafm.com", "backup.example.com"}
+	if got := stationStreamHosts(st); !slices.Equal(got, wantHosts) {
+		t.Errorf("stationStreamHosts = %q, want %q", got, wantHosts)
+	}
+}
+
+func TestCollapseHits(t *testing.T) {
+	hit := func(id string, streams any) *bleveSearch.DocumentMatch {
+		m := &bleveSearch.DocumentMatch{ID: id}
+		if streams != nil {
+			m.Fields = map[string]any{"stream": streams}
+		}
+		return m
+	}
+	tests := []struct {
+		name string
+		hits bleveSearch.DocumentMatchCollection
+		want []string
+	}{
+		{
+			name: "distinct streams",
+			hits: bleveSearch.DocumentMatchCollection{hit("a", "x"), hit("b", "y")},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "first of a cluster is kept",
+			hits: bleveSearch.DocumentMatchCollection{hit("a", "x"), hit("b", "y"), hit("c", "x")},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "any shared stream",
+			hits: bleveSearch.DocumentMatchCollection{hit("a", []any{"x", "y"}), hit("b", []any{"z", "y"}), hit("c", "z")},
+			want: []string{"a", "c"},
+		},
+		{
+			name: "hits without streams",
+			hits: bleveSearch.DocumentMatchCollection{hit("a", nil), hit("b", nil), hit("c", "x")},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "empty",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, h := range collapseHits(tt.hits) {
+				got = append(got, h.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("collapseHits = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+const (
+	// maxFavoritesBackfill caps the LMDB scan when the model is built.
+	maxFavoritesBackfill = 1_000_000
+	// maxFavoritesBasket is how many of a user's favourites count. Pairs
+	// grow with its square, and a list of thousands says little about
+	// taste anyway.
+	maxFavoritesBasket = 500
+
+	defaultRecommendLimit = 10
+	maxRecommendLimit     = 50
+
+	// favoritesShrink damps pairs few people share: two stations one user
+	// favourited together shouldn't outrank two that fifty did.
+	favoritesShrink = 3
+)
+
+// favoritesModel counts, for every pair of stations, how many users have
+// both in their favorites lists (kind 30078, featured lists excluded). A
+// user's lists are taken together as one set of favourites. It answers
+// "people who favourited X also favourited Y" and "stations pubkey P might
+// like".
+//
+// The model lives in memory: it is built from LMDB in the background at
+// startup and kept current by observe and forget as lists are replaced and
+// deleted. Replacing a list takes the user's old favourites out of the
+// counts and puts the new ones in.
+type favoritesModel struct {
+	db eventstore.Store
+
+	mu sync.RWMutex
+	// Stations are interned to int32 so the pair counts stay small.
+	index map[string]int32
+	addrs []string
+	// fans[i] is how many users favourited station i; together[i][j] how
+	// many favourited both i and j.
+	fans     []uint32
+	together []map[int32]uint32
+	lists    map[nostr.PubKey]map[string]favoritesList
+	baskets  map[nostr.PubKey][]int32
+}
+
+type favoritesList struct {
+	createdAt nostr.Timestamp
+	entries   []string
+}
+
+func newFavoritesModel(db eventstore.Store) *favoritesModel {
+	return &favoritesModel{
+		db:      db,
+		index:   make(map[string]int32),
+		lists:   make(map[nostr.PubKey]map[string]favoritesList),
+		baskets: make(map[nostr.PubKey][]int32),
+	}
+}
+
+// Backfill builds the model from the lists already in LMDB. Lists replaced
+// while it runs are observed as usual; the newer version wins either way.
+// It gives up when ctx ends.
+func (m *favoritesModel) Backfill(ctx context.Context) {
+	start := time.Now()
+	n := 0
+	for evt := range m.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{listKind}}, maxFavoritesBackfill) {
+		if ctx.Err() != nil {
+			return
+		}
+		m.observe(evt)
+		n++
+	}
+	m.mu.RLock()
+	users, stations := len(m.baskets), len(m.addrs)
+	m.mu.RUnlock()
+	slog.Info("built favorites model", "lists", n, "users", users, "stations", stations,
+		"took", time.Since(start).Round(time.Millisecond))
+}
+
+// observe takes a stored or replacing favorites list into the model.
+// Events of other kinds, featured lists and NIP-05 registry events are
+// ignored, except that a list relabelled as featured stops counting.
+func (m *favoritesModel) observe(evt nostr.Event) {
+	if evt.Kind != listKind || isNIP05Registration(evt) {
+		return
+	}
+	l := parseStationList(evt)
+	var entries []string
+	if l.Label != featuredListLabel {
+		for _, e := range l.Entries {
+			entries = append(entries, e.Address)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lists := m.lists[evt.PubKey]
+	if prev, ok := lists[l.D]; ok && prev.createdAt > evt.CreatedAt {
+		return
+	}
+	if lists == nil {
+		lists = make(map[string]favoritesList)
+		m.lists[evt.PubKey] = lists
+	}
+	// An emptied list stays as a tombstone with its createdAt, so an older
+	// version replayed later can't bring its favourites back.
+	lists[l.D] = favoritesList{createdAt: evt.CreatedAt, entries: entries}
+	m.rebasket(evt.PubKey)
+}
+
+// forget drops a deleted favorites list, if it is the version the model
+// holds, leaving a tombstone as observe does for an emptied one.
+func (m *favoritesModel) forget(evt nostr.Event) {
+	if evt.Kind != listKind {
+		return
+	}
+	d := evt.Tags.GetD()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lists := m.lists[evt.PubKey]
+	if prev, ok := lists[d]; !ok || prev.createdAt > evt.CreatedAt {
+		return
+	}
+	lists[d] = favoritesList{createdAt: evt.CreatedAt}
+	m.rebasket(evt.PubKey)
+}
+
+// rebasket recomputes pk's favourites from its lists and moves the counts
+// from the old set to the new one. m.mu must be held.
+func (m *favoritesModel) rebasket(pk nostr.PubKey) {
+	var basket []int32
+	for _, l := range m.lists[pk] {
+		for _, addr := range l.entries {
+			if len(basket) == maxFavoritesBasket {
+				break
+			}
+			i := m.intern(addr)
+			if !slices.Contains(basket, i) {
+				basket = append(basket, i)
+			}
+		}
+	}
+	m.count(m.baskets[pk], -1)
+	m.count(basket, 1)
+	if len(basket) == 0 {
+		delete(m.baskets, pk)
+		return
+	}
+	m.baskets[pk] = basket
+}
+
+// count adds delta to the fans of every station in basket and to every
+// pair in it.
+func (m *favoritesModel) count(basket []int32, delta int) {
+	for x, i := range basket {
+		m.fans[i] = uint32(int(m.fans[i]) + delta)
+		for _, j := range basket[x+1:] {
+			m.pair(i, j, delta)
+			m.pair(j, i, delta)
+		}
+	}
+}
+
+func (m *favoritesModel) pair(i, j int32, delta int) {
+	n := int(m.together[i][j]) + delta
+	if n <= 0 {
+		delete(m.together[i], j)
+		return
+	}
+	if m.together[i] == nil {
+		m.together[i] = make(map[int32]uint32)
+	}
+	m.together[i][j] = uint32(n)
+}
+
+func (m *favoritesModel) intern(addr string) int32 {
+	if i, ok := m.index[addr]; ok {
+		return i
+	}
+	i := int32(len(m.addrs))
+	m.index[addr] = i
+	m.addrs = append(m.addrs, addr)
+	m.fans = append(m.fans, 0)
+	m.together = append(m.together, nil)
+	return i
+}
+
+// affinity is how strongly favouriting i predicts favouriting j: the
+// cosine of their fan sets, damped by favoritesShrink when few users share
+// them.
+func (m *favoritesModel) affinity(i, j int32, both uint32) float64 {
+	cosine := float64(both) / math.Sqrt(float64(m.fans[i])*float64(m.fans[j]))
+	return cosine * float64(both) / float64(both+favoritesShrink)
+}
+
+type favoritesScore struct {
+	addr  string
+	score float64
+}
+
+// alsoFavorited returns the addresses of stations favourited by people who
+// favourited addr, best first.
+func (m *favoritesModel) alsoFavorited(addr string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, ok := m.index[addr]
+	if !ok {
+		return nil
+	}
+	scores := make([]favoritesScore, 0, len(m.together[i]))
+	for j, both := range m.together[i] {
+		scores = append(scores, favoritesScore{m.addrs[j], m.affinity(i, j, both)})
+	}
+	return rankFavorites(scores)
+}
+
+// recommendedFor returns the addresses of stations pk hasn't favourited,
+// scored by their affinity with every station pk has, best first.
+func (m *favoritesModel) recommendedFor(pk nostr.PubKey) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	basket := m.baskets[pk]
+	totals := make(map[int32]float64)
+	for _, i := range basket {
+		for j, both := range m.together[i] {
+			if !slices.Contains(basket, j) {
+				totals[j] += m.affinity(i, j, both)
+			}
+		}
+	}
+	scores := make([]favoritesScore, 0, len(totals))
+	for j, score := range totals {
+		scores = append(scores, favoritesScore{m.addrs[j], score})
+	}
+	return rankFavorites(scores)
+}
+
+func rankFavorites(scores []favoritesScore) []string {
+	slices.SortFunc(scores, func(a, b favoritesScore) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.addr, b.addr))
+	})
+	addrs := make([]string, len(scores))
+	for i, s := range scores {
+		addrs[i] = s.addr
+	}
+	return addrs
+}
+
+// stations returns the current events of the first limit addresses the
+// relay still has, in order.
+func (m *favoritesModel) stations(addrs []string, limit int) []nostr.Event {
+	events := []nostr.Event{}
+	for _, addr := range addrs {
+		if len(events) == limit {
+			break
+		}
+		kind, pk, d, ok := parseAddress(addr)
+		if !ok {
+			continue
+		}
+		if evt, found := fetchAddress(m.db, kind, pk, d); found {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+func recommendLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit, err := queryInt(r.URL.Query().Get("limit"), defaultRecommendLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return 0, false
+	}
+	return min(limit, maxRecommendLimit), true
+}
+
+// handleAlsoFavorited is GET /api/stations/{pubkey}/{d}/also-favorited:
+// stations that people who favourited this one also favourited.
+func (m *favoritesModel) handleAlsoFavorited(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := recommendLimit(w, r)
+	if !ok {
+		return
+	}
+	events := m.stations(m.alsoFavorited(stationAddress(pk, d)), limit)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
+
+// handleRecommended is GET /api/recommendations/{pubkey}: stations liked by
+// people whose favourites overlap pubkey's, leaving out its own.
+func (m *favoritesModel) handleRecommended(w http.ResponseWriter, r *http.Request) {
+	pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "pubkey must be 64-char hex")
+		return
+	}
+	limit, ok := recommendLimit(w, r)
+	if !ok {
+		return
+	}
+	events := m.stations(m.recommendedFor(pk), limit)
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestFavoritesModel(t *testing.T) {
+	alice, bob := nostr.Generate().Public(), nostr.Generate().Public()
+	const a, b, c = "31237:pk:a", "31237:pk:b", "31237:pk:c"
+	list := func(pk nostr.PubKey, d string, at nostr.Timestamp, addrs ...string) nostr.Event {
+		tags := nostr.Tags{{"d", d}}
+		for _, addr := range addrs {
+			tags = append(tags, nostr.Tag{"a", addr})
+		}
+		return nostr.Event{Kind: listKind, PubKey: pk, CreatedAt: at, Tags: tags}
+	}
+	featured := list(alice, "featured", 10, a, b)
+	featured.Tags = append(featured.Tags, nostr.Tag{"l", featuredListLabel})
+
+	// step is an observed event, or a forgotten one if forget is set.
+	type step struct {
+		evt    nostr.Event
+		forget bool
+	}
+	tests := []struct {
+		name     string
+		steps    []step
+		fans     map[string]uint32
+		together map[[2]string]uint32
+	}{
+		{
+			name:     "one list",
+			steps:    []step{{evt: list(alice, "fav", 10, a, b)}},
+			fans:     map[string]uint32{a: 1, b: 1},
+			together: map[[2]string]uint32{{a, b}: 1},
+		},
+		{
+			name:     "two users",
+			steps:    []step{{evt: list(alice, "fav", 10, a, b)}, {evt: list(bob, "fav", 10, a, b, c)}},
+			fans:     map[string]uint32{a: 2, b: 2, c: 1},
+			together: map[[2]string]uint32{{a, b}: 2, {a, c}: 1, {b, c}: 1},
+		},
+		{
+			name:     "one user's lists are one basket",
+			steps:    []step{{evt: list(alice, "one", 10, a, b)}, {evt: list(alice, "two", 10, b, c)}},
+			fans:     map[string]uint32{a: 1, b: 1, c: 1},
+			together: map[[2]string]uint32{{a, b}: 1, {a, c}: 1, {b, c}: 1},
+		},
+		{
+			name:     "replaced list moves the counts",
+			steps:    []step{{evt: list(alice, "fav", 10, a, b)}, {evt: list(alice, "fav", 20, b, c)}},
+			fans:     map[string]uint32{a: 0, b: 1, c: 1},
+			together: map[[2]string]uint32{{a, b}: 0, {b, c}: 1},
+		},
+		{
+			name:     "older version is ignored",
+			steps:    []step{{evt: list(alice, "fav", 20, b, c)}, {evt: list(alice, "fav", 10, a, b)}},
+			fans:     map[string]uint32{a: 0, b: 1, c: 1},
+			together: map[[2]string]uint32{{a, b}: 0, {b, c}: 1},
+		},
+		{
+			name:     "emptied list stays empty after an older replay",
+			steps:    []step{{evt: list(alice, "fav", 10, a, b)}, {evt: list(alice, "fav", 20)}, {evt: list(alice, "fav", 10, a, b)}},
+			fans:     map[string]uint32{a: 0, b: 0},
+			together: map[[2]string]uint32{{a, b}: 0},
+		},
+		{
+			name:     "empty list first, older version after",
+			steps:    []step{{evt: list(alice, "fav", 20)}, {evt: list(alice, "fav", 10, a, b)}},
+			together: map[[2]string]uint32{{a, b}: 0},
+		},
+		{
+			name:     "featured lists don't count",
+			steps:    []step{{evt: featured}},
+			together: map[[2]string]uint32{{a, b}: 0},
+		},
+		{
+			name:     "relabelled as featured stops counting",
+			steps:    []step{{evt: list(alice, "featured", 5, a, b)}, {evt: featured}},
+			fans:     map[string]uint32{a: 0, b: 0},
+			together: map[[2]string]uint32{{a, b}: 0},
+		},
+		{
+			name:     "forget the held version",
+			steps:    []step{{evt: list(alice, "fav", 10, a, b)}, {evt: list(bob, "fav", 10, a, b)}, {evt: list(alice, "fav", 10), forget: true}},
+			fans:     map[string]uint32{a: 1, b: 1},
+			together: map[[2]string]uint32{{a, b}: 1},
+		},
+		{
+			name:     "forget an older version",
+			steps:    []step{{evt: list(alice, "fav", 20, a, b)}, {evt: list(alice, "fav", 10), forget: true}},
+			fans:     map[string]uint32{a: 1, b: 1},
+			together: map[[2]string]uint32{{a, b}: 1},
+		},
+		{
+			name:     "forgotten list stays gone after an older replay",
+			steps:    []step{{evt: list(alice, "fav", 20, a, b)}, {evt: list(alice, "fav", 20), forget: true}, {evt: list(alice, "fav", 10, a, b)}},
+			fans:     map[string]uint32{a: 0, b: 0},
+			together: map[[2]string]uint32{{a, b}: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newFavoritesModel(nil)
+			for _, s := range tt.steps {
+				if s.forget {
+					m.forget(s.evt)
+				} else {
+					m.observe(s.evt)
+				}
+			}
+			for addr, want := range tt.fans {
+				var got uint32
+				if i, ok := m.index[addr]; ok {
+					got = m.fans[i]
+				}
+				if got != want {
+					t.Errorf("fans of %s = %d, want %d", addr, got, want)
+				}
+			}
+			for pair, want := range tt.together {
+				for _, p := range [][2]string{pair, {pair[1], pair[0]}} {
+					var got uint32
+					i, iok := m.index[p[0]]
+					j, jok := m.index[p[1]]
+					if iok && jok {
+						got = m.together[i][j]
+					}
+					if got != want {
+						t.Errorf("together(%s, %s) = %d, want %d", p[0], p[1], got, want)
+					}
+				}
+			}
+		})
+	}
+}
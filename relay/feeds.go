@@ -0,0 +1,444 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+const (
+	defaultFeedLimit = 50
+	feedMaxAge       = 5 * time.Minute
+	directoryMaxAge  = time.Hour
+
+	// newFeedScanPages bounds how many pages of recent stations the "new"
+	// feed looks through for first versions.
+	newFeedScanPages = 10
+
+	// maxDirectoryStations caps the OPML export's LMDB walk.
+	maxDirectoryStations = 1_000_000
+
+	// directoryWriteTimeout replaces the server's write timeout for the
+	// OPML directory, which walks the whole catalog when its cache is cold
+	// and then sends every station.
+	directoryWriteTimeout = 2 * time.Minute
+)
+
+// feeds serves Atom and RSS feeds of catalog changes and the OPML directory.
+// Everything is rendered from LMDB/bleve on demand and cached briefly, with
+// ETag and Last-Modified so feed readers polling every few minutes mostly get
+// 304s.
+//
+// "updated" lists stations by their latest version. "new" lists stations
+// whose current version is their first one, i.e. that have nothing in the
+// history store. History only exists for replacements made since it was
+// introduced, so older stations edited before then look new until their next
+// edit.
+type feeds struct {
+	db        eventstore.Store
+	history   eventstore.Store
+	search    *stationSearch
+	live      *liveConfig
+	pages     *pageCache
+	directory *pageCache
+}
+
+func newFeeds(db, history eventstore.Store, search *stationSearch, live *liveConfig) *feeds {
+	return &feeds{
+		db:        db,
+		history:   history,
+		search:    search,
+		live:      live,
+		pages:     newPageCache(time.Minute, 500),
+		directory: newPageCache(10*time.Minute, 1),
+	}
+}
+
+func (f *feeds) register(mux *http.ServeMux) {
+	for _, kind := range []string{"new", "updated"} {
+		mux.HandleFunc("GET /feeds/"+kind+".atom", f.handleFeed(kind, "atom"))
+		mux.HandleFunc("GET /feeds/"+kind+".rss", f.handleFeed(kind, "rss"))
+	}
+	mux.HandleFunc("GET /feeds/directory.opml", f.handleDirectory)
+}
+
+// handleFeed serves /feeds/{new,updated}.{atom,rss}?genre=&country=&limit=.
+func (f *feeds) handleFeed(kind, format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		q := stationQuery{
+			Genres:    queryList(params["genre"]),
+			Countries: queryList(params["country"]),
+		}
+		limit, err := queryInt(params.Get("limit"), defaultFeedLimit)
+		if err != nil || limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(limit, f.live.Load().Limits.MaxSearchLimit)
+
+		page, err := f.pages.get(requestBaseURL(r)+r.URL.RequestURI(), func() ([]byte, time.Time, error) {
+			stations, err := f.stations(kind, q, limit)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			meta := f.feedMeta(r, kind, q)
+			var modTime time.Time
+			if len(stations) > 0 {
+				modTime = stationTime(stations[0])
+			}
+			if format == "atom" {
+				return renderAtom(meta, stations, modTime), modTime, nil
+			}
+			return renderRSS(meta, stations, modTime), modTime, nil
+		})
+		if err != nil {
+			slog.Error("failed to build feed", "kind", kind, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to build feed")
+			return
+		}
+		contentType := "application/atom+xml; charset=utf-8"
+		if format == "rss" {
+			contentType = "application/rss+xml; charset=utf-8"
+		}
+		servePage(w, r, page, contentType, feedMaxAge)
+	}
+}
+
+// stations returns up to limit stations for the feed, newest first.
+func (f *feeds) stations(kind string, q stationQuery, limit int) ([]station, error) {
+	if kind == "updated" {
+		events, _, err := f.search.Find(q, 0, limit)
+		if err != nil {
+			return nil, err
+		}
+		stations := make([]station, len(events))
+		for i, evt := range events {
+			stations[i] = parseStation(evt)
+		}
+		return stations, nil
+	}
+
+	var stations []station
+	for page := 0; page < newFeedScanPages && len(stations) < limit; page++ {
+		events, _, err := f.search.Find(q, page*limit, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, evt := range events {
+			st := parseStation(evt)
+			if !f.hasHistory(st) {
+				stations = append(stations, st)
+			}
+		}
+		if len(events) < limit {
+			break
+		}
+	}
+	return stations[:min(limit, len(stations))], nil
+}
+
+func (f *feeds) hasHistory(st station) bool {
+	for range f.history.QueryEvents(addressFilter(indexedKind, st.Event.PubKey, st.D), 1) {
+		return true
+	}
+	return false
+}
+
+type feedMeta struct {
+	Kind   string
+	Title  string
+	Self   string
+	WebURL string
+}
+
+func (f *feeds) feedMeta(r *http.Request, kind string, q stationQuery) feedMeta {
+	cfg := f.live.Load()
+	title := cfg.Info.Name + ": "
+	if kind == "new" {
+		title += "new stations"
+	} else {
+		title += "updated stations"
+	}
+	if len(q.Genres) > 0 {
+		title += " in " + strings.Join(q.Genres, ", ")
+	}
+	if len(q.Countries) > 0 {
+		title += " (" + strings.ToUpper(strings.Join(q.Countries, ", ")) + ")"
+	}
+	return feedMeta{
+		Kind:   kind,
+		Title:  title,
+		Self:   requestBaseURL(r) + r.URL.RequestURI(),
+		WebURL: cfg.Web.URL,
+	}
+}
+
+// entryID is stable per station in the "new" feed and per version in the
+// "updated" feed, so readers show an edit as a fresh item only where that's
+// the point.
+func (m feedMeta) entryID(st station) string {
+	if m.Kind == "new" {
+		return "urn:nostr:" + st.Address()
+	}
+	return "urn:nostr:" + st.Event.ID.Hex()
+}
+
+func stationTime(st station) time.Time {
+	return time.Unix(int64(st.Event.CreatedAt), 0).UTC()
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Author    atomPerson  `xml:"author"`
+	Generator string      `xml:"generator"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func renderAtom(meta feedMeta, stations []station, modTime time.Time) []byte {
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0).UTC()
+	}
+	feed := atomFeed{
+		Title:   meta.Title,
+		ID:      meta.Self,
+		Updated: modTime.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: meta.Self, Rel: "self", Type: "application/atom+xml"},
+			{Href: meta.WebURL, Rel: "alternate", Type: "text/html"},
+		},
+		Author:    atomPerson{Name: "WaveFunc"},
+		Generator: "wavefunc-relay " + buildVersion(),
+	}
+	for _, st := range stations {
+		entry := atomEntry{
+			Title:   st.Name,
+			ID:      meta.entryID(st),
+			Updated: stationTime(st).Format(time.RFC3339),
+			Links:   []atomLink{{Href: st.pageURL(meta.WebURL), Rel: "alternate", Type: "text/html"}},
+			Summary: st.summary(400),
+		}
+		if stream, ok := st.primaryStream(); ok {
+			entry.Links = append(entry.Links, atomLink{Href: stream.URL, Rel: "enclosure", Type: stream.Format})
+		}
+		for _, g := range st.Genres {
+			entry.Categories = append(entry.Categories, atomCategory{Term: g})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return marshalXML(feed)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Generator     string    `xml:"generator"`
+	Self          rssLink   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description,omitempty"`
+	Categories  []string      `xml:"category"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int    `xml:"length,attr"`
+}
+
+func renderRSS(meta feedMeta, stations []station, modTime time.Time) []byte {
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       meta.Title,
+			Link:        meta.WebURL,
+			Description: meta.Title,
+			Generator:   "wavefunc-relay " + buildVersion(),
+			Self:        rssLink{Href: meta.Self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !modTime.IsZero() {
+		feed.Channel.LastBuildDate = modTime.Format(time.RFC1123Z)
+	}
+	for _, st := range stations {
+		item := rssItem{
+			Title:       st.Name,
+			Link:        st.pageURL(meta.WebURL),
+			GUID:        rssGUID{Value: meta.entryID(st)},
+			PubDate:     stationTime(st).Format(time.RFC1123Z),
+			Description: st.summary(400),
+			Categories:  st.Genres,
+		}
+		if stream, ok := st.primaryStream(); ok {
+			item.Enclosure = &rssEnclosure{URL: stream.URL, Type: cmp.Or(stream.Format, "audio/mpeg")}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return marshalXML(feed)
+}
+
+func marshalXML(v any) []byte {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		// only possible with a programming error in the structs above
+		panic(fmt.Sprintf("xml marshal: %v", err))
+	}
+	return append([]byte(xml.Header), append(out, '\n')...)
+}
+
+// OPML directory
+
+type opmlDoc struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title"`
+	Created string        `xml:"head>dateCreated"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Type     string        `xml:"type,attr,omitempty"`
+	URL      string        `xml:"URL,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Image    string        `xml:"image,attr,omitempty"`
+	Bitrate  string        `xml:"bitrate,attr,omitempty"`
+	Formats  string        `xml:"formats,attr,omitempty"`
+	Children []opmlOutline `xml:"outline"`
+}
+
+// handleDirectory is GET /feeds/directory.opml: every station with a stream,
+// grouped by genre. A station with several genres appears under each; one
+// with none goes under "Other".
+func (f *feeds) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(directoryWriteTimeout))
+	page, err := f.directory.get("directory", f.buildDirectory)
+	if err != nil {
+		slog.Error("failed to build OPML directory", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build directory")
+		return
+	}
+	w.Header().Set("Content-Disposition", `inline; filename="wavefunc.opml"`)
+	servePage(w, r, page, "text/x-opml; charset=utf-8", directoryMaxAge)
+}
+
+func (f *feeds) buildDirectory() ([]byte, time.Time, error) {
+	cfg := f.live.Load()
+	groups := make(map[string][]opmlOutline)
+	names := make(map[string]string) // lower-case genre -> first spelling seen
+	var newest nostr.Timestamp
+	for evt := range f.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{indexedKind}}, maxDirectoryStations) {
+		st := parseStation(evt)
+		stream, ok := st.primaryStream()
+		if !ok {
+			continue
+		}
+		newest = max(newest, evt.CreatedAt)
+		outline := opmlOutline{
+			Text:    st.Name,
+			Type:    "audio",
+			URL:     stream.URL,
+			HTMLURL: st.pageURL(cfg.Web.URL),
+			Image:   st.Thumbnail,
+			Formats: strings.ToLower(stream.codec()),
+		}
+		if stream.Quality.Bitrate > 0 {
+			outline.Bitrate = strconv.Itoa(stream.Quality.Bitrate)
+		}
+		genres := st.Genres
+		if len(genres) == 0 {
+			genres = []string{"Other"}
+		}
+		for _, g := range genres {
+			key := strings.ToLower(g)
+			if _, ok := names[key]; !ok {
+				names[key] = g
+			}
+			groups[key] = append(groups[key], outline)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	doc := opmlDoc{
+		Version: "2.0",
+		Title:   cfg.Info.Name + " directory",
+		Created: time.Now().UTC().Format(time.RFC1123Z),
+	}
+	for _, k := range keys {
+		children := groups[k]
+		slices.SortFunc(children, func(a, b opmlOutline) int {
+			return strings.Compare(strings.ToLower(a.Text), strings.ToLower(b.Text))
+		})
+		doc.Body = append(doc.Body, opmlOutline{Text: names[k], Children: children})
+	}
+	return marshalXML(doc), time.Unix(int64(newest), 0).UTC(), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	bleve "github.com/blevesearch/bleve/v2"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+)
+
+// activeTaxonomy is the genre taxonomy of the live config, swapped in by
+// liveConfig.apply. buildSearchDoc and stationQuery.compile read it on
+// every call.
+var activeTaxonomy atomic.Pointer[genreTaxonomy]
+
+// taxonomy returns the active genre taxonomy, or an empty one before the
+// config has been applied.
+func taxonomy() *genreTaxonomy {
+	if t := activeTaxonomy.Load(); t != nil {
+		return t
+	}
+	return &genreTaxonomy{}
+}
+
+// genreTaxonomy maps the free-text spellings in station `c` tags to
+// canonical genres, and canonical genres to their parents, so "Hip-Hop",
+// "hiphop" and "rap" are one genre and "deep house" is found under "house"
+// and "electronic".
+type genreTaxonomy struct {
+	// canonical maps the genreKey of every name and alias to its genre.
+	canonical map[string]string
+	parent    map[string]string
+	children  map[string][]string
+	aliases   map[string][]string
+	names     []string
+}
+
+// newGenreTaxonomy compiles the [genres] config. Validate has already
+// checked it for unknown parents, cycles and clashing aliases.
+func newGenreTaxonomy(genres map[string]GenreConfig) *genreTaxonomy {
+	t := &genreTaxonomy{
+		canonical: make(map[string]string),
+		parent:    make(map[string]string),
+		children:  make(map[string][]string),
+		aliases:   make(map[string][]string),
+	}
+	for name, g := range genres {
+		name = normalizeGenreName(name)
+		t.names = append(t.names, name)
+		t.canonical[genreKey(name)] = name
+		for _, alias := range g.Aliases {
+			t.canonical[genreKey(alias)] = name
+			t.aliases[name] = append(t.aliases[name], alias)
+		}
+		if g.Parent != "" {
+			parent := normalizeGenreName(g.Parent)
+			t.parent[name] = parent
+			t.children[parent] = append(t.children[parent], name)
+		}
+	}
+	slices.Sort(t.names)
+	for _, c := range t.children {
+		slices.Sort(c)
+	}
+	return t
+}
+
+// genreKey folds a genre spelling for lookup: lower case, no accents, and
+// only letters and digits, so "Hip-Hop", "hip hop" and "hiphop" agree.
+func genreKey(s string) string {
+	var b strings.Builder
+	for _, r := range foldSuggest(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeGenreName is how canonical genre names are written: lower case
+// with single spaces.
+func normalizeGenreName(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// canonicalize returns the canonical genre for a spelling, if the taxonomy
+// knows it.
+func (t *genreTaxonomy) canonicalize(s string) (string, bool) {
+	g, ok := t.canonical[genreKey(s)]
+	return g, ok
+}
+
+// lineage is genre followed by its parent, grandparent and so on.
+func (t *genreTaxonomy) lineage(genre string) []string {
+	out := []string{genre}
+	for p, ok := t.parent[genre]; ok && !slices.Contains(out, p); p, ok = t.parent[p] {
+		out = append(out, p)
+	}
+	return out
+}
+
+// expand returns the canonical genres and all their ancestors for a
+// station's raw genre tags, deduplicated, plus the canonical names alone.
+// Unknown spellings are left out of both.
+func (t *genreTaxonomy) expand(raw []string) (paths, canonical []string) {
+	for _, g := range raw {
+		c, ok := t.canonicalize(g)
+		if !ok {
+			continue
+		}
+		if !slices.Contains(canonical, c) {
+			canonical = append(canonical, c)
+		}
+		for _, p := range t.lineage(c) {
+			if !slices.Contains(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths, canonical
+}
+
+// genreQuery matches stations tagged with genre v. A genre the taxonomy
+// knows matches every spelling of it and of its sub-genres through
+// "genre_path"; the phrase on "genre" covers unknown genres and stations
+// indexed before the taxonomy was.
+func genreQuery(v string) bleveQuery.Query {
+	phrase := phraseQuery("genre", v)
+	if g, ok := taxonomy().canonicalize(v); ok {
+		return bleve.NewDisjunctionQuery(genrePathQuery(g, 1), phrase)
+	}
+	return phrase
+}
+
+// genreTextQuery adds to q, the query for an unscoped word or phrase, the
+// stations in the genre the text names, at the genre field's weight. Text
+// that isn't a known genre leaves q as it is.
+func genreTextQuery(q bleveQuery.Query, text string, boost float64) bleveQuery.Query {
+	g, ok := taxonomy().canonicalize(text)
+	if !ok {
+		return q
+	}
+	return bleve.NewDisjunctionQuery(q, genrePathQuery(g, boost))
+}
+
+func genrePathQuery(genre string, boost float64) bleveQuery.Query {
+	tq := bleve.NewTermQuery(genre)
+	tq.SetField("genre_path")
+	tq.SetBoost(boost)
+	return tq
+}
+
+// validateGenres checks the [genres] config: parents must be genres
+// themselves, the parent chain must not loop, and no spelling may belong to
+// two genres.
+func validateGenres(genres map[string]GenreConfig, bad func(string, ...any)) {
+	names := make(map[string]string, len(genres)) // normalized → as written
+	for name := range genres {
+		n := normalizeGenreName(name)
+		if n == "" || genreKey(n) == "" {
+			bad("genres: %q is not a usable genre name", name)
+			continue
+		}
+		if other, dup := names[n]; dup {
+			bad("genres: %q and %q are the same genre", other, name)
+		}
+		names[n] = name
+	}
+
+	owner := make(map[string]string)
+	claim := func(spelling, genre string) {
+		key := genreKey(spelling)
+		if key == "" {
+			bad("genres.%s: alias %q has no letters or digits", genre, spelling)
+			return
+		}
+		if prev, ok := owner[key]; ok && prev != genre {
+			bad("genres: %q belongs to both %q and %q", spelling, prev, genre)
+			return
+		}
+		owner[key] = genre
+	}
+	for name := range genres {
+		if genreKey(name) != "" { // unusable names were reported above
+			claim(name, normalizeGenreName(name))
+		}
+	}
+	for name, g := range genres {
+		for _, alias := range g.Aliases {
+			claim(alias, normalizeGenreName(name))
+		}
+	}
+
+	for name, g := range genres {
+		if g.Parent == "" {
+			continue
+		}
+		if _, ok := names[normalizeGenreName(g.Parent)]; !ok {
+			bad("genres.%s: parent %q is not a genre", name, g.Parent)
+			continue
+		}
+		seen := map[string]bool{normalizeGenreName(name): true}
+		for p := normalizeGenreName(g.Parent); p != ""; p = normalizeGenreName(genres[names[p]].Parent) {
+			if seen[p] {
+				bad("genres.%s: parent chain loops back through %q", name, p)
+				break
+			}
+			seen[p] = true
+			if _, ok := names[p]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// genreNode is one genre in the GET /api/genres response.
+type genreNode struct {
+	Name     string   `json:"name"`
+	Parent   string   `json:"parent,omitempty"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// handleGenres is GET /api/genres: the taxonomy, so clients can show the
+// same genre chips the search uses. Roots come first, then genres in name
+// order.
+func handleGenres(w http.ResponseWriter, r *http.Request) {
+	t := taxonomy()
+	nodes := make([]genreNode, 0, len(t.names))
+	for _, name := range t.names {
+		nodes = append(nodes, genreNode{
+			Name:     name,
+			Parent:   t.parent[name],
+			Aliases:  t.aliases[name],
+			Children: t.children[name],
+		})
+	}
+	slices.SortStableFunc(nodes, func(a, b genreNode) int {
+		return cmp.Compare(len(t.lineage(a.Name)), len(t.lineage(b.Name)))
+	})
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{"genres": nodes})
+}
+
+// defaultGenres is the built-in taxonomy. Entries in the config's [genres]
+// replace the built-in genre of the same name.
+func defaultGenres() map[string]GenreConfig {
+	return map[string]GenreConfig{
+		"electronic":        {Aliases: []string{"electronica", "electro", "edm", "electronic music", "dance"}},
+		"house":             {Parent: "electronic"},
+		"deep house":        {Parent: "house"},
+		"tech house":        {Parent: "house"},
+		"progressive house": {Parent: "house"},
+		"techno":            {Parent: "electronic"},
+		"trance":            {Parent: "electronic"},
+		"drum and bass":     {Parent: "electronic", Aliases: []string{"dnb", "drum & bass", "drum n bass", "drum'n'bass", "jungle"}},
+		"dubstep":           {Parent: "electronic"},
+		"ambient":           {Parent: "electronic", Aliases: []string{"ambience"}},
+		"drone":             {Parent: "ambient", Aliases: []string{"drone ambient"}},
+		"downtempo":         {Parent: "electronic", Aliases: []string{"chillout", "chill", "trip hop"}},
+		"lounge":            {Aliases: []string{"easy listening"}},
+		"hip hop":           {Aliases: []string{"rap"}},
+		"rock":              {Aliases: []string{"rock and roll", "rock n roll"}},
+		"classic rock":      {Parent: "rock"},
+		"alternative":       {Parent: "rock", Aliases: []string{"alternative rock", "alt rock"}},
+		"indie":             {Parent: "alternative", Aliases: []string{"indie rock", "indie pop"}},
+		"metal":             {Parent: "rock", Aliases: []string{"heavy metal"}},
+		"punk":              {Parent: "rock", Aliases: []string{"punk rock"}},
+		"pop":               {Aliases: []string{"pop music", "top 40", "hits"}},
+		"jazz":              {},
+		"smooth jazz":       {Parent: "jazz"},
+		"jazz fusion":       {Parent: "jazz", Aliases: []string{"fusion"}},
+		"blues":             {},
+		"soul":              {},
+		"rnb":               {Parent: "soul", Aliases: []string{"r&b", "r and b", "rhythm and blues"}},
+		"funk":              {Parent: "soul"},
+		"classical":         {Aliases: []string{"classical music", "orchestral"}},
+		"country":           {},
+		"folk":              {},
+		"reggae":            {},
+		"latin":             {},
+		"salsa":             {Parent: "latin"},
+		"reggaeton":         {Parent: "latin"},
+		"world":             {Aliases: []string{"world music"}},
+		"talk":              {Aliases: []string{"talk radio", "spoken word"}},
+		"news":              {Parent: "talk"},
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenreCanonicalize(t *testing.T) {
+	tax := newGenreTaxonomy(defaultGenres())
+	tests := []struct {
+		spelling string
+		want     string
+		wantOK   bool
+	}{
+		{"hip hop", "hip hop", true},
+		{"Hip-Hop", "hip hop", true},
+		{"HIPHOP", "hip hop", true},
+		{"rap", "hip hop", true},
+		{"Drum & Bass", "drum and bass", true},
+		{"drum'n'bass", "drum and bass", true},
+		{"R&B", "rnb", true},
+		{"electrónica", "electronic", true},
+		{"  deep   house ", "deep house", true},
+		{"vaporwave", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tax.canonicalize(tt.spelling)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("canonicalize(%q) = %q, %v, want %q, %v", tt.spelling, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestGenreLineage(t *testing.T) {
+	tax := newGenreTaxonomy(defaultGenres())
+	tests := []struct {
+		genre string
+		want  []string
+	}{
+		{"deep house", []string{"deep house", "house", "electronic"}},
+		{"indie", []string{"indie", "alternative", "rock"}},
+		{"jazz", []string{"jazz"}},
+		{"vaporwave", []string{"vaporwave"}},
+	}
+	for _, tt := range tests {
+		if got := tax.lineage(tt.genre); !slices.Equal(got, tt.want) {
+			t.Errorf("lineage(%q) = %v, want %v", tt.genre, got, tt.want)
+		}
+	}
+}
+
+func TestGenreExpand(t *testing.T) {
+	tax := newGenreTaxonomy(defaultGenres())
+	tests := []struct {
+		raw           []string
+		paths, canons []string
+	}{
+		{
+			raw:    []string{"Deep House", "techno"},
+			paths:  []string{"deep house", "house", "electronic", "techno"},
+			canons: []string{"deep house", "techno"},
+		},
+		{
+			raw:    []string{"rap", "Hip-Hop", "vaporwave"},
+			paths:  []string{"hip hop"},
+			canons: []string{"hip hop"},
+		},
+		{
+			raw: []string{"vaporwave"},
+		},
+	}
+	for _, tt := range tests {
+		paths, canons := tax.expand(tt.raw)
+		if !slices.Equal(paths, tt.paths) || !slices.Equal(canons, tt.canons) {
+			t.Errorf("expand(%q) = %v, %v, want %v, %v", tt.raw, paths, canons, tt.paths, tt.canons)
+		}
+	}
+}
+
+func TestValidateGenres(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres map[string]GenreConfig
+		want   []string // substrings of the expected problems
+	}{
+		{
+			name:   "built-in taxonomy",
+			genres: defaultGenres(),
+		},
+		{
+			name:   "unknown parent",
+			genres: map[string]GenreConfig{"house": {Parent: "electronic"}},
+			want:   []string{`parent "electronic" is not a genre`},
+		},
+		{
+			name: "parent loop",
+			genres: map[string]GenreConfig{
+				"a": {Parent: "b"},
+				"b": {Parent: "a"},
+			},
+			want: []string{"loops back", "loops back"},
+		},
+		{
+			name: "alias shared by two genres",
+			genres: map[string]GenreConfig{
+				"hip hop": {Aliases: []string{"rap"}},
+				"rap":     {},
+			},
+			want: []string{`"rap" belongs to both`},
+		},
+		{
+			name:   "alias spelling another genre",
+			genres: map[string]GenreConfig{"hip hop": {}, "rap": {Aliases: []string{"Hip-Hop"}}},
+			want:   []string{`"Hip-Hop" belongs to both`},
+		},
+		{
+			name:   "same genre twice",
+			genres: map[string]GenreConfig{"Hip Hop": {}, "hip  hop": {}},
+			want:   []string{"are the same genre"},
+		},
+		{
+			name:   "unusable name",
+			genres: map[string]GenreConfig{"&&": {}},
+			want:   []string{"not a usable genre name"},
+		},
+		{
+			name:   "unusable alias",
+			genres: map[string]GenreConfig{"rnb": {Aliases: []string{"&"}}},
+			want:   []string{"has no letters or digits"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var problems []string
+			validateGenres(tt.genres, func(format string, args ...any) {
+				problems = append(problems, fmt.Sprintf(format, args...))
+			})
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d matching %q", problems, len(tt.want), tt.want)
+			}
+			for _, want := range tt.want {
+				if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, want) }) {
+					t.Errorf("problems = %q, want one containing %q", problems, want)
+				}
+			}
+		})
+	}
+}
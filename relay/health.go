@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// version is overridden at build time with -ldflags "-X main.version=...".
+// When it isn't, the VCS revision embedded by the Go toolchain is used.
+var version = "dev"
+
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				return "dev-" + s.Value[:12]
+			}
+		}
+	}
+	return version
+}
+
+// maxStatsScan caps the full LMDB walk that recounts events by kind.
+const maxStatsScan = 10_000_000
+
+// statsSnapshot is the event counts by kind as of one moment.
+type statsSnapshot struct {
+	Total        int
+	ByKind       map[nostr.Kind]int
+	CountedAt    time.Time
+	ScanDuration time.Duration
+}
+
+func (s *statsSnapshot) stations() int { return s.ByKind[indexedKind] }
+
+// relayHealth backs /healthz, /readyz and /stats.
+//
+// The event counts by kind come from one full LMDB pass at startup and are
+// then kept current by the write wrappers in main, through observe, so
+// /stats never waits on or competes with a scan. Every
+// health.stats_interval a background recount replaces them, correcting any
+// drift.
+type relayHealth struct {
+	db         eventstore.Store
+	search     *stationSearch
+	duplicates *duplicateReport
+	life       *lifecycle
+	live       *liveConfig
+	started    time.Time
+
+	mu sync.Mutex
+	// byKind is nil until the first recount finishes.
+	byKind map[nostr.Kind]int
+	// pending collects the changes observed while a recount runs, which
+	// its LMDB snapshot doesn't see; nil otherwise.
+	pending      map[nostr.Kind]int
+	countedAt    time.Time
+	scanDuration time.Duration
+}
+
+func newRelayHealth(db eventstore.Store, search *stationSearch, duplicates *duplicateReport, life *lifecycle, live *liveConfig) *relayHealth {
+	return &relayHealth{db: db, search: search, duplicates: duplicates, life: life, live: live, started: time.Now()}
+}
+
+// run recounts the events until ctx is cancelled. The interval is re-read
+// from the live config after every pass.
+func (h *relayHealth) run(ctx context.Context) {
+	for {
+		h.recount()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.live.Load().Health.StatsInterval.Duration):
+		}
+	}
+}
+
+func (h *relayHealth) recount() {
+	h.mu.Lock()
+	h.pending = make(map[nostr.Kind]int)
+	h.mu.Unlock()
+
+	start := time.Now()
+	byKind := make(map[nostr.Kind]int)
+	for evt := range h.db.QueryEvents(nostr.Filter{}, maxStatsScan) {
+		byKind[evt.Kind]++
+	}
+
+	h.mu.Lock()
+	for kind, delta := range h.pending {
+		addCount(byKind, kind, delta)
+	}
+	h.byKind, h.pending = byKind, nil
+	h.countedAt, h.scanDuration = time.Now(), time.Since(start)
+	h.mu.Unlock()
+	slog.Debug("event counts recounted", "stations", byKind[indexedKind], "took", time.Since(start).Round(time.Millisecond))
+}
+
+// observe records that a write added (delta 1) or removed (delta -1) an
+// event of kind.
+func (h *relayHealth) observe(kind nostr.Kind, delta int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.byKind != nil {
+		addCount(h.byKind, kind, delta)
+	}
+	if h.pending != nil {
+		h.pending[kind] += delta
+	}
+}
+
+func addCount(byKind map[nostr.Kind]int, kind nostr.Kind, delta int) {
+	if n := byKind[kind] + delta; n > 0 {
+		byKind[kind] = n
+	} else {
+		delete(byKind, kind)
+	}
+}
+
+// snapshot returns the current counts, or nil before the first recount has
+// finished.
+func (h *relayHealth) snapshot() *statsSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.byKind == nil {
+		return nil
+	}
+	snap := &statsSnapshot{ByKind: maps.Clone(h.byKind), CountedAt: h.countedAt, ScanDuration: h.scanDuration}
+	for _, n := range snap.ByKind {
+		snap.Total += n
+	}
+	return snap
+}
+
+// handleHealthz is GET /healthz: the process is up and serving HTTP.
+func (h *relayHealth) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// handleReadyz is GET /readyz. Ready means: not shutting down, LMDB answers
+// a read, the bleve index is open, and the index isn't missing more than
+// health.max_index_drift of the stations LMDB holds. That last check is the
+// runtime version of the startup drift warning — a relay can be listening
+// with an empty index, and it should not receive traffic in that state.
+//
+// The "schema" check is informational: an index built with an older
+// searchSchemaVersion still answers queries (some filters just match
+// nothing), so it is reported as "outdated" without failing readiness.
+// The deploy script looks for it and runs --reindex.
+func (h *relayHealth) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(name, msg string) {
+		checks[name] = msg
+		ready = false
+	}
+
+	if h.life.isClosing() {
+		fail("lifecycle", "shutting down")
+	} else {
+		checks["lifecycle"] = "ok"
+	}
+
+	if err := h.checkLMDB(r.Context()); err != nil {
+		fail("lmdb", err.Error())
+	} else {
+		checks["lmdb"] = "ok"
+	}
+
+	docs, err := h.search.index.DocCount()
+	if err != nil {
+		fail("index", err.Error())
+	} else {
+		checks["index"] = "ok"
+	}
+
+	if err == nil {
+		if msg := h.driftProblem(docs); msg != "" {
+			fail("drift", msg)
+		} else {
+			checks["drift"] = "ok"
+		}
+		if h.search.schemaOutdated() {
+			checks["schema"] = "outdated"
+		} else {
+			checks["schema"] = "ok"
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{"ready": ready, "checks": checks})
+}
+
+// checkLMDB reads a single event, giving up after a couple of seconds so a
+// wedged environment shows up as not-ready rather than a hung probe.
+func (h *relayHealth) checkLMDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		for range h.db.QueryEvents(nostr.Filter{Limit: 1}, 1) {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("read timed out")
+	}
+}
+
+// driftProblem compares the index doc count with the latest LMDB station
+// count. Until the first snapshot exists it falls back to the same cheap
+// probe the startup drift check uses: stations in LMDB but an empty index.
+func (h *relayHealth) driftProblem(docs uint64) string {
+	snap := h.snapshot()
+	if snap == nil {
+		if docs >= 2 {
+			return ""
+		}
+		for range h.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{indexedKind}}, 2) {
+			return fmt.Sprintf("index has %d docs but LMDB has stations", docs)
+		}
+		return ""
+	}
+	stations := snap.stations()
+	if stations == 0 {
+		return ""
+	}
+	missing := stations - int(docs)
+	maxDrift := h.live.Load().Health.MaxIndexDrift
+	if missing > 0 && float64(missing)/float64(stations) > maxDrift {
+		return fmt.Sprintf("index has %d docs but LMDB has %d stations (%.1f%% missing, max %.1f%%)",
+			docs, stations, 100*float64(missing)/float64(stations), 100*maxDrift)
+	}
+	return ""
+}
+
+// handleStats is GET /stats.
+func (h *relayHealth) handleStats(w http.ResponseWriter, r *http.Request) {
+	out := map[string]any{
+		"version":        buildVersion(),
+		"started_at":     h.started.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(h.started).Seconds()),
+	}
+
+	index := map[string]any{
+		"schema":         h.search.storedSchema,
+		"current_schema": searchSchemaVersion,
+	}
+	if docs, err := h.search.index.DocCount(); err == nil {
+		index["docs"] = docs
+	} else {
+		index["error"] = err.Error()
+	}
+	out["index"] = index
+
+	if snap := h.snapshot(); snap != nil {
+		byKind := make(map[string]int, len(snap.ByKind))
+		for k, n := range snap.ByKind {
+			byKind[strconv.Itoa(int(k))] = n
+		}
+		out["events"] = map[string]any{
+			"total":            snap.Total,
+			"by_kind":          byKind,
+			"counted_at":       snap.CountedAt.UTC().Format(time.RFC3339),
+			"scan_duration_ms": snap.ScanDuration.Milliseconds(),
+		}
+		out["stations"] = snap.stations()
+		if docs, ok := index["docs"].(uint64); ok {
+			index["drift"] = snap.stations() - int(docs)
+		}
+	} else {
+		out["events"] = nil
+		out["stations"] = nil
+	}
+	out["duplicates"] = h.duplicates.stats()
+
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	bleve "github.com/blevesearch/bleve/v2"
+)
+
+// highlightFields are the text fields fragments are cut from, in the order
+// clients should prefer them.
+var highlightFields = []string{"name", "genre", "location", "description"}
+
+// Highlights returns, for each station ID in ids that q matches, the
+// fragments of each field where q's words or phrases occur, keyed by event
+// ID and then field. Fragments are HTML-escaped with the matched terms in
+// <mark>. IDs that don't match, or matched only through filters, are left
+// out.
+func (s *stationSearch) Highlights(q stationQuery, ids []string) (map[string]map[string][]string, error) {
+	out := make(map[string]map[string][]string)
+	if len(ids) == 0 || strings.TrimSpace(q.Text) == "" {
+		return out, nil
+	}
+	query := bleve.NewConjunctionQuery(q.compile(), bleve.NewDocIDQuery(ids))
+	req := bleve.NewSearchRequestOptions(query, len(ids), 0, false)
+	req.Highlight = bleve.NewHighlight()
+	for _, field := range highlightFields {
+		req.Highlight.AddField(field)
+	}
+	result, err := s.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range result.Hits {
+		// bleve returns a field's start when nothing in it matched; only
+		// fragments with a marked term say why the station matched.
+		fields := make(map[string][]string)
+		for field, frags := range hit.Fragments {
+			for _, frag := range frags {
+				if strings.Contains(frag, "<mark>") {
+					fields[field] = append(fields[field], frag)
+				}
+			}
+		}
+		if len(fields) > 0 {
+			out[hit.ID] = fields
+		}
+	}
+	return out, nil
+}
+
+// handleHighlights is GET /api/stations/highlights?q=&ids=: the companion
+// to a NIP-50 REQ. A client passes the search string it sent and the IDs of
+// the stations it got back, and learns why each one matched. ids may be
+// repeated or comma-separated, up to limits.max_search_limit of them.
+func (a *stationAPI) handleHighlights(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	text := params.Get("q")
+	if strings.TrimSpace(text) == "" {
+		writeJSONError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	ids := queryList(params["ids"])
+	for i, id := range ids {
+		ids[i] = strings.ToLower(id)
+	}
+	if len(ids) > a.live.Load().Limits.MaxSearchLimit {
+		writeJSONError(w, http.StatusBadRequest, "too many ids")
+		return
+	}
+	highlights, err := a.search.Highlights(stationQuery{Text: text}, ids)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	writeJSON(w, http.StatusOK, map[string]any{"highlights": highlights})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	hllBucket = []byte("hll")
+	hllMeta   = []byte("meta")
+	// hllBackfilledKey marks that the registers cover every event LMDB
+	// held when they were first built. Its name carries the register
+	// format; a file without it is cleared and rebuilt. v2 counts zap
+	// receipts by their signer, as NIP-45 does, where v1 used the zapper.
+	hllBackfilledKey = []byte("backfilled-v2")
+)
+
+// hllRegisterCount is NIP-45's fixed register count.
+const hllRegisterCount = 256
+
+// zapReceiptKind is the NIP-57 zap receipt.
+const zapReceiptKind = nostr.Kind(9735)
+
+// hllKinds are the kinds whose per-target registers are kept on write:
+// reactions, favorites lists and zap receipts, the "how many people liked
+// or favourited this station" questions the landing page asks. Zap
+// receipts count by signer, as every NIP-45 register does.
+var hllKinds = []nostr.Kind{7, listKind, zapReceiptKind}
+
+// hllTags are the target tags registers are kept for.
+var hllTags = []string{"a", "e"}
+
+// maxHLLBackfill caps the LMDB scan per kind when the registers are built.
+const maxHLLBackfill = 5_000_000
+
+// hllFlushTargets is how many targets' registers the backfill gathers in
+// memory, 256 bytes each, before writing them out.
+const hllFlushTargets = 20_000
+
+// hllCounts keeps NIP-45 HyperLogLog registers for every {kind, #a or #e
+// value} in hllKinds, updated as events are stored. A COUNT for one of
+// those targets is then a single bbolt read, and the registers are what
+// other relays need to merge the count with their own.
+//
+// Registers only ever grow, so an unliked or unfavourited station keeps
+// counting the pubkey until the file is removed and rebuilt on next start.
+type hllCounts struct {
+	db *bolt.DB
+	// ready is false while the registers are being backfilled from LMDB;
+	// counts go to the LMDB scan until then.
+	ready atomic.Bool
+}
+
+func openHLLCounts(path string) (*hllCounts, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening HLL counts: %w", err)
+	}
+	var backfilled bool
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(hllMeta)
+		if err != nil {
+			return err
+		}
+		backfilled = meta.Get(hllBackfilledKey) != nil
+		if !backfilled && tx.Bucket(hllBucket) != nil {
+			// Registers only grow, so anything from an older format or an
+			// interrupted backfill has to go before building again.
+			if err := tx.DeleteBucket(hllBucket); err != nil {
+				return err
+			}
+		}
+		_, err = tx.CreateBucketIfNotExists(hllBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing HLL counts: %w", err)
+	}
+	h := &hllCounts{db: db}
+	h.ready.Store(backfilled)
+	return h, nil
+}
+
+func (h *hllCounts) Close() error { return h.db.Close() }
+
+// Backfill builds the registers from the events already in store, once per
+// counts file. They are gathered in memory and written hllFlushTargets at a
+// time, so the scan isn't paced by bbolt commits. Events stored while it
+// runs are observed as usual; merging takes the larger register either way.
+// If ctx ends first the counts stay unbuilt and the next start begins again.
+func (h *hllCounts) Backfill(ctx context.Context, store eventstore.Store) {
+	if h.ready.Load() {
+		return
+	}
+	start := time.Now()
+	n := 0
+	pending := make(map[string][]byte)
+	for _, kind := range hllKinds {
+		for evt := range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{kind}}, maxHLLBackfill) {
+			if ctx.Err() != nil {
+				return
+			}
+			keys, offsets := hllTargets(evt)
+			for i, key := range keys {
+				regs, ok := pending[string(key)]
+				if !ok {
+					regs = make([]byte, hllRegisterCount)
+					pending[string(key)] = regs
+				}
+				hllAdd(regs, evt.PubKey, offsets[i])
+			}
+			n++
+			if len(pending) >= hllFlushTargets {
+				if err := h.merge(pending); err != nil {
+					slog.Warn("HLL backfill stopped", "err", err)
+					return
+				}
+				clear(pending)
+			}
+		}
+	}
+	if err := h.merge(pending); err != nil {
+		slog.Warn("HLL backfill stopped", "err", err)
+		return
+	}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hllMeta).Put(hllBackfilledKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		slog.Warn("failed to mark HLL counts as built", "err", err)
+		return
+	}
+	h.ready.Store(true)
+	slog.Info("built HLL counts", "events", n, "took", time.Since(start).Round(time.Millisecond))
+}
+
+// merge folds pending registers into the stored ones in one transaction,
+// keeping the larger value of each register.
+func (h *hllCounts) merge(pending map[string][]byte) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hllBucket)
+		for key, add := range pending {
+			regs := make([]byte, hllRegisterCount)
+			copy(regs, b.Get([]byte(key)))
+			changed := false
+			for i, r := range add {
+				if r > regs[i] {
+					regs[i] = r
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			if err := b.Put([]byte(key), regs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// observe adds evt's pubkey to the registers of every target it tags.
+// Events of other kinds are ignored. It commits right away rather than
+// through bbolt's Batch, whose delay would hold up every stored event.
+func (h *hllCounts) observe(evt nostr.Event) error {
+	keys, offsets := hllTargets(evt)
+	if len(keys) == 0 {
+		return nil
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hllBucket)
+		for i, key := range keys {
+			regs := make([]byte, hllRegisterCount)
+			copy(regs, b.Get(key))
+			if !hllAdd(regs, evt.PubKey, offsets[i]) {
+				continue
+			}
+			if err := b.Put(key, regs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hllTargets returns the register keys evt counts towards, each with its
+// offset, or nothing if evt isn't of a kind in hllKinds.
+func hllTargets(evt nostr.Event) (keys [][]byte, offsets []int) {
+	if !slices.Contains(hllKinds, evt.Kind) {
+		return nil, nil
+	}
+	for _, name := range hllTags {
+		for tag := range evt.Tags.FindAll(name) {
+			if len(tag) < 2 {
+				continue
+			}
+			offset, ok := hllOffset(name, tag[1])
+			if !ok {
+				continue
+			}
+			key := hllKey(evt.Kind, name, tag[1])
+			if slices.ContainsFunc(keys, func(k []byte) bool { return string(k) == string(key) }) {
+				continue
+			}
+			keys = append(keys, key)
+			offsets = append(offsets, offset)
+		}
+	}
+	return keys, offsets
+}
+
+// lookup returns the registers for filter if it asks exactly for one kept
+// target: one kind from hllKinds, one #a or #e value and nothing else that
+// would narrow the set. A target nobody has tagged yet has empty registers.
+func (h *hllCounts) lookup(filter nostr.Filter) (regs []byte, offset int, ok bool) {
+	if !h.ready.Load() {
+		return nil, 0, false
+	}
+	if len(filter.Kinds) != 1 || !slices.Contains(hllKinds, filter.Kinds[0]) {
+		return nil, 0, false
+	}
+	if len(filter.IDs) != 0 || len(filter.Authors) != 0 || filter.Since != 0 || filter.Until != 0 || filter.Search != "" {
+		return nil, 0, false
+	}
+	if len(filter.Tags) != 1 {
+		return nil, 0, false
+	}
+	var name, value string
+	for k, vals := range filter.Tags {
+		if len(vals) != 1 || !slices.Contains(hllTags, k) {
+			return nil, 0, false
+		}
+		name, value = k, vals[0]
+	}
+	offset, ok = hllOffset(name, value)
+	if !ok {
+		return nil, 0, false
+	}
+	regs = make([]byte, hllRegisterCount)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		copy(regs, tx.Bucket(hllBucket).Get(hllKey(filter.Kinds[0], name, value)))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false
+	}
+	return regs, offset, true
+}
+
+func hllKey(kind nostr.Kind, tag, value string) []byte {
+	return []byte(strconv.Itoa(int(kind)) + ":" + tag + ":" + value)
+}
+
+// hllOffset is NIP-45's register offset for a tag value: the hex digit at
+// position 32 of the event ID, or of the pubkey inside an address, plus 8.
+func hllOffset(tag, value string) (int, bool) {
+	if tag == "a" {
+		parts := strings.SplitN(value, ":", 3)
+		if len(parts) != 3 {
+			return 0, false
+		}
+		value = parts[1]
+	}
+	if len(value) != 64 {
+		return 0, false
+	}
+	if _, err := hex.DecodeString(value); err != nil {
+		return 0, false
+	}
+	digit, _ := strconv.ParseUint(value[32:33], 16, 8)
+	return int(digit) + 8, true
+}
+
+// hllAdd folds pk into regs at offset as NIP-45 describes: the byte at the
+// offset picks the register, and the leading zero bits of the next eight
+// bytes plus one is its candidate value. It reports whether regs changed.
+func hllAdd(regs []byte, pk nostr.PubKey, offset int) bool {
+	ri := pk[offset]
+	var zeros byte
+	for _, b := range pk[offset+1 : offset+9] {
+		if b == 0 {
+			zeros += 8
+			continue
+		}
+		for b&0x80 == 0 {
+			zeros++
+			b <<= 1
+		}
+		break
+	}
+	if zeros+1 <= regs[ri] {
+		return false
+	}
+	regs[ri] = zeros + 1
+	return true
+}
+
+// hllEstimate is the standard HyperLogLog estimate over 256 registers,
+// with linear counting for small cardinalities.
+func hllEstimate(regs []byte) uint32 {
+	const m = float64(hllRegisterCount)
+	alpha := 0.7213 / (1 + 1.079/m)
+	sum, zeros := 0.0, 0
+	for _, r := range regs {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint32(math.Round(estimate))
+}
+
+// estimates returns the count for each value of tag on kind, reading all
+// registers in one transaction; values with no registers (or before the
+// backfill has finished) count 0.
+func (h *hllCounts) estimates(kind nostr.Kind, tag string, values []string) []uint32 {
+	out := make([]uint32, len(values))
+	if !h.ready.Load() {
+		return out
+	}
+	_ = h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hllBucket)
+		for i, v := range values {
+			if regs := b.Get(hllKey(kind, tag, v)); regs != nil {
+				out[i] = hllEstimate(regs)
+			}
+		}
+		return nil
+	})
+	return out
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestHLLOffset(t *testing.T) {
+	// position 32 of each value is the digit after the 32 leading chars
+	hexWith := func(digit string) string {
+		return strings.Repeat("a", 32) + digit + strings.Repeat("b", 31)
+	}
+	tests := []struct {
+		tag, value string
+		want       int
+		wantOK     bool
+	}{
+		{"e", hexWith("0"), 8, true},
+		{"e", hexWith("7"), 15, true},
+		{"e", hexWith("f"), 23, true},
+		{"e", hexWith("F"), 23, true},
+		{"a", "31237:" + hexWith("c") + ":my-station", 20, true},
+		{"a", "31237:" + hexWith("c") + ":", 20, true},
+		{"a", "31237:" + hexWith("c"), 0, false},
+		{"a", hexWith("c"), 0, false},
+		{"e", hexWith("0")[:63], 0, false},
+		{"e", hexWith("g"), 0, false},
+		{"e", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := hllOffset(tt.tag, tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("hllOffset(%q, %q) = %d, %v, want %d, %v", tt.tag, tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestHLLAdd(t *testing.T) {
+	const offset = 8
+	tests := []struct {
+		name    string
+		ri      byte
+		next    []byte // pk[offset+1:], zero-padded
+		initial byte
+		want    byte
+		changed bool
+	}{
+		{name: "leading one bit", ri: 3, next: []byte{0x80}, want: 1, changed: true},
+		{name: "three zero bits", ri: 3, next: []byte{0x10}, want: 4, changed: true},
+		{name: "zero byte then bits", ri: 200, next: []byte{0x00, 0x01}, want: 16, changed: true},
+		{name: "all zero", ri: 0, next: make([]byte, 8), want: 65, changed: true},
+		{name: "lower than register", ri: 3, next: []byte{0x10}, initial: 9, want: 9},
+		{name: "equal to register", ri: 3, next: []byte{0x10}, initial: 4, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pk nostr.PubKey
+			pk[offset] = tt.ri
+			copy(pk[offset+1:], tt.next)
+			// bytes past the eight read must not matter
+			for i := offset + 9; i < len(pk); i++ {
+				pk[i] = 0xff
+			}
+			regs := make([]byte, hllRegisterCount)
+			regs[tt.ri] = tt.initial
+			if changed := hllAdd(regs, pk, offset); changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if regs[tt.ri] != tt.want {
+				t.Errorf("register %d = %d, want %d", tt.ri, regs[tt.ri], tt.want)
+			}
+		})
+	}
+}
+
+// hllTestPubKey is a deterministic, well-mixed pubkey.
+func hllTestPubKey(i int) nostr.PubKey {
+	return nostr.PubKey(sha256.Sum256(binary.BigEndian.AppendUint64(nil, uint64(i))))
+}
+
+func TestHLLEstimate(t *testing.T) {
+	if got := hllEstimate(make([]byte, hllRegisterCount)); got != 0 {
+		t.Errorf("empty registers = %d, want 0", got)
+	}
+	one := make([]byte, hllRegisterCount)
+	one[17] = 3
+	if got := hllEstimate(one); got != 1 {
+		t.Errorf("one register set = %d, want 1", got)
+	}
+
+	// 256 registers give a standard error of about 6.5%; allow three.
+	for _, n := range []int{10, 100, 1_000, 10_000, 100_000} {
+		for _, offset := range []int{8, 15, 23} {
+			regs := make([]byte, hllRegisterCount)
+			for i := range n {
+				hllAdd(regs, hllTestPubKey(i), offset)
+			}
+			got := float64(hllEstimate(regs))
+			if math.Abs(got-float64(n)) > 0.2*float64(n)+1 {
+				t.Errorf("n=%d offset=%d: estimate %v", n, offset, got)
+			}
+		}
+	}
+}
+
+func TestHLLCountsObserve(t *testing.T) {
+	h, err := openHLLCounts(filepath.Join(t.TempDir(), "hll.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.ready.Store(true)
+
+	station := "31237:" + hllTestPubKey(-1).Hex() + ":station"
+	other := "31237:" + hllTestPubKey(-2).Hex() + ":station"
+	observe := func(kind nostr.Kind, pk nostr.PubKey, tags ...nostr.Tag) {
+		t.Helper()
+		if err := h.observe(nostr.Event{Kind: kind, PubKey: pk, Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stationOffset, _ := hllOffset("a", station)
+	want := make([]byte, hllRegisterCount)
+	for i := range 50 {
+		observe(7, hllTestPubKey(i), nostr.Tag{"a", station})
+		hllAdd(want, hllTestPubKey(i), stationOffset)
+	}
+	reactions := hllEstimate(want)
+	// the same pubkeys again, and one event tagging the station twice
+	for i := range 50 {
+		observe(7, hllTestPubKey(i), nostr.Tag{"a", station}, nostr.Tag{"a", station})
+	}
+	observe(7, hllTestPubKey(1000), nostr.Tag{"a", other})
+	// not a counted kind
+	observe(1, hllTestPubKey(2000), nostr.Tag{"a", station})
+	// zap receipts count their signer, not the zapper in the P tag
+	zapper := hllTestPubKey(3000)
+	for i := range 20 {
+		observe(zapReceiptKind, zapper, nostr.Tag{"a", station}, nostr.Tag{"P", hllTestPubKey(i).Hex()})
+	}
+
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+		want   uint32
+		wantOK bool
+	}{
+		{"reactions", nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {station}}}, reactions, true},
+		{"other station", nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {other}}}, 1, true},
+		{"zap receipts", nostr.Filter{Kinds: []nostr.Kind{zapReceiptKind}, Tags: nostr.TagMap{"a": {station}}}, 1, true},
+		{"untagged target", nostr.Filter{Kinds: []nostr.Kind{listKind}, Tags: nostr.TagMap{"a": {station}}}, 0, true},
+		{"uncounted kind", nostr.Filter{Kinds: []nostr.Kind{1}, Tags: nostr.TagMap{"a": {station}}}, 0, false},
+		{"two kinds", nostr.Filter{Kinds: []nostr.Kind{7, listKind}, Tags: nostr.TagMap{"a": {station}}}, 0, false},
+		{"two values", nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {station, other}}}, 0, false},
+		{"author", nostr.Filter{Kinds: []nostr.Kind{7}, Authors: []nostr.PubKey{zapper}, Tags: nostr.TagMap{"a": {station}}}, 0, false},
+		{"since", nostr.Filter{Kinds: []nostr.Kind{7}, Since: 1, Tags: nostr.TagMap{"a": {station}}}, 0, false},
+		{"p tag", nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"p": {zapper.Hex()}}}, 0, false},
+		{"bad address", nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {"31237:nope:x"}}}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regs, _, ok := h.lookup(tt.filter)
+			if ok != tt.wantOK {
+				t.Fatalf("lookup ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := hllEstimate(regs); got != tt.want {
+				t.Errorf("estimate = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	got := h.estimates(7, "a", []string{station, other, "31237:unknown:x"})
+	if got[0] != reactions || got[1] != 1 || got[2] != 0 {
+		t.Errorf("estimates = %v, want [%d 1 0]", got, reactions)
+	}
+}
+
+func TestHLLCountsMerge(t *testing.T) {
+	h, err := openHLLCounts(filepath.Join(t.TempDir(), "hll.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.ready.Store(true)
+
+	// one pubkey written as it is stored, the rest merged from a backfill
+	station := "31237:" + hllTestPubKey(-1).Hex() + ":station"
+	offset, _ := hllOffset("a", station)
+	if err := h.observe(nostr.Event{Kind: 7, PubKey: hllTestPubKey(0), Tags: nostr.Tags{{"a", station}}}); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, hllRegisterCount)
+	hllAdd(want, hllTestPubKey(0), offset)
+	backfilled := make([]byte, hllRegisterCount)
+	for i := 1; i < 100; i++ {
+		hllAdd(backfilled, hllTestPubKey(i), offset)
+		hllAdd(want, hllTestPubKey(i), offset)
+	}
+	key := string(hllKey(7, "a", station))
+	if err := h.merge(map[string][]byte{key: backfilled}); err != nil {
+		t.Fatal(err)
+	}
+	// merging the same registers again changes nothing
+	if err := h.merge(map[string][]byte{key: backfilled}); err != nil {
+		t.Fatal(err)
+	}
+	regs, _, _ := h.lookup(nostr.Filter{Kinds: []nostr.Kind{7}, Tags: nostr.TagMap{"a": {station}}})
+	if string(regs) != string(want) {
+		t.Errorf("merged estimate %d, want %d", hllEstimate(regs), hllEstimate(want))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("failed to write JSON response", "err", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]any{"error": msg})
+}
+
+// requestBaseURL is the scheme and host the client used to reach us, taking
+// Caddy's X-Forwarded-Proto into account.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// renderedPage is a generated document (feed, sitemap, ...) kept in memory
+// so repeat requests and conditional GETs don't redo the LMDB work.
+type renderedPage struct {
+	body    []byte
+	modTime time.Time
+	etag    string
+	expires time.Time
+}
+
+// pageCache memoises renderedPages by key for ttl. Builds run outside the
+// lock, one per key at a time: a burst of requests for an expensive page
+// waits for one build, while other pages are served meanwhile.
+type pageCache struct {
+	ttl      time.Duration
+	maxPages int
+
+	mu       sync.Mutex
+	pages    map[string]*renderedPage
+	building map[string]*pageBuild
+}
+
+var errPageBuild = errors.New("page build failed")
+
+// pageBuild is a build in progress; page and err are set before done closes.
+type pageBuild struct {
+	done chan struct{}
+	page *renderedPage
+	err  error
+}
+
+func newPageCache(ttl time.Duration, maxPages int) *pageCache {
+	return &pageCache{
+		ttl:      ttl,
+		maxPages: maxPages,
+		pages:    make(map[string]*renderedPage),
+		building: make(map[string]*pageBuild),
+	}
+}
+
+func (c *pageCache) get(key string, build func() ([]byte, time.Time, error)) (*renderedPage, error) {
+	c.mu.Lock()
+	if p, ok := c.pages[key]; ok && time.Now().Before(p.expires) {
+		c.mu.Unlock()
+		return p, nil
+	}
+	if b, busy := c.building[key]; busy {
+		c.mu.Unlock()
+		<-b.done
+		return b.page, b.err
+	}
+	b := &pageBuild{done: make(chan struct{})}
+	c.building[key] = b
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.building, key)
+		if b.page == nil && b.err == nil {
+			// build panicked; waiters get an error rather than no page
+			b.err = errPageBuild
+		}
+		if b.page != nil {
+			if len(c.pages) >= c.maxPages {
+				// keys come from query strings; don't let them grow without bound
+				clear(c.pages)
+			}
+			c.pages[key] = b.page
+		}
+		c.mu.Unlock()
+		close(b.done)
+	}()
+	body, modTime, err := build()
+	if err != nil {
+		b.err = err
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	b.page = &renderedPage{
+		body:    body,
+		modTime: modTime,
+		etag:    strconv.Quote(hex.EncodeToString(sum[:8])),
+		expires: time.Now().Add(c.ttl),
+	}
+	return b.page, nil
+}
+
+// servePage writes p with validators, answering If-None-Match and
+// If-Modified-Since with 304.
+func servePage(w http.ResponseWriter, r *http.Request, p *renderedPage, contentType string, maxAge time.Duration) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	w.Header().Set("ETag", p.etag)
+	http.ServeContent(w, r, "", p.modTime, bytes.NewReader(p.body))
+}
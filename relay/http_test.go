@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPageCache(t *testing.T) {
+	c := newPageCache(time.Hour, 10)
+	var builds atomic.Int32
+	release := make(chan struct{})
+	slow := func() ([]byte, time.Time, error) {
+		builds.Add(1)
+		<-release
+		return []byte("slow"), time.Time{}, nil
+	}
+
+	// concurrent requests for one key share a build
+	var wg sync.WaitGroup
+	pages := make([]*renderedPage, 8)
+	for i := range pages {
+		wg.Go(func() {
+			p, err := c.get("slow", slow)
+			if err != nil {
+				t.Error(err)
+			}
+			pages[i] = p
+		})
+	}
+	for builds.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// other keys aren't held up by it
+	done := make(chan struct{})
+	go func() {
+		c.get("fast", func() ([]byte, time.Time, error) { return []byte("fast"), time.Time{}, nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a build for one key blocked another key")
+	}
+	close(release)
+	wg.Wait()
+	if n := builds.Load(); n != 1 {
+		t.Errorf("built %d times, want 1", n)
+	}
+	for _, p := range pages {
+		if p != pages[0] || string(p.body) != "slow" {
+			t.Fatalf("pages differ: %+v", pages)
+		}
+	}
+
+	// failures aren't cached
+	fail := errors.New("boom")
+	if _, err := c.get("bad", func() ([]byte, time.Time, error) { return nil, time.Time{}, fail }); err != fail {
+		t.Errorf("err = %v, want %v", err, fail)
+	}
+	if p, err := c.get("bad", func() ([]byte, time.Time, error) { return []byte("ok"), time.Time{}, nil }); err != nil || string(p.body) != "ok" {
+		t.Errorf("after a failure: %v, %v", p, err)
+	}
+}
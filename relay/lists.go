@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// listKind is the NIP-78 kind WaveFunc uses for favorites and featured
+// station lists. The two are told apart by their `l` label.
+const listKind = nostr.Kind(30078)
+
+const featuredListLabel = "featured_station_list"
+
+// stationList is the parsed view of a kind-30078 favorites or featured list.
+type stationList struct {
+	Event       nostr.Event
+	D           string
+	Label       string
+	Name        string
+	Description string
+	Image       string
+	Entries     []listEntry
+}
+
+// listEntry is one `a` tag pointing at a station:
+// ["a", "31237:<pubkey>:<d>", relay?, display_name?, order?].
+type listEntry struct {
+	Address     string
+	DisplayName string
+	Order       int
+}
+
+// parseStationList keeps only `a` tags that reference stations. Featured
+// lists are ordered by their order field; favorites keep tag order (their
+// fifth element is when the station was added, not a rank).
+func parseStationList(evt nostr.Event) stationList {
+	l := stationList{Event: evt, D: evt.Tags.GetD()}
+	if tag := evt.Tags.Find("l"); tag != nil {
+		l.Label = tag[1]
+	}
+
+	var content struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Image       string `json:"image"`
+	}
+	_ = json.Unmarshal([]byte(evt.Content), &content)
+	l.Name, l.Description, l.Image = content.Name, content.Description, content.Image
+	if tag := evt.Tags.Find("name"); tag != nil && l.Name == "" {
+		l.Name = tag[1]
+	}
+	if tag := evt.Tags.Find("description"); tag != nil && l.Description == "" {
+		l.Description = tag[1]
+	}
+
+	prefix := strconv.Itoa(int(indexedKind)) + ":"
+	for tag := range evt.Tags.FindAll("a") {
+		if len(tag) < 2 || !strings.HasPrefix(tag[1], prefix) {
+			continue
+		}
+		entry := listEntry{Address: tag[1]}
+		if len(tag) > 3 {
+			entry.DisplayName = tag[3]
+		}
+		if len(tag) > 4 {
+			entry.Order, _ = strconv.Atoi(tag[4])
+		}
+		l.Entries = append(l.Entries, entry)
+	}
+	if l.Label == featuredListLabel {
+		slices.SortStableFunc(l.Entries, func(a, b listEntry) int { return a.Order - b.Order })
+	}
+	return l
+}
+
+// resolveStations returns the current station event for each entry, in list
+// order. Entries whose station isn't in store are skipped.
+func (l stationList) resolveStations(store eventstore.Store) []station {
+	stations := make([]station, 0, len(l.Entries))
+	seen := make(map[string]bool, len(l.Entries))
+	for _, entry := range l.Entries {
+		if seen[entry.Address] {
+			continue
+		}
+		seen[entry.Address] = true
+		kind, pk, d, ok := parseAddress(entry.Address)
+		if !ok {
+			continue
+		}
+		if evt, found := fetchAddress(store, kind, pk, d); found {
+			stations = append(stations, parseStation(evt))
+		}
+	}
+	return stations
+}
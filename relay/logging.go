@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// newLogger builds the process-wide slog logger. format is "text" or "json".
+// Passing a *slog.LevelVar as level lets a config reload change verbosity
+// without rebuilding the handler. slog.SetDefault on the result also routes
+// the stdlib `log` package through the same handler, so anything a
+// dependency logs ends up in the same stream as the relay's own records.
+func newLogger(format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+}
+
+// fatal logs msg and its attributes at error level and exits, for startup
+// failures the relay can't run past.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parseLogLevel accepts debug, info, warn or error (any case).
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("invalid log level %q", level)
+	}
+	return lvl, nil
+}
+
+// queryLogger emits one record per REQ once its result iterator is drained.
+//
+// Ordinary queries are sampled: only a log.query_sample fraction of them is
+// logged, at info level. Anything slower than log.slow_query is always
+// logged at warn level regardless of sampling, so a 5% sample never hides a
+// pathological filter. Latency is measured from QueryStored being called to
+// the iterator finishing, which includes the time khatru spends writing each
+// event to the socket — that is what the client experiences.
+//
+// The thresholds live behind an atomic pointer so a config reload can change
+// them while queries are in flight.
+type queryLogger struct {
+	logger   *slog.Logger
+	settings atomic.Pointer[LogConfig]
+}
+
+func newQueryLogger(logger *slog.Logger, cfg LogConfig) *queryLogger {
+	ql := &queryLogger{logger: logger}
+	ql.configure(cfg)
+	return ql
+}
+
+func (ql *queryLogger) configure(cfg LogConfig) {
+	ql.settings.Store(&cfg)
+}
+
+func (ql *queryLogger) wrap(ctx context.Context, filter nostr.Filter, seq iter.Seq[nostr.Event]) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		start := time.Now()
+		results := 0
+		defer func() {
+			ql.log(ctx, filter, results, time.Since(start))
+		}()
+		for evt := range seq {
+			results++
+			if !yield(evt) {
+				return
+			}
+		}
+	}
+}
+
+func (ql *queryLogger) log(ctx context.Context, filter nostr.Filter, results int, latency time.Duration) {
+	settings := ql.settings.Load()
+	slow := settings.SlowQuery.Duration > 0 && latency >= settings.SlowQuery.Duration
+	sample := settings.QuerySample
+	if !slow && (sample <= 0 || (sample < 1 && rand.Float64() >= sample)) {
+		return
+	}
+
+	level := slog.LevelInfo
+	msg := "query"
+	if slow {
+		level = slog.LevelWarn
+		msg = "slow query"
+	}
+	if !ql.logger.Enabled(ctx, level) {
+		return
+	}
+
+	ql.logger.LogAttrs(ctx, level, msg,
+		slog.String("sub", safeGetSubscriptionID(ctx)),
+		slog.String("ip", safeGetIP(ctx)),
+		slog.Group("filter", filterAttrs(filter)...),
+		slog.Int("results", results),
+		slog.Duration("latency", latency),
+	)
+}
+
+// filterAttrs summarises a filter without dumping every id/author/tag value,
+// which can run to thousands of entries for follow-list queries.
+func filterAttrs(filter nostr.Filter) []any {
+	var attrs []any
+	if len(filter.IDs) > 0 {
+		attrs = append(attrs, slog.Int("ids", len(filter.IDs)))
+	}
+	if len(filter.Authors) > 0 {
+		attrs = append(attrs, slog.Int("authors", len(filter.Authors)))
+	}
+	if len(filter.Kinds) > 0 {
+		kinds := make([]int, len(filter.Kinds))
+		for i, k := range filter.Kinds {
+			kinds[i] = int(k)
+		}
+		attrs = append(attrs, slog.Any("kinds", kinds))
+	}
+	if filter.Since != 0 {
+		attrs = append(attrs, slog.Int64("since", int64(filter.Since)))
+	}
+	if filter.Until != 0 {
+		attrs = append(attrs, slog.Int64("until", int64(filter.Until)))
+	}
+	if filter.Limit > 0 {
+		attrs = append(attrs, slog.Int("limit", filter.Limit))
+	}
+	if filter.Search != "" {
+		attrs = append(attrs, slog.String("search", filter.Search))
+	}
+	for tagName, values := range filter.Tags {
+		attrs = append(attrs, slog.Int("#"+tagName, len(values)))
+	}
+	return attrs
+}
+
+// logIncomingEvent logs events being stored or replacing an earlier
+// version, before the write. Reactions and list saves arrive far more often
+// than queries are worth logging, so writes are only logged at debug level.
+func logIncomingEvent(ctx context.Context, evt nostr.Event) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Int("kind", int(evt.Kind)),
+		slog.String("kind_name", getKindName(evt.Kind)),
+		slog.String("id", evt.ID.Hex()),
+		slog.String("pubkey", evt.PubKey.Hex()),
+		slog.String("ip", safeGetIP(ctx)),
+	}
+
+	switch evt.Kind {
+	case 31237:
+		if tag := evt.Tags.Find("name"); tag != nil {
+			attrs = append(attrs, slog.String("name", tag[1]))
+		}
+	case 31337:
+		if tag := evt.Tags.Find("title"); tag != nil {
+			attrs = append(attrs, slog.String("title", tag[1]))
+		}
+	case 30078, 31990, 31989:
+		if tag := evt.Tags.Find("d"); tag != nil {
+			attrs = append(attrs, slog.String("d", tag[1]))
+		}
+	}
+
+	slog.LogAttrs(ctx, slog.LevelDebug, "event", attrs...)
+}
+
+// safeGetSubscriptionID retrieves the subscription ID without panicking when
+// the context doesn't carry one (e.g. internal queries triggered by delete requests).
+func safeGetSubscriptionID(ctx context.Context) (subID string) {
+	defer func() {
+		if r := recover(); r != nil {
+			subID = "internal"
+		}
+	}()
+	subID = khatru.GetSubscriptionID(ctx)
+	if subID == "" {
+		subID = "internal"
+	}
+	return
+}
+
+// safeGetIP is the GetIP counterpart of safeGetSubscriptionID: internal
+// calls have no connection in their context.
+func safeGetIP(ctx context.Context) (ip string) {
+	defer func() {
+		if r := recover(); r != nil {
+			ip = ""
+		}
+	}()
+	return khatru.GetIP(ctx)
+}
+
+func getKindName(kind nostr.Kind) string {
+	switch kind {
+	case 0:
+		return "Metadata"
+	case 1:
+		return "Note"
+	case 3:
+		return "Contacts"
+	case 7:
+		return "Reaction"
+	case 1111:
+		return "Comment"
+	case 1311:
+		return "Live Chat"
+	case 9735:
+		return "Zap"
+	case 10002:
+		return "Relay List"
+	case 30078:
+		return "App Data"
+	case 31237:
+		return "Radio Station"
+	case 31337:
+		return "Song"
+	case 31989:
+		return "Handler Recommendation"
+	case 31990:
+		return "Handler Info"
+	default:
+		if kind >= 30000 && kind < 40000 {
+			return "Parameterized Replaceable"
+		} else if kind >= 10000 && kind < 20000 {
+			return "Replaceable"
+		} else if kind >= 20000 && kind < 30000 {
+			return "Ephemeral"
+		}
+		return "Unknown"
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	_ "golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+// logoSizes are the square renditions generated for every logo.
+var logoSizes = []int{64, 192, 512}
+
+// maxLogoPixels rejects decompression bombs before decoding.
+const maxLogoPixels = 40_000_000
+
+var logosBucket = []byte("logos")
+
+// logoRecord is what the index keeps per station address.
+type logoRecord struct {
+	Source string `json:"source"`
+	// Sizes maps each size to the SHA-256 of its WebP file.
+	Sizes     map[int]string `json:"sizes,omitempty"`
+	FetchedAt int64          `json:"fetched_at"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// logoMirror fetches station thumbnails from their origins and serves them
+// as WebP at /img/{pubkey}/{d}/{size}. Files are content-addressed under
+// <dir>/<first two hex chars>/<sha256>.webp, so stations sharing a logo
+// share files; a bbolt index maps each station address to its current
+// source URL and renditions.
+type logoMirror struct {
+	dir    string
+	db     *bolt.DB
+	store  eventstore.Store
+	live   *liveConfig
+	client *http.Client
+	queue  chan logoJob
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+type logoJob struct{ addr, source string }
+
+func openLogoMirror(dir string, store eventstore.Store, live *liveConfig) (*logoMirror, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating logo directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "index.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening logo index: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(logosBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing logo index: %w", err)
+	}
+	m := &logoMirror{
+		dir:      dir,
+		db:       db,
+		store:    store,
+		live:     live,
+		queue:    make(chan logoJob, 1024),
+		inflight: make(map[string]chan struct{}),
+	}
+	m.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: m.checkDial}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+	return m, nil
+}
+
+func (m *logoMirror) Close() error { return m.db.Close() }
+
+func (m *logoMirror) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /img/{pubkey}/{d}/{size}", m.handleImage)
+}
+
+// checkDial refuses loopback, private and link-local addresses (unless
+// logos.allow_private_hosts is set), so a station's thumbnail URL can't be
+// used to probe the relay's network. It runs after DNS resolution, on every
+// connection including redirects.
+func (m *logoMirror) checkDial(network, address string, _ syscall.RawConn) error {
+	if m.live.Load().Logos.AllowPrivateHosts {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to fetch logos from %s", host)
+	}
+	return nil
+}
+
+// observe queues a fetch when a station is stored with a logo we haven't
+// mirrored yet. A full queue is not an error: the image handler fetches on
+// demand.
+func (m *logoMirror) observe(evt nostr.Event) {
+	cfg := m.live.Load().Logos
+	if evt.Kind != indexedKind || !cfg.Enabled || !cfg.FetchOnWrite {
+		return
+	}
+	st := parseStation(evt)
+	if st.Thumbnail == "" {
+		return
+	}
+	if rec, found := m.record(st.Address()); found && rec.Source == st.Thumbnail {
+		return
+	}
+	select {
+	case m.queue <- logoJob{st.Address(), st.Thumbnail}:
+	default:
+	}
+}
+
+// run fetches queued logos until ctx ends. It first removes renditions no
+// station refers to any more.
+func (m *logoMirror) run(ctx context.Context) {
+	m.sweep()
+	const workers = 2
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-m.queue:
+					m.ensure(job.addr, job.source)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *logoMirror) record(addr string) (logoRecord, bool) {
+	var rec logoRecord
+	found := false
+	m.db.View(func(tx *bolt.Tx) error {
+		if raw := tx.Bucket(logosBucket).Get([]byte(addr)); raw != nil {
+			found = json.Unmarshal(raw, &rec) == nil
+		}
+		return nil
+	})
+	return rec, found
+}
+
+// ensure returns the mirrored logo for addr, fetching source if it isn't
+// mirrored yet (or a failure has expired). Concurrent callers for the same
+// station share one fetch.
+func (m *logoMirror) ensure(addr, source string) logoRecord {
+	m.mu.Lock()
+	if wait, busy := m.inflight[addr]; busy {
+		m.mu.Unlock()
+		<-wait
+		rec, _ := m.record(addr)
+		return rec
+	}
+	rec, found := m.record(addr)
+	retryAfter := m.live.Load().Logos.RetryAfter.Duration
+	if found && rec.Source == source && (rec.Error == "" || time.Since(time.Unix(rec.FetchedAt, 0)) < retryAfter) {
+		m.mu.Unlock()
+		return rec
+	}
+	done := make(chan struct{})
+	m.inflight[addr] = done
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inflight, addr)
+		m.mu.Unlock()
+		close(done)
+	}()
+
+	rec = logoRecord{Source: source, FetchedAt: time.Now().Unix()}
+	sizes, err := m.mirror(source)
+	if err != nil {
+		rec.Error = err.Error()
+		slog.Info("failed to mirror station logo", "address", addr, "source", source, "err", err)
+	} else {
+		rec.Sizes = sizes
+		slog.Debug("mirrored station logo", "address", addr, "source", source)
+	}
+	raw, _ := json.Marshal(rec)
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(logosBucket).Put([]byte(addr), raw)
+	}); err != nil {
+		slog.Error("failed to record station logo", "address", addr, "err", err)
+	}
+	return rec
+}
+
+// mirror downloads source and writes every rendition, returning their hashes.
+func (m *logoMirror) mirror(source string) (map[int]string, error) {
+	cfg := m.live.Load().Logos
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("logo URL is not http(s)")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.FetchTimeout.Duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "WaveFunc-Relay/1.0 (+https://wavefunc.live)")
+	req.Header.Set("Accept", "image/webp,image/png,image/jpeg,image/gif,image/*;q=0.8")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origin answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(cfg.MaxSourceSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > int(cfg.MaxSourceSize) {
+		return nil, fmt.Errorf("logo is larger than %d bytes", cfg.MaxSourceSize)
+	}
+
+	conf, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image: %w", err)
+	}
+	if conf.Width*conf.Height > maxLogoPixels {
+		return nil, fmt.Errorf("logo is %dx%d, too large to resize", conf.Width, conf.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image: %w", err)
+	}
+
+	sizes := make(map[int]string, len(logoSizes))
+	for _, size := range logoSizes {
+		data := encodeWebP(resizeLogo(src, size))
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if err := m.writeFile(hash, data); err != nil {
+			return nil, err
+		}
+		sizes[size] = hash
+	}
+	return sizes, nil
+}
+
+// resizeLogo fits src into a size x size square, centered on transparency.
+func resizeLogo(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, size*b.Dy()/b.Dx())
+	} else if b.Dy() > b.Dx() {
+		w = max(1, size*b.Dx()/b.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	at := image.Pt((size-w)/2, (size-h)/2)
+	xdraw.CatmullRom.Scale(dst, image.Rectangle{Min: at, Max: at.Add(image.Pt(w, h))}, src, b, xdraw.Src, nil)
+	return dst
+}
+
+func (m *logoMirror) path(hash string) string {
+	return filepath.Join(m.dir, hash[:2], hash+".webp")
+}
+
+func (m *logoMirror) writeFile(hash string, data []byte) error {
+	path := m.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sweep deletes renditions that no station's record refers to, e.g. after a
+// station changed its logo. Files younger than an hour are left alone in
+// case a fetch is writing them right now.
+func (m *logoMirror) sweep() {
+	live := make(map[string]bool)
+	m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(logosBucket).ForEach(func(_, v []byte) error {
+			var rec logoRecord
+			if json.Unmarshal(v, &rec) == nil {
+				for _, hash := range rec.Sizes {
+					live[hash] = true
+				}
+			}
+			return nil
+		})
+	})
+	removed := 0
+	filepath.WalkDir(m.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".webp") {
+			return nil
+		}
+		if live[strings.TrimSuffix(d.Name(), ".webp")] {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > time.Hour {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	if removed > 0 {
+		slog.Info("removed unused logo renditions", "files", removed)
+	}
+}
+
+// handleImage is GET /img/{pubkey}/{d}/{size}, size being 64, 192 or 512
+// (optionally with .webp). The URL is stable across logo changes; the ETag
+// is the rendition's hash, and a ?v= matching a prefix of it marks the
+// response immutable.
+func (m *logoMirror) handleImage(w http.ResponseWriter, r *http.Request) {
+	cfg := m.live.Load().Logos
+	if !cfg.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("size"), ".webp"))
+	if err != nil || !slices.Contains(logoSizes, size) {
+		writeJSONError(w, http.StatusNotFound, "size must be 64, 192 or 512")
+		return
+	}
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	evt, found := fetchAddress(m.store, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+	st := parseStation(evt)
+	if st.Thumbnail == "" {
+		writeJSONError(w, http.StatusNotFound, "station has no logo")
+		return
+	}
+
+	// an on-demand fetch can outlast the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(cfg.FetchTimeout.Duration + 5*time.Second))
+	rec := m.ensure(st.Address(), st.Thumbnail)
+	hash, ok := rec.Sizes[size]
+	if !ok {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSONError(w, http.StatusNotFound, "logo unavailable: "+rec.Error)
+		return
+	}
+	f, err := os.Open(m.path(hash))
+	if err != nil {
+		slog.Error("logo rendition missing", "address", st.Address(), "hash", hash, "err", err)
+		writeJSONError(w, http.StatusNotFound, "logo unavailable")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "image/webp")
+	if v := r.URL.Query().Get("v"); len(v) >= 8 && strings.HasPrefix(hash, v) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("ETag", strconv.Quote(hash))
+	http.ServeContent(w, r, "", time.Unix(rec.FetchedAt, 0), f)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// logoOrigin serves a 300x150 PNG at /logo.png, a redirect to it at
+// /redirect, plain text at /text and a 404 everywhere else, counting
+// requests per path.
+func logoOrigin(t *testing.T) (*httptest.Server, *sync.Map) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 150))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	var hits sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hits.LoadOrStore(r.URL.Path, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		switch r.URL.Path {
+		case "/logo.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+		case "/text":
+			w.Write([]byte("not an image"))
+		case "/redirect":
+			http.Redirect(w, r, "/logo.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func originHits(hits *sync.Map, path string) int32 {
+	if n, ok := hits.Load(path); ok {
+		return n.(*atomic.Int32).Load()
+	}
+	return 0
+}
+
+func newTestLogoMirror(t *testing.T, cfg LogosConfig) *logoMirror {
+	t.Helper()
+	full := defaultConfig()
+	full.Logos = cfg
+	m, err := openLogoMirror(t.TempDir(), nil, newLiveConfig("", full, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestLogoMirror(t *testing.T) {
+	srv, hits := logoOrigin(t)
+	// the test origin is on localhost, so most cases allow private hosts
+	timeout := Duration{5 * time.Second}
+	tests := []struct {
+		name    string
+		path    string
+		cfg     LogosConfig
+		wantErr string
+	}{
+		{name: "png", path: "/logo.png", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 5 << 20, AllowPrivateHosts: true}},
+		{name: "redirect", path: "/redirect", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 5 << 20, AllowPrivateHosts: true}},
+		{name: "missing", path: "/gone.png", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 5 << 20, AllowPrivateHosts: true}, wantErr: "404"},
+		{name: "not an image", path: "/text", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 5 << 20, AllowPrivateHosts: true}, wantErr: "unsupported image"},
+		{name: "too large", path: "/logo.png", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 100, AllowPrivateHosts: true}, wantErr: "larger than 100 bytes"},
+		{name: "private origin", path: "/logo.png", cfg: LogosConfig{Enabled: true, FetchTimeout: timeout, MaxSourceSize: 5 << 20}, wantErr: "refusing to fetch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestLogoMirror(t, tt.cfg)
+			rec := m.ensure("31237:pk:"+tt.name, srv.URL+tt.path)
+			if tt.wantErr != "" {
+				if !strings.Contains(rec.Error, tt.wantErr) || len(rec.Sizes) != 0 {
+					t.Fatalf("record = %+v, want error containing %q", rec, tt.wantErr)
+				}
+				return
+			}
+			if rec.Error != "" {
+				t.Fatalf("unexpected error: %s", rec.Error)
+			}
+			for _, size := range logoSizes {
+				f, err := os.Open(m.path(rec.Sizes[size]))
+				if err != nil {
+					t.Fatalf("size %d: %v", size, err)
+				}
+				img, err := webp.Decode(f)
+				f.Close()
+				if err != nil {
+					t.Fatalf("size %d: %v", size, err)
+				}
+				if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+					t.Errorf("size %d: rendition is %dx%d", size, b.Dx(), b.Dy())
+				}
+				// 2:1 logo, letterboxed on transparency
+				if _, _, _, a := img.At(size/2, 0).RGBA(); a != 0 {
+					t.Errorf("size %d: top edge is not transparent", size)
+				}
+				if _, _, _, a := img.At(size/2, size/2).RGBA(); a == 0 {
+					t.Errorf("size %d: centre is transparent", size)
+				}
+			}
+		})
+	}
+	if n := originHits(hits, "/gone.png"); n != 1 {
+		t.Errorf("origin was asked for /gone.png %d times, want 1", n)
+	}
+}
+
+func TestLogoMirrorEnsure(t *testing.T) {
+	srv, hits := logoOrigin(t)
+	m := newTestLogoMirror(t, LogosConfig{
+		Enabled:           true,
+		FetchTimeout:      Duration{5 * time.Second},
+		MaxSourceSize:     5 << 20,
+		RetryAfter:        Duration{time.Hour},
+		AllowPrivateHosts: true,
+	})
+
+	// concurrent requests for one station share a fetch
+	var wg sync.WaitGroup
+	recs := make([]logoRecord, 8)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = m.ensure("31237:pk:a", srv.URL+"/logo.png")
+		}()
+	}
+	wg.Wait()
+	for _, rec := range recs {
+		if rec.Error != "" || rec.Sizes[64] != recs[0].Sizes[64] {
+			t.Fatalf("records differ: %+v", recs)
+		}
+	}
+	if n := originHits(hits, "/logo.png"); n != 1 {
+		t.Errorf("origin fetched %d times, want 1", n)
+	}
+
+	// a mirrored logo isn't fetched again; a second station with the same
+	// logo gets the same files
+	m.ensure("31237:pk:a", srv.URL+"/logo.png")
+	if rec := m.ensure("31237:pk:b", srv.URL+"/logo.png"); rec.Sizes[192] != recs[0].Sizes[192] {
+		t.Errorf("same logo, different renditions: %v and %v", rec.Sizes, recs[0].Sizes)
+	}
+	if n := originHits(hits, "/logo.png"); n != 2 {
+		t.Errorf("origin fetched %d times, want 2", n)
+	}
+
+	// failures are remembered for retry_after, unless the source changes
+	m.ensure("31237:pk:c", srv.URL+"/gone.png")
+	m.ensure("31237:pk:c", srv.URL+"/gone.png")
+	if n := originHits(hits, "/gone.png"); n != 1 {
+		t.Errorf("failed origin fetched %d times, want 1", n)
+	}
+	if rec := m.ensure("31237:pk:c", srv.URL+"/logo.png"); rec.Error != "" || rec.Source != srv.URL+"/logo.png" {
+		t.Errorf("changed source: %+v", rec)
+	}
+}
+
+func TestLogoMirrorRejectsNonHTTP(t *testing.T) {
+	m := newTestLogoMirror(t, LogosConfig{Enabled: true, FetchTimeout: Duration{5 * time.Second}, MaxSourceSize: 5 << 20})
+	for _, source := range []string{"file:///etc/passwd", "data:image/png;base64,AAAA", "//example.com/logo.png", "not a url"} {
+		if rec := m.ensure("31237:pk:x", source); !strings.Contains(rec.Error, "not http(s)") {
+			t.Errorf("%q: record = %+v", source, rec)
+		}
+	}
+}
+
+func TestResizeLogo(t *testing.T) {
+	tests := []struct {
+		w, h      int
+		inside    image.Point
+		outside   image.Point
+		hasBorder bool
+	}{
+		{w: 100, h: 100, inside: image.Pt(0, 0)},
+		{w: 200, h: 100, inside: image.Pt(32, 32), outside: image.Pt(32, 2), hasBorder: true},
+		{w: 100, h: 200, inside: image.Pt(32, 32), outside: image.Pt(2, 32), hasBorder: true},
+		{w: 1000, h: 1, inside: image.Pt(32, 31), outside: image.Pt(32, 10), hasBorder: true},
+	}
+	for _, tt := range tests {
+		src := image.NewUniform(color.White)
+		img := resizeLogo(&boundedImage{src, image.Rect(0, 0, tt.w, tt.h)}, 64)
+		if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 64 {
+			t.Errorf("%dx%d: resized to %v", tt.w, tt.h, b)
+		}
+		if img.RGBAAt(tt.inside.X, tt.inside.Y).A == 0 {
+			t.Errorf("%dx%d: %v is transparent", tt.w, tt.h, tt.inside)
+		}
+		if tt.hasBorder && img.RGBAAt(tt.outside.X, tt.outside.Y).A != 0 {
+			t.Errorf("%dx%d: %v is not transparent", tt.w, tt.h, tt.outside)
+		}
+	}
+}
+
+// boundedImage gives an image.Uniform finite bounds.
+type boundedImage struct {
+	*image.Uniform
+	bounds image.Rectangle
+}
+
+func (b *boundedImage) Bounds() image.Rectangle { return b.bounds }
@@ -2,35 +2,82 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"iter"
-	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	bleve "github.com/blevesearch/bleve/v2"
+	keywordAnalyzer "github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
 	bleveMapping "github.com/blevesearch/bleve/v2/mapping"
+	bleveSearch "github.com/blevesearch/bleve/v2/search"
 	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+	"github.com/rs/cors"
 
 	"fiatjaf.com/nostr"
 	"fiatjaf.com/nostr/eventstore"
 	"fiatjaf.com/nostr/eventstore/lmdb"
 	"fiatjaf.com/nostr/khatru"
-	"fiatjaf.com/nostr/nip11"
+	"fiatjaf.com/nostr/nip45/hyperloglog"
 )
 
 var (
-	port       = flag.String("port", "3334", "Port to listen on")
-	dbPath     = flag.String("db-path", "./data/events", "Path to LMDB database directory")
-	searchPath = flag.String("search-path", "./data/search", "Path to bleve search index")
-	resetDB    = flag.Bool("reset-db", false, "Reset the database")
-	resetIndex = flag.Bool("reset-index", false, "Reset the search index")
-	resetAll   = flag.Bool("reset-all", false, "Reset both database and index")
-	reindex    = flag.Bool("reindex", false, "Rebuild search index from existing LMDB data then exit")
+	configPath  = flag.String("config", os.Getenv("RELAY_CONFIG"), "Path to TOML config file (env: RELAY_CONFIG)")
+	checkConfig = flag.Bool("check-config", false, "Validate the configuration, print it and exit")
+	host        = flag.String("host", "0.0.0.0", "Address to listen on")
+	port        = flag.Int("port", 3334, "Port to listen on")
+	dbPath      = flag.String("db-path", "./data/events", "Path to LMDB database directory")
+	searchPath  = flag.String("search-path", "./data/search", "Path to bleve search index")
+	resetDB     = flag.Bool("reset-db", false, "Reset the database")
+	resetIndex  = flag.Bool("reset-index", false, "Reset the search index")
+	resetAll    = flag.Bool("reset-all", false, "Reset both database and index")
+	reindex     = flag.Bool("reindex", false, "Rebuild search index from existing LMDB data then exit")
+	importNIP05 = flag.String("import-nip05", "", "Register the names in a NIP-05 nostr.json file, signed by the relay key, then exit")
+
+	logFormat      = flag.String("log-format", "text", "Log output format: text or json")
+	logLevel       = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	querySample    = flag.Float64("query-log-sample", 1.0, "Fraction of REQs to log (0..1); slow queries are always logged")
+	slowQueryAfter = flag.Duration("slow-query", 500*time.Millisecond, "Always log queries slower than this (0 disables)")
 )
 
+// applyFlags overlays only the flags that were set explicitly on the command
+// line, so flag defaults never clobber values from the config file or env.
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.Listen.Host = *host
+		case "port":
+			cfg.Listen.Port = *port
+		case "db-path":
+			cfg.Storage.DBPath = *dbPath
+		case "search-path":
+			cfg.Storage.SearchPath = *searchPath
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "query-log-sample":
+			cfg.Log.QuerySample = *querySample
+		case "slow-query":
+			cfg.Log.SlowQuery = Duration{*slowQueryAfter}
+		}
+	})
+}
+
 // stationSearch is a custom bleve search index with:
 //   - Station-aware indexing: indexes "name description" as searchable content
 //   - Prefix+match querying: "enall" matches "Enallax Radio"
@@ -38,6 +85,56 @@ type stationSearch struct {
 	path     string
 	rawStore eventstore.Store
 	index    bleve.Index
+
+	// storedSchema is the searchSchemaVersion the open index was built with.
+	storedSchema int
+}
+
+// searchSchemaVersion is bumped whenever newStationIndexMapping or
+// buildSearchDoc change in a way that needs existing docs rebuilt. The
+// version an index was built with lives in bleve's internal storage; an
+// older index keeps serving but /readyz reports it until `--reindex` runs.
+//
+//	1: keyword-analysed "country"/"lang"/"p", phrase-searchable "genre"
+//	2: "name", "name_sort", "tag", "codec", "bitrate" and "uuid" for the
+//	   Radio Browser facade
+//	3: "c" split into "description" and "location" so each field can be
+//	   weighted (see searchFieldBoosts)
+//	4: canonical genres added to "genre", and "genre_path" for the genre
+//	   taxonomy (see genreTaxonomy)
+//	5: "stream", so similar stations can leave out ones playing the same
+//	   stream
+//	6: "stream" holds normalised stream keys (see streamKey), for
+//	   duplicate detection
+//	7: "stream_host", for finding stations by stream host
+//	8: stream keys keep the query string, less per-listener tokens
+const searchSchemaVersion = 8
+
+var schemaVersionKey = []byte("wavefunc_schema_version")
+
+// newStationIndexMapping keeps bleve's dynamic default mapping (standard
+// analyzer) for free text, but indexes codes verbatim: the standard analyzer
+// drops English stop words, which would silently lose countries like "IT"
+// and "IN".
+func newStationIndexMapping() *bleveMapping.IndexMappingImpl {
+	verbatim := bleveMapping.NewTextFieldMapping()
+	verbatim.Analyzer = keywordAnalyzer.Name
+
+	doc := bleveMapping.NewDocumentMapping()
+	doc.AddFieldMappingsAt("p", verbatim)
+	doc.AddFieldMappingsAt("country", verbatim)
+	doc.AddFieldMappingsAt("lang", verbatim)
+	doc.AddFieldMappingsAt("name_sort", verbatim)
+	doc.AddFieldMappingsAt("tag", verbatim)
+	doc.AddFieldMappingsAt("codec", verbatim)
+	doc.AddFieldMappingsAt("uuid", verbatim)
+	doc.AddFieldMappingsAt("genre_path", verbatim)
+	doc.AddFieldMappingsAt("stream", verbatim)
+	doc.AddFieldMappingsAt("stream_host", verbatim)
+
+	im := bleveMapping.NewIndexMapping()
+	im.DefaultMapping = doc
+	return im
 }
 
 func newStationSearch(path string, rawStore eventstore.Store) *stationSearch {
@@ -48,8 +145,7 @@ func (s *stationSearch) Init() error {
 	idx, err := bleve.Open(s.path)
 	if err == bleve.ErrorIndexPathDoesNotExist {
 		// Fresh start: directory doesn't exist yet
-		mapping := bleveMapping.NewIndexMapping()
-		idx, err = bleve.New(s.path, mapping)
+		idx, err = bleve.New(s.path, newStationIndexMapping())
 		if err != nil {
 			return fmt.Errorf("error creating bleve index: %w", err)
 		}
@@ -57,25 +153,64 @@ func (s *stationSearch) Init() error {
 		// Index is corrupted or in an incompatible format (e.g. old bluge data).
 		// Wipe and recreate rather than crashing — stations will be re-indexed
 		// on the next migration run.
-		log.Printf("⚠️  Search index unreadable (%v), recreating from scratch...", err)
+		slog.Warn("search index unreadable, recreating it from scratch", "path", s.path, "err", err)
 		if removeErr := os.RemoveAll(s.path); removeErr != nil {
 			return fmt.Errorf("could not remove bad search index: %w", removeErr)
 		}
-		mapping := bleveMapping.NewIndexMapping()
-		idx, err = bleve.New(s.path, mapping)
+		idx, err = bleve.New(s.path, newStationIndexMapping())
 		if err != nil {
 			return fmt.Errorf("error creating bleve index after reset: %w", err)
 		}
-		log.Println("✅ Fresh search index created — run migration to re-populate")
+		slog.Info("fresh search index created; run --reindex to populate it")
 	}
 	s.index = idx
+
+	raw, err := idx.GetInternal(schemaVersionKey)
+	if err != nil {
+		return fmt.Errorf("error reading search index schema version: %w", err)
+	}
+	if raw == nil {
+		if count, _ := idx.DocCount(); count == 0 {
+			// brand-new (or emptied) index: it was just created with the
+			// current mapping.
+			return s.markSchemaCurrent()
+		}
+		s.storedSchema = 0
+	} else {
+		s.storedSchema, _ = strconv.Atoi(string(raw))
+	}
+	if s.storedSchema < searchSchemaVersion {
+		slog.Warn("search index was built with an older schema; run --reindex to rebuild it",
+			"index_schema", s.storedSchema, "current_schema", searchSchemaVersion)
+	}
+	return nil
+}
+
+// markSchemaCurrent records that every doc in the index was built by the
+// current buildSearchDoc/mapping. Called for fresh indexes and at the end of
+// --reindex.
+func (s *stationSearch) markSchemaCurrent() error {
+	if err := s.index.SetInternal(schemaVersionKey, []byte(strconv.Itoa(searchSchemaVersion))); err != nil {
+		return fmt.Errorf("error writing search index schema version: %w", err)
+	}
+	s.storedSchema = searchSchemaVersion
 	return nil
 }
 
+func (s *stationSearch) schemaOutdated() bool {
+	return s.storedSchema < searchSchemaVersion
+}
+
+// Close persists scorch's in-memory segments and releases the index. It is
+// safe to call more than once.
 func (s *stationSearch) Close() {
-	if s.index != nil {
-		s.index.Close()
+	if s.index == nil {
+		return
 	}
+	if err := s.index.Close(); err != nil {
+		slog.Error("failed to close bleve index cleanly", "err", err)
+	}
+	s.index = nil
 }
 
 // indexedKind is the only event kind whose content we search via NIP-50.
@@ -86,38 +221,85 @@ const indexedKind = nostr.Kind(31237)
 
 // buildSearchDoc produces the bleve document for a kind-31237 (radio station)
 // event. Doc fields:
-//   - "c": searchable text content — name + description + genre tag values
+//   - "name": the station name, the most heavily weighted text field
+//   - "genre": genre tag values and their canonical genres, searched as
+//     text and for phrase-matched genre filtering
+//   - "genre_path": the canonical genres and all their ancestors, verbatim,
+//     so a filter on "electronic" finds stations tagged "deep house"
+//   - "location": the location tag, free text
+//   - "description": the description from the content JSON
+//   - "country": upper-cased countryCode tag, verbatim
+//   - "lang": language tag values, verbatim
+//   - "name_sort": lower-cased name, verbatim, for exact matches and sorting
+//   - "tag": lower-cased genre tag values, verbatim, for exact tag matches
+//     and tag facets
+//   - "codec", "bitrate": the primary stream's codec (upper-cased) and bitrate
+//   - "stream": the normalised key of every stream URL (see streamKey),
+//     verbatim, so stations playing the same broadcast can be found
+//   - "stream_host": the normalised host of every stream URL, without port
+//   - "uuid": the station's Radio Browser UUID (see rbStationUUID)
 //   - "p": author pubkey (hex), for optional author filtering
 //   - "t": created_at as a float64, for optional since/until range filtering
 //
 // We no longer need a "k" field since only one kind is ever indexed.
 func buildSearchDoc(evt nostr.Event) map[string]any {
-	name := ""
-	if tag := evt.Tags.Find("name"); tag != nil {
-		name = tag[1]
+	st := parseStation(evt)
+	doc := map[string]any{
+		"p": evt.PubKey.Hex(),
+		"t": float64(evt.CreatedAt),
+	}
+	if st.Name != "" {
+		doc["name"] = st.Name
+		doc["name_sort"] = strings.ToLower(st.Name)
 	}
-	var parsed struct {
-		Description string `json:"description"`
+	if st.Description != "" {
+		doc["description"] = st.Description
 	}
-	description := ""
-	if err := json.Unmarshal([]byte(evt.Content), &parsed); err == nil {
-		description = parsed.Description
+	if st.Location != "" {
+		doc["location"] = st.Location
 	}
-	// Include genre tag values so searches like "ambient" or "drone" match
-	// stations where those words appear only in the "c" genre tags.
-	var genreParts []string
-	for tag := range evt.Tags.FindAll("c") {
-		if len(tag) >= 2 {
-			genreParts = append(genreParts, tag[1])
+	if len(st.Genres) > 0 {
+		paths, canonical := taxonomy().expand(st.Genres)
+		genres := slices.Clone(st.Genres)
+		for _, c := range canonical {
+			if !slices.ContainsFunc(genres, func(g string) bool { return strings.EqualFold(g, c) }) {
+				genres = append(genres, c)
+			}
+		}
+		doc["genre"] = genres
+		if len(paths) > 0 {
+			doc["genre_path"] = paths
 		}
+		tags := make([]string, len(st.Genres))
+		for i, g := range st.Genres {
+			tags[i] = strings.ToLower(g)
+		}
+		doc["tag"] = tags
 	}
-	content := strings.TrimSpace(name + " " + description + " " + strings.Join(genreParts, " "))
-
-	return map[string]any{
-		"c": content,
-		"p": evt.PubKey.Hex(),
-		"t": float64(evt.CreatedAt),
+	if stream, ok := st.primaryStream(); ok {
+		if codec := stream.codec(); codec != "" {
+			doc["codec"] = codec
+		}
+		if stream.Quality.Bitrate > 0 {
+			doc["bitrate"] = float64(stream.Quality.Bitrate)
+		}
+	}
+	if streams := stationStreamKeys(st); len(streams) > 0 {
+		doc["stream"] = streams
+		doc["stream_host"] = stationStreamHosts(st)
+	}
+	doc["uuid"] = rbStationUUID(st.Address())
+	if st.CountryCode != "" {
+		doc["country"] = st.CountryCode
+	}
+	if len(st.Languages) > 0 {
+		langs := make([]string, len(st.Languages))
+		for i, l := range st.Languages {
+			langs[i] = strings.ToLower(l)
+		}
+		doc["lang"] = langs
 	}
+	return doc
 }
 
 // SaveEvent only indexes radio stations (kind 31237). All other kinds stay in
@@ -204,95 +386,228 @@ func isStationOnlyCountFilter(f nostr.Filter) bool {
 	return true
 }
 
-// QueryEvents searches the index. For each whitespace-separated term it builds
-// a (MatchQuery OR PrefixQuery) so that partial words like "enall" match
-// "enallax". All terms must match (AND between terms). The index only ever
-// holds kind-31237 events, so we don't need a kind conjunct — but we still
-// honor Authors and Since/Until from the nostr filter.
-//
-// If the caller's filter has Kinds set and *doesn't* include 31237, we early-
-// return: the search index has nothing for them.
-func (s *stationSearch) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
-	return func(yield func(nostr.Event) bool) {
-		terms := strings.Fields(strings.ToLower(strings.TrimSpace(filter.Search)))
-		if len(terms) == 0 {
-			return
-		}
+// stationQuery is a structured station search. The NIP-50 path builds one
+// from a nostr filter; the HTTP API builds one from query parameters.
+type stationQuery struct {
+	Text      string
+	Name      string
+	NameExact bool
+	Genres    []string
+	Tags      []string
+	Countries []string
+	Languages []string
+	Codecs    []string
+	UUIDs     []string
+	Streams   []string // stream URLs or hosts, see streamQuery
+	Authors   []nostr.PubKey
+	Since     nostr.Timestamp
+	Until     nostr.Timestamp
+
+	MinBitrate int
+	MaxBitrate int
+
+	// Collapse keeps only the best hit of each duplicate cluster (see
+	// collapseHits). Totals still count every match.
+	Collapse bool
+
+	// Similar ranks stations by how much they have in common with one
+	// station, set from a similar: extension by resolveSimilar or directly
+	// by the similar-stations endpoint.
+	Similar *similarProfile
+
+	// Sort is a bleve sort order (e.g. "name_sort", "-t"). Empty means by
+	// score, or newest first when there is no text to score.
+	Sort []string
+}
 
-		// the search index is station-only. if the caller restricted to kinds
-		// that don't include 31237, there's nothing to return.
-		if len(filter.Kinds) > 0 {
-			wantsStations := false
-			for _, k := range filter.Kinds {
-				if k == indexedKind {
-					wantsStations = true
-					break
-				}
+// compile turns q into a bleve query. Text is parsed with the search
+// grammar in searchquery.go (phrases, OR, negation, field:term), where a
+// bare word is a (MatchQuery OR PrefixQuery) so that partial words like
+// "enall" match "enallax"; text that doesn't parse falls back to ANDing
+// every whitespace-separated word. Genres and Countries are each an OR of
+// their values, ANDed with the rest. When Text is plain words, stations
+// whose name is or starts with it rank first. An empty query matches every
+// station.
+func (q stationQuery) compile() bleveQuery.Query {
+	var conjuncts []bleveQuery.Query
+	if text := strings.TrimSpace(q.Text); text != "" {
+		if tq, err := compileSearchText(text); err != nil {
+			conjuncts = append(conjuncts, plainTextQueries(text)...)
+		} else if tq != nil {
+			// Unquoted "drum and bass" is three words to the grammar but
+			// one genre to the taxonomy.
+			if plain, ok := plainSearchText(text); ok {
+				tq = genreTextQuery(tq, plain, genreBoost)
 			}
-			if !wantsStations {
-				return
+			conjuncts = append(conjuncts, tq)
+		}
+	}
+
+	// Name → like Text but restricted to the "name" field, or the whole
+	// lower-cased name verbatim when NameExact is set
+	if name := strings.TrimSpace(q.Name); name != "" {
+		if q.NameExact {
+			conjuncts = append(conjuncts, newKeywordTermQuery("name_sort", strings.ToLower(name)))
+		} else {
+			for _, term := range strings.Fields(strings.ToLower(name)) {
+				conjuncts = append(conjuncts, wordQuery("name", term, 1))
 			}
 		}
+	}
 
-		var conjuncts []bleveQuery.Query
-		for _, term := range terms {
-			matchQ := bleve.NewMatchQuery(term)
-			matchQ.SetField("c")
+	// Genre filter → disjunction of genreQuery: the genre and its
+	// sub-genres in any spelling the taxonomy knows, else a phrase match on
+	// "genre", so "deep house" doesn't match a station tagged "house" and
+	// "deep space".
+	if len(q.Genres) > 0 {
+		genreDisjuncts := make([]bleveQuery.Query, 0, len(q.Genres))
+		for _, g := range q.Genres {
+			genreDisjuncts = append(genreDisjuncts, genreQuery(g))
+		}
+		conjuncts = append(conjuncts, orQuery(genreDisjuncts))
+	}
 
-			prefixQ := bleve.NewPrefixQuery(term)
-			prefixQ.SetField("c")
+	// Tags → every one must be present verbatim on "tag"
+	for _, t := range q.Tags {
+		conjuncts = append(conjuncts, newKeywordTermQuery("tag", strings.ToLower(t)))
+	}
 
-			// term matches if either the word is present OR the term is a prefix of a word
-			conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(matchQ, prefixQ))
+	// Language, codec and UUID filters → disjunction of verbatim terms
+	if len(q.Languages) > 0 {
+		conjuncts = append(conjuncts, keywordAnyOf("lang", q.Languages, strings.ToLower))
+	}
+	if len(q.Codecs) > 0 {
+		conjuncts = append(conjuncts, keywordAnyOf("codec", q.Codecs, strings.ToUpper))
+	}
+	if len(q.UUIDs) > 0 {
+		conjuncts = append(conjuncts, keywordAnyOf("uuid", q.UUIDs, strings.ToLower))
+	}
+	if len(q.Streams) > 0 {
+		var disjuncts []bleveQuery.Query
+		for _, v := range q.Streams {
+			disjuncts = append(disjuncts, streamQuery(v))
 		}
+		conjuncts = append(conjuncts, orQuery(disjuncts))
+	}
 
-		// Author filter → disjunction of term queries on "p"
-		if len(filter.Authors) > 0 {
-			authorDisjuncts := make([]bleveQuery.Query, 0, len(filter.Authors))
-			for _, a := range filter.Authors {
-				authorDisjuncts = append(authorDisjuncts, newKeywordTermQuery("p", a.Hex()))
-			}
-			if len(authorDisjuncts) == 1 {
-				conjuncts = append(conjuncts, authorDisjuncts[0])
-			} else {
-				conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(authorDisjuncts...))
-			}
+	// MinBitrate/MaxBitrate → numeric range on "bitrate"
+	if q.MinBitrate > 0 || q.MaxBitrate > 0 {
+		var min, max *float64
+		inc := true
+		if q.MinBitrate > 0 {
+			v := float64(q.MinBitrate)
+			min = &v
 		}
-
-		// Since/Until → numeric range on "t"
-		if filter.Since != 0 || filter.Until != 0 {
-			var min, max *float64
-			inc := true
-			if filter.Since != 0 {
-				v := float64(filter.Since)
-				min = &v
-			}
-			if filter.Until != 0 {
-				v := float64(filter.Until)
-				max = &v
-			}
-			rq := bleve.NewNumericRangeInclusiveQuery(min, max, &inc, &inc)
-			rq.SetField("t")
-			conjuncts = append(conjuncts, rq)
+		if q.MaxBitrate > 0 {
+			v := float64(q.MaxBitrate)
+			max = &v
 		}
+		rq := bleve.NewNumericRangeInclusiveQuery(min, max, &inc, &inc)
+		rq.SetField("bitrate")
+		conjuncts = append(conjuncts, rq)
+	}
 
-		var q bleveQuery.Query
-		if len(conjuncts) == 1 {
-			q = conjuncts[0]
-		} else {
-			q = bleve.NewConjunctionQuery(conjuncts...)
+	// Country filter → disjunction of verbatim terms on "country"
+	if len(q.Countries) > 0 {
+		conjuncts = append(conjuncts, keywordAnyOf("country", q.Countries, strings.ToUpper))
+	}
+
+	// Author filter → disjunction of term queries on "p"
+	if len(q.Authors) > 0 {
+		authorDisjuncts := make([]bleveQuery.Query, 0, len(q.Authors))
+		for _, a := range q.Authors {
+			authorDisjuncts = append(authorDisjuncts, newKeywordTermQuery("p", a.Hex()))
 		}
+		conjuncts = append(conjuncts, orQuery(authorDisjuncts))
+	}
 
-		req := bleve.NewSearchRequest(q)
-		req.Size = maxLimit
+	if q.Similar != nil {
+		conjuncts = append(conjuncts, q.Similar.query())
+	}
 
-		result, err := s.index.Search(req)
-		if err != nil {
-			log.Printf("❌ [SEARCH] bleve query error: %v", err)
-			return
+	// Since/Until → numeric range on "t"
+	if q.Since != 0 || q.Until != 0 {
+		var min, max *float64
+		inc := true
+		if q.Since != 0 {
+			v := float64(q.Since)
+			min = &v
+		}
+		if q.Until != 0 {
+			v := float64(q.Until)
+			max = &v
 		}
+		rq := bleve.NewNumericRangeInclusiveQuery(min, max, &inc, &inc)
+		rq.SetField("t")
+		conjuncts = append(conjuncts, rq)
+	}
 
-		for _, hit := range result.Hits {
+	var base bleveQuery.Query
+	switch len(conjuncts) {
+	case 0:
+		return bleve.NewMatchAllQuery()
+	case 1:
+		base = conjuncts[0]
+	default:
+		base = bleve.NewConjunctionQuery(conjuncts...)
+	}
+	if name, ok := plainSearchText(q.Text); ok {
+		return boostNameMatches(base, name)
+	}
+	return base
+}
+
+func keywordAnyOf(field string, values []string, normalize func(string) string) bleveQuery.Query {
+	disjuncts := make([]bleveQuery.Query, 0, len(values))
+	for _, v := range values {
+		disjuncts = append(disjuncts, newKeywordTermQuery(field, normalize(v)))
+	}
+	return orQuery(disjuncts)
+}
+
+func orQuery(disjuncts []bleveQuery.Query) bleveQuery.Query {
+	if len(disjuncts) == 1 {
+		return disjuncts[0]
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...)
+}
+
+// Find runs q and returns the matching station events in hit order plus the
+// total number of matches. Unless q.Sort says otherwise, hits without Text
+// or Name are ordered newest first rather than by (meaningless) score.
+func (s *stationSearch) Find(q stationQuery, from, size int) ([]nostr.Event, uint64, error) {
+	req := bleve.NewSearchRequestOptions(q.compile(), size, from, false)
+	if q.Collapse {
+		// Collapsing drops hits, so read enough from the start to fill
+		// the page afterwards.
+		req.From, req.Size = 0, min((from+size)*collapseOverfetch, maxCollapseFetch)
+		req.Fields = []string{"stream"}
+	}
+	if len(q.Sort) > 0 {
+		req.SortBy(q.Sort)
+	} else if strings.TrimSpace(q.Text) == "" && strings.TrimSpace(q.Name) == "" && q.Similar == nil {
+		req.SortBy([]string{"-t"})
+	}
+	result, err := s.index.Search(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := result.Hits
+	if q.Collapse {
+		hits = collapseHits(hits)
+		hits = hits[min(from, len(hits)):min(from+size, len(hits))]
+	}
+	events := make([]nostr.Event, 0, len(hits))
+	for evt := range s.hydrate(hits) {
+		events = append(events, evt)
+	}
+	return events, result.Total, nil
+}
+
+// hydrate loads the LMDB event behind each hit, in hit order.
+func (s *stationSearch) hydrate(hits bleveSearch.DocumentMatchCollection) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		for _, hit := range hits {
 			id, err := nostr.IDFromHex(hit.ID)
 			if err != nil {
 				continue
@@ -311,58 +626,181 @@ func (s *stationSearch) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[
 	}
 }
 
+// QueryEvents answers NIP-50 REQs. The filter's search string becomes the
+// stationQuery text (see compile). The index only ever holds kind-31237
+// events, so we don't need a kind conjunct — but we still honor Authors and
+// Since/Until from the nostr filter.
+//
+// If the caller's filter has Kinds set and *doesn't* include 31237, we early-
+// return: the search index has nothing for them.
+func (s *stationSearch) QueryEvents(filter nostr.Filter, maxLimit int) iter.Seq[nostr.Event] {
+	return func(yield func(nostr.Event) bool) {
+		q, ok := searchFilterQuery(filter)
+		if !ok || !s.resolveSimilar(&q) {
+			return
+		}
+		req := bleve.NewSearchRequest(q.compile())
+		req.Size = maxLimit
+		if q.Collapse {
+			req.Size = min(maxLimit*collapseOverfetch, maxCollapseFetch)
+			req.Fields = []string{"stream"}
+		}
+
+		result, err := s.index.Search(req)
+		if err != nil {
+			slog.Error("bleve query failed", "search", filter.Search, "err", err)
+			return
+		}
+
+		hits := result.Hits
+		if q.Collapse {
+			hits = collapseHits(hits)
+			hits = hits[:min(maxLimit, len(hits))]
+		}
+		for evt := range s.hydrate(hits) {
+			if !yield(evt) {
+				return
+			}
+		}
+	}
+}
+
+// Count is the number of stations QueryEvents would find for filter with no
+// limit, taken from bleve's Total without loading any hits.
+func (s *stationSearch) Count(filter nostr.Filter) (uint64, error) {
+	q, ok := searchFilterQuery(filter)
+	if !ok || !s.resolveSimilar(&q) {
+		return 0, nil
+	}
+	result, err := s.index.Search(bleve.NewSearchRequestOptions(q.compile(), 0, 0, false))
+	if err != nil {
+		return 0, err
+	}
+	return result.Total, nil
+}
+
+// searchFilterQuery is the stationQuery for a NIP-50 filter, or false if the
+// filter has no search text or restricts to kinds other than stations.
+func searchFilterQuery(filter nostr.Filter) (stationQuery, bool) {
+	if strings.TrimSpace(filter.Search) == "" {
+		return stationQuery{}, false
+	}
+	// the search index is station-only. if the caller restricted to kinds
+	// that don't include 31237, there's nothing to return.
+	if len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, indexedKind) {
+		return stationQuery{}, false
+	}
+	return stationQuery{
+		Text:     filter.Search,
+		Authors:  filter.Authors,
+		Since:    filter.Since,
+		Until:    filter.Until,
+		Collapse: slices.Contains(searchExtensions(filter.Search, collapseExtension), "duplicates"),
+	}, true
+}
+
 func main() {
 	flag.Parse()
 
+	// exitCode is applied after all other defers (index flush, LMDB close)
+	// have run.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal("failed to load configuration", "err", err)
+	}
+	applyFlags(&cfg)
+	if err := cfg.Validate(); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	if *checkConfig {
+		if err := toml.NewEncoder(os.Stdout).Encode(cfg); err != nil {
+			fatal("failed to print configuration", "err", err)
+		}
+		return
+	}
+
+	logLevelVar := new(slog.LevelVar)
+	logger, _ := newLogger(cfg.Log.Format, logLevelVar)
+	slog.SetDefault(logger)
+	queries := newQueryLogger(logger, cfg.Log)
+
+	// live holds everything that SIGHUP / POST /admin/reload can change.
+	live := newLiveConfig(*configPath, cfg, logLevelVar, queries)
+	dbPath, searchPath, historyPath := cfg.Storage.DBPath, cfg.Storage.SearchPath, cfg.Storage.HistoryPath
+
 	if *resetAll {
 		*resetDB = true
 		*resetIndex = true
 	}
 
 	if *resetDB {
-		log.Println("⚠️  Resetting LMDB database...")
-		if err := os.RemoveAll(*dbPath); err != nil && !os.IsNotExist(err) {
-			log.Fatalf("Failed to reset database: %v", err)
+		slog.Warn("resetting LMDB database", "path", dbPath)
+		if err := os.RemoveAll(dbPath); err != nil && !os.IsNotExist(err) {
+			fatal("failed to reset database", "err", err)
 		}
-		log.Println("✅ Database reset complete")
+		if err := os.RemoveAll(historyPath); err != nil && !os.IsNotExist(err) {
+			fatal("failed to reset station history", "err", err)
+		}
+		if err := os.Remove(cfg.Storage.CountsPath); err != nil && !os.IsNotExist(err) {
+			fatal("failed to reset HLL counts", "err", err)
+		}
+		slog.Info("database reset complete")
 	}
 
 	if *resetIndex {
-		log.Println("⚠️  Resetting search index...")
-		if err := os.RemoveAll(*searchPath); err != nil && !os.IsNotExist(err) {
-			log.Fatalf("Failed to reset search index: %v", err)
+		slog.Warn("resetting search index", "path", searchPath)
+		if err := os.RemoveAll(searchPath); err != nil && !os.IsNotExist(err) {
+			fatal("failed to reset search index", "err", err)
 		}
-		log.Println("✅ Search index reset complete")
+		slog.Info("search index reset complete")
 	}
 
 	// Initialize LMDB backend
-	if err := os.MkdirAll(*dbPath, 0755); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+	if err := os.MkdirAll(dbPath, 0755); err != nil {
+		fatal("failed to create data directory", "err", err)
 	}
-	db := &lmdb.LMDBBackend{Path: *dbPath}
+	db := &lmdb.LMDBBackend{Path: dbPath}
 	if err := db.Init(); err != nil {
-		log.Fatalf("Failed to initialize LMDB: %v", err)
+		fatal("failed to initialize LMDB", "err", err)
 	}
 	defer db.Close()
 
+	// Superseded station versions. The main LMDB keeps only the latest event
+	// per address, so ReplaceEvent copies the outgoing one here first.
+	if err := os.MkdirAll(historyPath, 0755); err != nil {
+		fatal("failed to create history directory", "err", err)
+	}
+	history := &lmdb.LMDBBackend{Path: historyPath}
+	if err := history.Init(); err != nil {
+		fatal("failed to initialize station history", "err", err)
+	}
+	defer history.Close()
+
 	// --reindex: clear bleve index so Init() starts fresh, then populate from LMDB
 	if *reindex {
-		log.Println("⚠️  Clearing search index for rebuild...")
-		if err := os.RemoveAll(*searchPath); err != nil && !os.IsNotExist(err) {
-			log.Fatalf("Failed to clear search index: %v", err)
+		slog.Warn("clearing search index for rebuild", "path", searchPath)
+		if err := os.RemoveAll(searchPath); err != nil && !os.IsNotExist(err) {
+			fatal("failed to clear search index", "err", err)
 		}
 	}
 
 	// Initialize custom station search index
 	// Note: do NOT pre-create the search directory — bleve creates it on first run
 	// and errors if it finds an existing empty directory without its metadata files.
-	search := newStationSearch(*searchPath, db)
+	search := newStationSearch(searchPath, db)
 	if err := search.Init(); err != nil {
-		log.Fatalf("Failed to initialize search index: %v", err)
+		fatal("failed to initialize search index", "err", err)
 	}
 
 	if *reindex {
-		log.Println("🔄 Reindexing all events from LMDB...")
+		slog.Info("reindexing all stations from LMDB")
 		// 500-doc batches keep scorch segment writes under a megabyte-ish.
 		// Larger batches have triggered internal "invalid address" errors
 		// mid-scorch-flush on ~50k-event re-indexes; smaller + fall-back
@@ -386,14 +824,14 @@ func main() {
 				batchDocs = batchDocs[:0]
 				return
 			} else {
-				log.Printf("⚠️  bleve batch flush failed at count=%d: %v — retrying per-doc", count, err)
+				slog.Warn("bleve batch flush failed, retrying per document", "count", count, "err", err)
 			}
 			// Per-doc retry so a single bad document doesn't stall the rebuild.
 			for i := range batchIDs {
 				if err := search.index.Index(batchIDs[i], batchDocs[i]); err != nil {
 					failed++
 					if failed < 10 {
-						log.Printf("   ✗ skip %s: %v", batchIDs[i][:16], err)
+						slog.Warn("skipping station that failed to index", "id", batchIDs[i], "err", err)
 					}
 				}
 			}
@@ -410,7 +848,7 @@ func main() {
 			id := evt.ID.Hex()
 			doc := buildSearchDoc(evt)
 			if err := batch.Index(id, doc); err != nil {
-				log.Printf("⚠️  Failed to add %s to batch: %v", id[:8], err)
+				slog.Warn("failed to add station to batch", "id", id, "err", err)
 				failed++
 				return
 			}
@@ -420,7 +858,7 @@ func main() {
 			seen[id] = struct{}{}
 			if batch.Size() >= batchSize {
 				commit()
-				log.Printf("   Indexed %d stations (failed so far: %d)", count, failed)
+				slog.Info("reindex progress", "indexed", count, "failed", failed)
 			}
 		}
 
@@ -434,7 +872,7 @@ func main() {
 		// events the kind-index iterator missed when many stations share the
 		// same created_at second (which happens after a bulk migration). Any
 		// ID not seen in pass 1 gets indexed here.
-		log.Println("🔎 Verification pass: paginated rescan for missed IDs...")
+		slog.Info("verification pass: paginated rescan for missed stations")
 		recovered := 0
 		until := uint32(4294967295)
 		for {
@@ -466,77 +904,190 @@ func main() {
 		}
 		commit()
 		if recovered > 0 {
-			log.Printf("🩹 Recovered %d stations the kind-index iterator missed", recovered)
+			slog.Info("recovered stations the kind-index iterator missed", "recovered", recovered)
 		}
 
-		log.Printf("✅ Reindex complete: %d stations indexed, %d skipped", count-failed, failed)
+		slog.Info("reindex complete", "indexed", count-failed, "skipped", failed)
+		if err := search.markSchemaCurrent(); err != nil {
+			slog.Warn("failed to record search schema version", "err", err)
+		}
 		// Close explicitly so scorch persists its last segments before we exit.
 		if err := search.index.Close(); err != nil {
-			log.Printf("⚠️  failed to close bleve index cleanly: %v", err)
+			slog.Warn("failed to close bleve index cleanly", "err", err)
 		}
 		return
 	}
 	defer search.Close()
 
+	// The relay's own key signs the events it publishes itself.
+	relayKey, err := loadRelayKey(cfg.Storage.KeyPath)
+	if err != nil {
+		fatal("failed to load relay key", "err", err)
+	}
+
 	// Initialize relay
 	relay := khatru.NewRelay()
-	relayPubKey := nostr.MustPubKeyFromHex("96c727f4d1ea18a80d03621520ebfe3c9be1387033009a4f5b65959d09222eec")
-	relay.Info = &nip11.RelayInformationDocument{
-		Name:          "WaveFunc Radio Relay",
-		Description:   "A Nostr relay for internet radio stations with full-text search",
-		PubKey:        &relayPubKey,
-		Icon:          "https://wavefunc.live/icons/logo.png",
-		Contact:       "https://github.com/schlaus/wavefunc-rewrite",
-		SupportedNIPs: []any{1, 9, 11, 12, 15, 16, 20, 22, 33, 40, 45, 50},
-	}
+	// NIP-11 is served from the live config by live.serveNIP11; relay.Info
+	// only holds the startup snapshot for khatru's internal use.
+	relay.Info = cfg.relayInfo()
 
 	// Wire up LMDB as primary storage (also starts expiration manager)
-	relay.UseEventstore(db, 1000)
+	relay.UseEventstore(db, cfg.Limits.MaxQueryLimit)
+
+	// life tracks in-flight writes and open subscriptions for graceful
+	// shutdown; every storage override below brackets its work with
+	// beginWrite/endWrite so SIGTERM can wait for it.
+	life := newLifecycle()
+	relay.OnRequest = life.trackSubscription
+	relay.OnDisconnect = life.forgetConnection
+
+	// Reject events that fail the configured policy before they reach storage.
+	// The policy is looked up per event so reloads apply immediately.
+	nip05 := newNIP05Registry(db, live, relayKey)
+	// A revoked admin's names stop resolving at the reload that drops them.
+	live.adminsChanged = nip05.Load
+
+	// NIP-45 HyperLogLog registers for reactions, favorites and zaps,
+	// built from LMDB in the background the first time.
+	if err := os.MkdirAll(filepath.Dir(cfg.Storage.CountsPath), 0755); err != nil {
+		fatal("failed to create counts directory", "err", err)
+	}
+	counts, err := openHLLCounts(cfg.Storage.CountsPath)
+	if err != nil {
+		fatal("failed to open HLL counts", "err", err)
+	}
+	defer counts.Close()
+
+	// Typeahead over station names and genres, ranked by favorites.
+	suggest := newSuggester(db, counts)
+
+	// "Also favourited" and per-user recommendations from favorites lists,
+	// built from LMDB in the background.
+	favorites := newFavoritesModel(db)
+
+	// Trending stations from recent reactions, zaps, favourites and
+	// comments, published as relay-signed rankings.
+	trending := newTrendingEngine(db, live, relayKey)
+
+	// Mirrored, resized station logos.
+	logos, err := openLogoMirror(cfg.Storage.LogosPath, db, live)
+	if err != nil {
+		fatal("failed to open logo mirror", "err", err)
+	}
+	defer logos.Close()
+
+	relay.OnEvent = func(ctx context.Context, event nostr.Event) (bool, string) {
+		if life.isClosing() {
+			return true, "error: " + errShuttingDown.Error()
+		}
+		if reject, msg := live.Policy().rejectEvent(ctx, event); reject {
+			return reject, msg
+		}
+		return nip05.rejectEvent(event)
+	}
+
+	// COUNT results by filter, dropped by the writes below that change them.
+	countCache := newCountCache()
+
+	// Duplicate stations: new ones are reported as they are written, and
+	// /api/duplicates is recomputed in the background.
+	duplicates := newDuplicateReport(db, search)
+
+	// Health checks and /stats, whose event counts the writes below keep
+	// current.
+	health := newRelayHealth(db, search, duplicates, life, live)
 
 	// Override StoreEvent to also index in bleve
 	baseStore := relay.StoreEvent
 	relay.StoreEvent = func(ctx context.Context, event nostr.Event) error {
-		logIncomingEvent(event)
+		if !life.beginWrite() {
+			return errShuttingDown
+		}
+		defer life.endWrite()
+		logIncomingEvent(ctx, event)
 		if err := baseStore(ctx, event); err != nil {
 			return err
 		}
-		return search.SaveEvent(event)
+		health.observe(event.Kind, 1)
+		if err := counts.observe(event); err != nil {
+			slog.Warn("failed to update HLL counts", "id", event.ID.Hex(), "err", err)
+		}
+		countCache.invalidate(event)
+		suggest.observe(event)
+		favorites.observe(event)
+		trending.observe(event)
+		if err := search.SaveEvent(event); err != nil {
+			return err
+		}
+		duplicates.observe(event)
+		return nil
 	}
 
-	// Override ReplaceEvent to also update bleve index. For station events we
-	// capture the prior LMDB-resident event ID for this {pubkey, d} coordinate
-	// *before* baseReplace runs (because baseReplace evicts the prior event
-	// from LMDB), then hand it to search.ReplaceEvent so it can drop exactly
-	// that one stale bleve doc. No broad sweep, no LMDB-miss-deletes.
+	// Override ReplaceEvent to also update bleve index. We capture the prior
+	// LMDB-resident event for this coordinate *before* baseReplace runs
+	// (because baseReplace evicts it from LMDB). For stations its ID goes to
+	// search.ReplaceEvent so it can drop exactly that one stale bleve doc. No
+	// broad sweep, no LMDB-miss-deletes. The prior station event itself goes
+	// to the history store so /api/stations/{pubkey}/{d}/history can still
+	// serve it. For every kind it tells /stats whether the write added an
+	// event, and the count cache which entries the old version matched.
 	baseReplace := relay.ReplaceEvent
 	relay.ReplaceEvent = func(ctx context.Context, event nostr.Event) error {
-		var priorID nostr.ID
-		if event.Kind == indexedKind {
-			d := event.Tags.GetD()
-			if d != "" {
-				prevFilter := nostr.Filter{
-					Kinds:   []nostr.Kind{indexedKind},
-					Authors: []nostr.PubKey{event.PubKey},
-					Tags:    nostr.TagMap{"d": []string{d}},
-				}
-				for prev := range db.QueryEvents(prevFilter, 1) {
-					priorID = prev.ID
-					break
-				}
-			}
+		if !life.beginWrite() {
+			return errShuttingDown
 		}
+		defer life.endWrite()
+		logIncomingEvent(ctx, event)
+		prior, hadPrior := fetchReplaced(db, event)
 		if err := baseReplace(ctx, event); err != nil {
 			return err
 		}
-		return search.ReplaceEvent(event, priorID)
+		if !hadPrior {
+			health.observe(event.Kind, 1)
+		}
+		countCache.invalidate(event)
+		if !isZeroID(prior.ID) && prior.ID != event.ID {
+			countCache.invalidate(prior)
+		}
+		// Only station versions belong in the history store.
+		if prior.Kind == indexedKind && !isZeroID(prior.ID) && prior.ID != event.ID && prior.CreatedAt <= event.CreatedAt {
+			if err := history.SaveEvent(prior); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+				slog.Warn("failed to archive station version", "id", prior.ID.Hex(), "err", err)
+			}
+		}
+		nip05.observe(event)
+		logos.observe(event)
+		suggest.observe(event)
+		favorites.observe(event)
+		trending.observe(event)
+		if err := counts.observe(event); err != nil {
+			slog.Warn("failed to update HLL counts", "id", event.ID.Hex(), "err", err)
+		}
+		if err := search.ReplaceEvent(event, prior.ID); err != nil {
+			return err
+		}
+		duplicates.observe(event)
+		return nil
 	}
 
 	// Override DeleteEvent to also remove from bleve.
 	baseDelete := relay.DeleteEvent
 	relay.DeleteEvent = func(ctx context.Context, id nostr.ID) error {
+		if !life.beginWrite() {
+			return errShuttingDown
+		}
+		defer life.endWrite()
+		deleted, found := fetchEvent(db, id)
 		if err := baseDelete(ctx, id); err != nil {
 			return err
 		}
+		if found {
+			health.observe(deleted.Kind, -1)
+			countCache.invalidate(deleted)
+			suggest.observe(deleted)
+			favorites.forget(deleted)
+		}
+		nip05.forget(id)
 		return search.DeleteEvent(id)
 	}
 
@@ -547,14 +1098,15 @@ func main() {
 	// always accepted even when the referenced event is not in this relay's database.
 	relay.QueryStored = func(ctx context.Context, filter nostr.Filter) iter.Seq[nostr.Event] {
 		isInternal := safeGetSubscriptionID(ctx) == "internal"
-		if !isInternal {
-			logQuery(ctx, filter)
-		}
+		limits := live.Load().Limits
 		if len(filter.Search) > 0 {
-			return search.QueryEvents(filter, 100)
+			if isInternal {
+				return search.QueryEvents(filter, limits.MaxSearchLimit)
+			}
+			return queries.wrap(ctx, filter, search.QueryEvents(filter, limits.MaxSearchLimit))
 		}
 		if !isInternal {
-			return db.QueryEvents(filter, 1000)
+			return queries.wrap(ctx, filter, db.QueryEvents(filter, limits.MaxQueryLimit))
 		}
 		// Internal delete-check query: run normally, but if nothing is found AND the
 		// filter targets a specific author (from an "a"-tag coordinate), yield a phantom
@@ -563,7 +1115,7 @@ func main() {
 		// called with the phantom's zero ID which is a no-op in LMDB.
 		return func(yield func(nostr.Event) bool) {
 			found := false
-			for evt := range db.QueryEvents(filter, 1000) {
+			for evt := range db.QueryEvents(filter, limits.MaxQueryLimit) {
 				found = true
 				if !yield(evt) {
 					return
@@ -584,10 +1136,16 @@ func main() {
 	// question the UI asks on every page load, and bleve's DocCount() is
 	// O(1) since the index only ever holds station events.
 	//
-	// For any other filter shape we fall back to iterating LMDB, which is
-	// still cheap because the kind/pubkey indexes are pre-built. We cap the
-	// fallback at 200k so a malformed empty-filter request can't pin the
-	// relay scanning forever.
+	// Reactions, favorites and zap receipts for one #a or #e target are
+	// answered from the HyperLogLog registers kept on write (see hll.go).
+	//
+	// Any other filter shape is answered from countCache if a previous
+	// COUNT asked the same thing and no matching event has arrived since.
+	// Otherwise search filters are counted by bleve's Total, and the rest by
+	// iterating LMDB, which is still cheap because the kind/pubkey indexes
+	// are pre-built. We cap that at limits.max_count_scan (200k by default)
+	// so a malformed empty-filter request can't pin the relay scanning
+	// forever.
 	relay.Count = func(_ context.Context, filter nostr.Filter) (uint32, error) {
 		if isStationOnlyCountFilter(filter) {
 			docCount, err := search.index.DocCount()
@@ -596,14 +1154,73 @@ func main() {
 			}
 			// fall through to LMDB if bleve hiccups
 		}
-		const fallbackCap = 200_000
+		if regs, _, ok := counts.lookup(filter); ok {
+			return hllEstimate(regs), nil
+		}
+		key := countKey(filter)
+		if n, ok := countCache.get(key); ok {
+			return n, nil
+		}
+		limits := live.Load().Limits
+		version := countCache.version(filter)
 		var n uint32
-		for range db.QueryEvents(filter, fallbackCap) {
-			n++
+		if filter.Search != "" {
+			total, err := search.Count(filter)
+			if err != nil {
+				return 0, err
+			}
+			n = uint32(min(total, math.MaxUint32))
+		} else {
+			for range db.QueryEvents(filter, limits.MaxCountScan) {
+				n++
+			}
 		}
+		countCache.put(key, filter, n, version, limits.CountCacheSize, limits.CountCacheTTL.Duration)
 		return n, nil
 	}
 
+	// khatru asks for registers when the filter is a single-tag, single-kind
+	// NIP-45 shape. Shapes other than the kept ones build theirs with the
+	// same capped LMDB scan.
+	relay.CountHLL = func(_ context.Context, filter nostr.Filter, offset int) (uint32, *hyperloglog.HyperLogLog, error) {
+		regs, kept, ok := counts.lookup(filter)
+		if !ok || kept != offset {
+			regs = make([]byte, hllRegisterCount)
+			for evt := range db.QueryEvents(filter, live.Load().Limits.MaxCountScan) {
+				hllAdd(regs, evt.PubKey, offset)
+			}
+		}
+		return hllEstimate(regs), hyperloglog.NewWithRegisters(regs, offset), nil
+	}
+
+	// NIP-05 names, from the registry events in LMDB.
+	nip05.publish = func(ctx context.Context, evt nostr.Event) error {
+		if err := relay.ReplaceEvent(ctx, evt); err != nil {
+			return err
+		}
+		relay.BroadcastEvent(evt)
+		return nil
+	}
+	trending.publish = nip05.publish
+	nip05.Load()
+	if *importNIP05 != "" {
+		n, err := nip05.Import(context.Background(), *importNIP05)
+		if err != nil {
+			slog.Error("NIP-05 import stopped", "imported", n, "err", err)
+			exitCode = 1
+			return
+		}
+		slog.Info("imported NIP-05 names", "names", n, "file", *importNIP05)
+		return
+	}
+
+	// Build the HLL registers, favorites model and trending scores from
+	// LMDB in the background. Like the loops started below, they stop at
+	// shutdown before the stores close.
+	life.spawn(func(ctx context.Context) { counts.Backfill(ctx, db) })
+	life.spawn(favorites.Backfill)
+	life.spawn(trending.Backfill)
+
 	// Drift check: if LMDB has stations but the search index has essentially
 	// none, log a loud warning. The deploy script will auto-reindex on a fresh
 	// deploy, but operators need to see this immediately if something gets out
@@ -615,143 +1232,157 @@ func main() {
 		}
 		if lmdbCount > 0 {
 			if idxCount, err := search.index.DocCount(); err == nil && idxCount < 2 {
-				log.Printf("⚠️  Search index is essentially empty (%d docs) but LMDB has stations.", idxCount)
-				log.Printf("    NIP-50 search will return no results. Run `./relay/relay --reindex` to rebuild.")
+				slog.Warn("search index is essentially empty but LMDB has stations; NIP-50 search will return nothing until --reindex runs",
+					"index_docs", idxCount)
 			}
 		}
 	}
 
-	port := *port
-	log.Printf("🚀 WaveFunc Radio Relay starting on port %s", port)
-	log.Printf("📊 LMDB: %s", *dbPath)
-	log.Printf("🔍 Search index: %s", *searchPath)
-
-	portInt := 3334
-	fmt.Sscanf(port, "%d", &portInt)
-
-	if err := relay.Start("0.0.0.0", portInt); err != nil {
-		log.Fatalf("Failed to start relay: %v", err)
+	slog.Info("WaveFunc Radio Relay starting",
+		"host", cfg.Listen.Host,
+		"port", cfg.Listen.Port,
+		"name", cfg.Info.Name,
+		"lmdb", dbPath,
+		"search_index", searchPath,
+		"history", historyPath,
+		"relay_pubkey", relayKey.Public().Hex(),
+		"query_log_sample", cfg.Log.QuerySample,
+		"slow_query", cfg.Log.SlowQuery.Duration,
+	)
+
+	// Health, readiness and stats for deploy scripts and Caddy.
+	life.spawn(health.run)
+	relay.Router().HandleFunc("GET /healthz", health.handleHealthz)
+	relay.Router().HandleFunc("GET /readyz", health.handleReadyz)
+	relay.Router().HandleFunc("GET /stats", health.handleStats)
+
+	// Radio Browser-compatible API for existing players and head units.
+	if err := os.MkdirAll(filepath.Dir(cfg.Storage.ClicksPath), 0755); err != nil {
+		fatal("failed to create click count directory", "err", err)
 	}
-}
-
-// logIncomingEvent logs events being stored
-func logIncomingEvent(evt nostr.Event) {
-	kindName := getKindName(evt.Kind)
-
-	identifier := ""
-	switch evt.Kind {
-	case 31237:
-		if tag := evt.Tags.Find("name"); tag != nil {
-			identifier = fmt.Sprintf(" (%s)", tag[1])
-		}
-	case 31337:
-		if tag := evt.Tags.Find("title"); tag != nil {
-			identifier = fmt.Sprintf(" (%s)", tag[1])
-		}
-	case 30078, 31990, 31989:
-		if tag := evt.Tags.Find("d"); tag != nil {
-			identifier = fmt.Sprintf(" (d:%s)", tag[1])
-		}
+	clicks, err := openClickStore(cfg.Storage.ClicksPath)
+	if err != nil {
+		fatal("failed to open click counts", "err", err)
 	}
-
-	log.Printf("📝 [EVENT] Kind %d (%s)%s - ID: %.16s... (%.8s...)",
-		evt.Kind, kindName, identifier, evt.ID.Hex(), evt.PubKey.Hex())
-}
-
-// safeGetSubscriptionID retrieves the subscription ID without panicking when
-// the context doesn't carry one (e.g. internal queries triggered by delete requests).
-func safeGetSubscriptionID(ctx context.Context) (subID string) {
-	defer func() {
-		if r := recover(); r != nil {
-			subID = "internal"
-		}
-	}()
-	subID = khatru.GetSubscriptionID(ctx)
-	if subID == "" {
-		subID = "internal"
+	defer clicks.Close()
+	newRadioBrowser(db, search, clicks, live).register(relay.Router())
+
+	// HTTP JSON API for consumers that don't speak websockets.
+	api := newStationAPI(db, history, search, live)
+	relay.Router().HandleFunc("GET /api/stations/search", api.handleSearch)
+	relay.Router().HandleFunc("GET /api/stations/highlights", api.handleHighlights)
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}", api.handleStation)
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}/history", api.handleHistory)
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}/similar", api.handleSimilar)
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}/duplicates", api.handleStationDuplicates)
+	relay.Router().HandleFunc("GET /api/stations/by-stream", api.handleByStream)
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}/playlist/{format}", api.handleStationPlaylist)
+	relay.Router().HandleFunc("GET /api/lists/{pubkey}/{d}/playlist/{format}", api.handleListPlaylist)
+
+	// /api/duplicates, recomputed in the background.
+	life.spawn(duplicates.run)
+	relay.Router().HandleFunc("GET /api/duplicates", duplicates.handleDuplicates)
+
+	// Recommendations from favorites lists.
+	relay.Router().HandleFunc("GET /api/stations/{pubkey}/{d}/also-favorited", favorites.handleAlsoFavorited)
+	relay.Router().HandleFunc("GET /api/recommendations/{pubkey}", favorites.handleRecommended)
+
+	// /api/trending, and the rankings published from it.
+	life.spawn(trending.run)
+	relay.Router().HandleFunc("GET /api/trending", trending.handleTrending)
+
+	// /api/genres: the genre taxonomy search and filters use.
+	relay.Router().HandleFunc("GET /api/genres", handleGenres)
+
+	// /api/suggest: typeahead, rebuilt in the background.
+	life.spawn(suggest.run)
+	relay.Router().HandleFunc("GET /api/suggest", suggest.handleSuggest)
+
+	// Atom/RSS feeds of catalog changes and the OPML directory.
+	newFeeds(db, history, search, live).register(relay.Router())
+
+	// sitemap.xml and crawlable station pages, with the sitemap rebuilt in
+	// the background.
+	seo := newSEOPages(db, live)
+	life.spawn(seo.run)
+	seo.register(relay.Router())
+
+	// NIP-05 identifiers for the main domain, plus /admin/nip05.
+	nip05.register(relay.Router())
+
+	// Blossom blob server for logos and song files.
+	blobs, err := openBlobStore(cfg.Storage.BlobsPath, live)
+	if err != nil {
+		fatal("failed to open blob store", "err", err)
 	}
-	return
-}
-
-// logQuery logs incoming subscription queries
-func logQuery(ctx context.Context, filter nostr.Filter) {
-	subID := safeGetSubscriptionID(ctx)
-
-	var parts []string
-
-	if len(filter.IDs) > 0 {
-		parts = append(parts, fmt.Sprintf("IDs:%d", len(filter.IDs)))
+	defer blobs.Close()
+	blobs.register(relay.Router())
+
+	// /img/{pubkey}/{d}/{size}: station logos as WebP.
+	life.spawn(logos.run)
+	logos.register(relay.Router())
+
+	// Admin endpoints (NIP-98 auth, admin.pubkeys only).
+	relay.Router().HandleFunc("POST /admin/reload", live.requireAdmin(live.handleReload))
+	live.reloadOnSIGHUP()
+
+	// Serve the relay ourselves rather than via relay.Start so NIP-11 can be
+	// answered from the live config. Timeouts mirror khatru's Start (blob
+	// transfers extend their own deadlines); CORS also lets browsers make
+	// the authorized PUT and DELETE requests Blossom uses.
+	corsHandler := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"X-Reason"},
+		MaxAge:         86400,
+	})
+	server := &http.Server{
+		Addr:         net.JoinHostPort(cfg.Listen.Host, strconv.Itoa(cfg.Listen.Port)),
+		Handler:      corsHandler.Handler(live.serveNIP11(relay, relayKey.Public())),
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 2 * time.Second,
+		IdleTimeout:  30 * time.Second,
 	}
-	if len(filter.Authors) > 0 {
-		parts = append(parts, fmt.Sprintf("Authors:%d", len(filter.Authors)))
-	}
-	if len(filter.Kinds) > 0 {
-		kinds := make([]string, len(filter.Kinds))
-		for i, k := range filter.Kinds {
-			kinds[i] = fmt.Sprintf("%d", k)
-		}
-		parts = append(parts, fmt.Sprintf("Kinds:[%s]", strings.Join(kinds, ",")))
-	}
-	if filter.Since != 0 {
-		parts = append(parts, fmt.Sprintf("Since:%d", filter.Since))
-	}
-	if filter.Until != 0 {
-		parts = append(parts, fmt.Sprintf("Until:%d", filter.Until))
-	}
-	if filter.Limit > 0 {
-		parts = append(parts, fmt.Sprintf("Limit:%d", filter.Limit))
-	}
-	if filter.Search != "" {
-		parts = append(parts, fmt.Sprintf("Search:'%s'", filter.Search))
-	}
-	for tagName, values := range filter.Tags {
-		parts = append(parts, fmt.Sprintf("#%s:%d", tagName, len(values)))
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		slog.Error("relay server stopped unexpectedly", "err", err)
+		exitCode = 1
+	case sig := <-stop:
+		slog.Info("shutdown requested", "signal", sig.String(), "timeout", cfg.Listen.ShutdownTimeout.Duration)
+		go func() {
+			<-stop
+			slog.Warn("second signal received, exiting without cleanup")
+			os.Exit(1)
+		}()
 	}
 
-	filterDesc := strings.Join(parts, ", ")
-	if filterDesc == "" {
-		filterDesc = "empty filter"
+	// Graceful shutdown, bounded by listen.shutdown_timeout:
+	//  1. refuse new EVENTs and REQs
+	//  2. stop accepting connections (websockets are hijacked, so they stay up)
+	//  3. wait for in-flight writes so LMDB and bleve agree
+	//  4. tell every subscriber its subscription is CLOSED
+	//  5. stop the background workers and wait for them
+	// then return, letting the deferred search.Close() flush scorch's
+	// segments before db.Close(). Skipping that flush on SIGTERM is what used
+	// to leave the index unreadable on the next start.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Listen.ShutdownTimeout.Duration)
+	defer cancel()
+	life.startShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("http server did not shut down cleanly", "err", err)
 	}
-
-	log.Printf("🔍 [QUERY %s] %s", subID, filterDesc)
-}
-
-func getKindName(kind nostr.Kind) string {
-	switch kind {
-	case 0:
-		return "Metadata"
-	case 1:
-		return "Note"
-	case 3:
-		return "Contacts"
-	case 7:
-		return "Reaction"
-	case 1111:
-		return "Comment"
-	case 1311:
-		return "Live Chat"
-	case 9735:
-		return "Zap"
-	case 10002:
-		return "Relay List"
-	case 30078:
-		return "App Data"
-	case 31237:
-		return "Radio Station"
-	case 31337:
-		return "Song"
-	case 31989:
-		return "Handler Recommendation"
-	case 31990:
-		return "Handler Info"
-	default:
-		if kind >= 30000 && kind < 40000 {
-			return "Parameterized Replaceable"
-		} else if kind >= 10000 && kind < 20000 {
-			return "Replaceable"
-		} else if kind >= 20000 && kind < 30000 {
-			return "Ephemeral"
-		}
-		return "Unknown"
+	if err := life.drainWrites(ctx); err != nil {
+		slog.Warn("timed out waiting for in-flight writes", "err", err)
+	}
+	closed := life.closeSubscriptions("error: " + errShuttingDown.Error())
+	if err := life.stopWorkers(ctx); err != nil {
+		slog.Warn("timed out waiting for background workers", "err", err)
 	}
+	slog.Info("relay stopped, flushing search index and closing LMDB", "subscriptions_closed", closed)
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/nip19"
+)
+
+// nip05Label marks the kind-30078 events that make up the NIP-05 registry.
+// One event per name, published by an admin or by the relay itself:
+//
+//	["d", "nip05:<name>"]
+//	["l", "wavefunc_nip05"]
+//	["p", "<pubkey>"]           absent to revoke the name
+//	["relay", "wss://..."]      optional, repeatable
+//
+// The newest event for a name wins, whoever of the authorities signed it.
+const nip05Label = "wavefunc_nip05"
+
+const nip05DPrefix = "nip05:"
+
+// nip05Entry is the current registration of one name.
+type nip05Entry struct {
+	Name      string          `json:"name"`
+	PubKey    nostr.PubKey    `json:"pubkey"`
+	Relays    []string        `json:"relays,omitempty"`
+	EventID   nostr.ID        `json:"event_id"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+
+	revoked bool
+}
+
+// nip05Registry serves /.well-known/nostr.json from the registration events
+// in LMDB. It keeps an in-memory copy, loaded at startup and updated by the
+// storage hooks, so lookups never touch LMDB.
+type nip05Registry struct {
+	db       eventstore.Store
+	live     *liveConfig
+	relayKey nostr.SecretKey
+
+	// publish stores and broadcasts an event the relay signed itself.
+	publish func(context.Context, nostr.Event) error
+
+	mu    sync.RWMutex
+	names map[string]nip05Entry
+}
+
+func newNIP05Registry(db eventstore.Store, live *liveConfig, relayKey nostr.SecretKey) *nip05Registry {
+	return &nip05Registry{db: db, live: live, relayKey: relayKey, names: make(map[string]nip05Entry)}
+}
+
+func (n *nip05Registry) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /.well-known/nostr.json", n.handleWellKnown)
+	mux.HandleFunc("GET /admin/nip05", n.live.requireAdmin(n.handleList))
+	mux.HandleFunc("PUT /admin/nip05/{name}", n.live.requireAdmin(n.handlePut))
+	mux.HandleFunc("DELETE /admin/nip05/{name}", n.live.requireAdmin(n.handleDelete))
+}
+
+// validNIP05Name accepts the NIP-05 local-part alphabet, lower-cased.
+func validNIP05Name(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isNIP05Registration reports whether evt claims to be a registry event.
+func isNIP05Registration(evt nostr.Event) bool {
+	if evt.Kind != listKind {
+		return false
+	}
+	if tag := evt.Tags.Find("l"); tag != nil && tag[1] == nip05Label {
+		return true
+	}
+	return strings.HasPrefix(evt.Tags.GetD(), nip05DPrefix)
+}
+
+// isAuthority reports whether pk may publish registry events: the relay's
+// own key and the current admin.pubkeys.
+func (n *nip05Registry) isAuthority(pk nostr.PubKey) bool {
+	if pk == n.relayKey.Public() {
+		return true
+	}
+	for _, a := range n.live.Load().Admin.Pubkeys {
+		if apk, err := nostr.PubKeyFromHex(a); err == nil && apk == pk {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectEvent has the khatru OnEvent signature. Registry events are only
+// accepted from authorities, and must name a valid pubkey.
+func (n *nip05Registry) rejectEvent(evt nostr.Event) (bool, string) {
+	if !isNIP05Registration(evt) {
+		return false, ""
+	}
+	if !n.isAuthority(evt.PubKey) {
+		return true, "restricted: only relay admins can register NIP-05 names"
+	}
+	if _, err := parseNIP05Event(evt); err != nil {
+		return true, "invalid: " + err.Error()
+	}
+	return false, ""
+}
+
+// parseNIP05Event reads a registry event. A missing p tag is a revocation.
+func parseNIP05Event(evt nostr.Event) (nip05Entry, error) {
+	name, ok := strings.CutPrefix(evt.Tags.GetD(), nip05DPrefix)
+	if !ok || !validNIP05Name(name) {
+		return nip05Entry{}, fmt.Errorf("d tag must be %q followed by a lower-case a-z0-9-_. name", nip05DPrefix)
+	}
+	if tag := evt.Tags.Find("l"); tag == nil || tag[1] != nip05Label {
+		return nip05Entry{}, fmt.Errorf("registry events need the l tag %q", nip05Label)
+	}
+	e := nip05Entry{Name: name, EventID: evt.ID, CreatedAt: evt.CreatedAt, revoked: true}
+	if tag := evt.Tags.Find("p"); tag != nil {
+		pk, err := nostr.PubKeyFromHex(tag[1])
+		if err != nil {
+			return nip05Entry{}, fmt.Errorf("p tag %q is not a hex pubkey", tag[1])
+		}
+		e.PubKey, e.revoked = pk, false
+	}
+	for tag := range evt.Tags.FindAll("relay") {
+		if len(tag) > 1 && tag[1] != "" {
+			e.Relays = append(e.Relays, tag[1])
+		}
+	}
+	return e, nil
+}
+
+// Load rebuilds the registry from LMDB, keeping only events from current
+// authorities.
+func (n *nip05Registry) Load() {
+	names := make(map[string]nip05Entry)
+	filter := nostr.Filter{Kinds: []nostr.Kind{listKind}, Tags: nostr.TagMap{"l": []string{nip05Label}}}
+	for evt := range n.db.QueryEvents(filter, maxDirectoryStations) {
+		if !n.isAuthority(evt.PubKey) {
+			continue
+		}
+		e, err := parseNIP05Event(evt)
+		if err != nil {
+			continue
+		}
+		if prev, ok := names[e.Name]; !ok || e.CreatedAt > prev.CreatedAt {
+			names[e.Name] = e
+		}
+	}
+	n.mu.Lock()
+	n.names = names
+	n.mu.Unlock()
+	slog.Debug("loaded NIP-05 registry", "names", len(names))
+}
+
+// observe applies a stored event to the registry, if it is one of ours.
+func (n *nip05Registry) observe(evt nostr.Event) {
+	if !isNIP05Registration(evt) || !n.isAuthority(evt.PubKey) {
+		return
+	}
+	e, err := parseNIP05Event(evt)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if prev, ok := n.names[e.Name]; !ok || e.CreatedAt >= prev.CreatedAt {
+		n.names[e.Name] = e
+	}
+}
+
+// forget is called after an event is deleted. Deleting the current
+// registration of a name falls back to whatever is left in LMDB, so the
+// registry is simply reloaded.
+func (n *nip05Registry) forget(id nostr.ID) {
+	n.mu.RLock()
+	hit := false
+	for _, e := range n.names {
+		if e.EventID == id {
+			hit = true
+			break
+		}
+	}
+	n.mu.RUnlock()
+	if hit {
+		n.Load()
+	}
+}
+
+// entries returns the active registrations, sorted by name.
+func (n *nip05Registry) entries() []nip05Entry {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	out := make([]nip05Entry, 0, len(n.names))
+	for _, e := range n.names {
+		if !e.revoked {
+			out = append(out, e)
+		}
+	}
+	slices.SortFunc(out, func(a, b nip05Entry) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
+
+func (n *nip05Registry) lookup(name string) (nip05Entry, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	e, ok := n.names[name]
+	return e, ok && !e.revoked
+}
+
+// nip05Document is the NIP-05 response body.
+type nip05Document struct {
+	Names  map[string]string   `json:"names"`
+	Relays map[string][]string `json:"relays,omitempty"`
+}
+
+func (n *nip05Registry) add(doc *nip05Document, e nip05Entry) {
+	doc.Names[e.Name] = e.PubKey.Hex()
+	relays := e.Relays
+	if len(relays) == 0 {
+		relays = n.live.Load().NIP05.Relays
+	}
+	if len(relays) > 0 {
+		doc.Relays[e.PubKey.Hex()] = relays
+	}
+}
+
+// handleWellKnown is GET /.well-known/nostr.json?name=. Without a name it
+// lists every registration, as the old static file did.
+func (n *nip05Registry) handleWellKnown(w http.ResponseWriter, r *http.Request) {
+	doc := nip05Document{Names: map[string]string{}, Relays: map[string][]string{}}
+	if name := r.URL.Query().Get("name"); name != "" {
+		if e, ok := n.lookup(strings.ToLower(name)); ok {
+			n.add(&doc, e)
+		}
+	} else {
+		for _, e := range n.entries() {
+			n.add(&doc, e)
+		}
+	}
+	// NIP-05 requires CORS on this path even for clients that don't send an
+	// Origin the CORS middleware would react to.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// handleList is GET /admin/nip05.
+func (n *nip05Registry) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"names": n.entries()})
+}
+
+// handlePut is PUT /admin/nip05/{name} with {"pubkey": "<hex or npub>",
+// "relays": [...]}. The relay signs the registration itself.
+func (n *nip05Registry) handlePut(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.PathValue("name"))
+	if !validNIP05Name(name) {
+		writeJSONError(w, http.StatusBadRequest, "name may only contain a-z, 0-9, '-', '_' and '.'")
+		return
+	}
+	var body struct {
+		PubKey string   `json:"pubkey"`
+		Relays []string `json:"relays"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "body must be JSON with a pubkey field")
+		return
+	}
+	pk, err := parsePubKey(body.PubKey)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tags := nostr.Tags{{"p", pk.Hex()}}
+	for _, relay := range body.Relays {
+		tags = append(tags, nostr.Tag{"relay", relay})
+	}
+	e, err := n.sign(r.Context(), name, tags)
+	if err != nil {
+		slog.Error("failed to publish NIP-05 registration", "name", name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to publish registration")
+		return
+	}
+	slog.Info("NIP-05 name registered", "name", name, "pubkey", pk.Hex())
+	writeJSON(w, http.StatusOK, e)
+}
+
+// handleDelete is DELETE /admin/nip05/{name}: publishes a revocation.
+func (n *nip05Registry) handleDelete(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.PathValue("name"))
+	if _, ok := n.lookup(name); !ok {
+		writeJSONError(w, http.StatusNotFound, "name is not registered")
+		return
+	}
+	if _, err := n.sign(r.Context(), name, nil); err != nil {
+		slog.Error("failed to publish NIP-05 revocation", "name", name, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to publish revocation")
+		return
+	}
+	slog.Info("NIP-05 name revoked", "name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parsePubKey accepts a hex pubkey or an npub.
+func parsePubKey(s string) (nostr.PubKey, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "npub1") {
+		if prefix, value, err := nip19.Decode(s); err == nil && prefix == "npub" {
+			if pk, ok := value.(nostr.PubKey); ok {
+				return pk, nil
+			}
+		}
+		return nostr.PubKey{}, fmt.Errorf("%q is not a valid npub", s)
+	}
+	pk, err := nostr.PubKeyFromHex(s)
+	if err != nil {
+		return pk, fmt.Errorf("%q is not a hex pubkey or npub", s)
+	}
+	return pk, nil
+}
+
+// sign publishes a relay-signed registry event for name with extra tags.
+func (n *nip05Registry) sign(ctx context.Context, name string, extra nostr.Tags) (nip05Entry, error) {
+	evt := nostr.Event{
+		Kind:      listKind,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"d", nip05DPrefix + name}, {"l", nip05Label}}, extra...),
+	}
+	// replacing within the same second would be a no-op for LMDB
+	n.mu.RLock()
+	prev, ok := n.names[name]
+	n.mu.RUnlock()
+	if ok && evt.CreatedAt <= prev.CreatedAt {
+		evt.CreatedAt = prev.CreatedAt + 1
+	}
+	if err := evt.Sign(n.relayKey); err != nil {
+		return nip05Entry{}, err
+	}
+	if err := n.publish(ctx, evt); err != nil {
+		return nip05Entry{}, err
+	}
+	return parseNIP05Event(evt)
+}
+
+// Import registers every name in a NIP-05 JSON document (such as the old
+// static public/.well-known/nostr.json), signed by the relay.
+func (n *nip05Registry) Import(ctx context.Context, path string) (int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var doc nip05Document
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return 0, fmt.Errorf("%s is not a NIP-05 document: %w", path, err)
+	}
+	imported := 0
+	for name, hex := range doc.Names {
+		name = strings.ToLower(name)
+		pk, err := nostr.PubKeyFromHex(hex)
+		if err != nil || !validNIP05Name(name) {
+			slog.Warn("skipping NIP-05 name", "name", name, "pubkey", hex)
+			continue
+		}
+		tags := nostr.Tags{{"p", pk.Hex()}}
+		for _, relay := range doc.Relays[hex] {
+			tags = append(tags, nostr.Tag{"relay", relay})
+		}
+		if _, err := n.sign(ctx, name, tags); err != nil {
+			return imported, fmt.Errorf("registering %q: %w", name, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
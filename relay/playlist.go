@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// playlistFormat renders stations as one playlist file type.
+type playlistFormat struct {
+	ext         string
+	contentType string
+	render      func(title string, stations []station) []byte
+}
+
+var playlistFormats = map[string]playlistFormat{
+	"m3u8": {"m3u8", "audio/x-mpegurl; charset=utf-8", renderM3U},
+	"m3u":  {"m3u", "audio/x-mpegurl; charset=utf-8", renderM3U},
+	"pls":  {"pls", "audio/x-scpls; charset=utf-8", renderPLS},
+	"xspf": {"xspf", "application/xspf+xml; charset=utf-8", renderXSPF},
+}
+
+// handleListPlaylist is GET /api/lists/{pubkey}/{d}/playlist/{format}: a
+// favorites or featured list resolved to its stations' primary streams.
+func (a *stationAPI) handleListPlaylist(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	format, ok := playlistFormats[r.PathValue("format")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "format must be m3u8, m3u, pls or xspf")
+		return
+	}
+	evt, found := fetchAddress(a.db, listKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "list not found")
+		return
+	}
+	list := parseStationList(evt)
+	title := list.Name
+	if title == "" {
+		title = "WaveFunc list"
+	}
+	writePlaylist(w, format, title, list.resolveStations(a.db))
+}
+
+// handleStationPlaylist is GET /api/stations/{pubkey}/{d}/playlist/{format}.
+func (a *stationAPI) handleStationPlaylist(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	format, ok := playlistFormats[r.PathValue("format")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "format must be m3u8, m3u, pls or xspf")
+		return
+	}
+	evt, found := fetchAddress(a.db, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+	st := parseStation(evt)
+	writePlaylist(w, format, st.Name, []station{st})
+}
+
+func writePlaylist(w http.ResponseWriter, format playlistFormat, title string, stations []station) {
+	// stations without a stream would be entries players can't open
+	playable := stations[:0:0]
+	for _, st := range stations {
+		if _, ok := st.primaryStream(); ok {
+			playable = append(playable, st)
+		}
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, playlistFilename(title), format.ext))
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(format.render(title, playable))
+}
+
+// playlistFilename reduces title to a safe ASCII file name.
+func playlistFilename(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		return "wavefunc"
+	}
+	return name
+}
+
+// oneLine keeps names from breaking line-based formats.
+var oneLine = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// renderM3U writes extended M3U. The logo and genre go in tvg-logo and
+// group-title, which VLC, Kodi and most IPTV-style players understand.
+func renderM3U(title string, stations []station) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#PLAYLIST:%s\n", oneLine.Replace(title))
+	attr := strings.NewReplacer(`"`, "'", "\r", "", "\n", "")
+	for _, st := range stations {
+		stream, _ := st.primaryStream()
+		b.WriteString("#EXTINF:-1")
+		if st.Thumbnail != "" {
+			fmt.Fprintf(&b, ` tvg-logo="%s"`, attr.Replace(st.Thumbnail))
+		}
+		if len(st.Genres) > 0 {
+			fmt.Fprintf(&b, ` group-title="%s"`, attr.Replace(st.Genres[0]))
+		}
+		fmt.Fprintf(&b, ",%s\n%s\n", oneLine.Replace(st.Name), oneLine.Replace(stream.URL))
+	}
+	return b.Bytes()
+}
+
+func renderPLS(_ string, stations []station) []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	for i, st := range stations {
+		stream, _ := st.primaryStream()
+		n := i + 1
+		fmt.Fprintf(&b, "File%d=%s\nTitle%d=%s\nLength%d=-1\n", n, oneLine.Replace(stream.URL), n, oneLine.Replace(st.Name), n)
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(stations))
+	return b.Bytes()
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Title      string `xml:"title,omitempty"`
+	Image      string `xml:"image,omitempty"`
+	Info       string `xml:"info,omitempty"`
+	Annotation string `xml:"annotation,omitempty"`
+}
+
+func renderXSPF(title string, stations []station) []byte {
+	pl := xspfPlaylist{Version: 1, Title: title, Tracks: make([]xspfTrack, 0, len(stations))}
+	for _, st := range stations {
+		stream, _ := st.primaryStream()
+		pl.Tracks = append(pl.Tracks, xspfTrack{
+			Location:   stream.URL,
+			Title:      st.Name,
+			Image:      st.Thumbnail,
+			Info:       st.Website,
+			Annotation: strings.Join(st.Genres, ", "),
+		})
+	}
+	out, _ := xml.MarshalIndent(pl, "", "  ")
+	return append([]byte(xml.Header), append(out, '\n')...)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// policy is the compiled form of PolicyConfig plus the per-event limits. It is
+// consulted for every incoming EVENT via relay.OnEvent.
+type policy struct {
+	trusted          map[nostr.PubKey]struct{}
+	blocked          map[nostr.PubKey]struct{}
+	allowedKinds     map[nostr.Kind]struct{}
+	maxContentLength int
+	maxEventTags     int
+	limiter          *rateLimiter
+}
+
+// newPolicy assumes cfg has already passed Validate.
+func newPolicy(cfg Config) *policy {
+	p := &policy{
+		trusted:          make(map[nostr.PubKey]struct{}, len(cfg.Policy.TrustedKeys)),
+		blocked:          make(map[nostr.PubKey]struct{}, len(cfg.Policy.BlockedPubkeys)),
+		maxContentLength: cfg.Limits.MaxContentLength,
+		maxEventTags:     cfg.Limits.MaxEventTags,
+	}
+	for _, k := range cfg.Policy.TrustedKeys {
+		if pk, err := nostr.PubKeyFromHex(k); err == nil {
+			p.trusted[pk] = struct{}{}
+		}
+	}
+	for _, k := range cfg.Policy.BlockedPubkeys {
+		if pk, err := nostr.PubKeyFromHex(k); err == nil {
+			p.blocked[pk] = struct{}{}
+		}
+	}
+	if len(cfg.Policy.AllowedKinds) > 0 {
+		p.allowedKinds = make(map[nostr.Kind]struct{}, len(cfg.Policy.AllowedKinds))
+		for _, k := range cfg.Policy.AllowedKinds {
+			p.allowedKinds[nostr.Kind(k)] = struct{}{}
+		}
+	}
+	if cfg.Policy.EventsPerMinute > 0 {
+		burst := cfg.Policy.EventBurst
+		if burst < 1 {
+			burst = 1
+		}
+		p.limiter = newRateLimiter(cfg.Policy.EventsPerMinute/60, burst)
+	}
+	return p
+}
+
+func (p *policy) isTrusted(pk nostr.PubKey) bool {
+	_, ok := p.trusted[pk]
+	return ok
+}
+
+// rejectEvent has the khatru OnEvent signature. Blocked authors and
+// oversized events are rejected for everyone; the kind allow-list and the
+// rate limit only apply to authors not in trusted_keys.
+func (p *policy) rejectEvent(ctx context.Context, evt nostr.Event) (reject bool, msg string) {
+	if _, ok := p.blocked[evt.PubKey]; ok {
+		return true, "blocked: pubkey is not allowed to publish here"
+	}
+	if p.maxContentLength > 0 && len(evt.Content) > p.maxContentLength {
+		return true, fmt.Sprintf("invalid: content longer than %d bytes", p.maxContentLength)
+	}
+	if p.maxEventTags > 0 && len(evt.Tags) > p.maxEventTags {
+		return true, fmt.Sprintf("invalid: more than %d tags", p.maxEventTags)
+	}
+	if p.isTrusted(evt.PubKey) {
+		return false, ""
+	}
+	if p.allowedKinds != nil {
+		if _, ok := p.allowedKinds[evt.Kind]; !ok {
+			return true, fmt.Sprintf("blocked: kind %d is not accepted by this relay", evt.Kind)
+		}
+	}
+	if p.limiter != nil && !p.limiter.allow(safeGetIP(ctx)) {
+		return true, "rate-limited: slow down"
+	}
+	return false, ""
+}
+
+// rateLimiter is a per-key token bucket. Idle buckets are dropped lazily once
+// they have refilled completely, since they are then indistinguishable from a
+// new one.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *rateLimiter) allow(key string) bool {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > time.Minute {
+		full := time.Duration(rl.burst / rl.perSecond * float64(time.Second))
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > full {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.perSecond)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bleve "github.com/blevesearch/bleve/v2"
+	bleveSearch "github.com/blevesearch/bleve/v2/search"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/khatru"
+)
+
+// radioBrowser serves a subset of the Radio Browser JSON API
+// (https://de1.api.radio-browser.info) so existing players and head units
+// can use WaveFunc as their backend. Only /json is supported; every endpoint
+// answers GET and POST with parameters in the query string or a form body.
+//
+// Stations are identified by a UUID derived from their 31237 address, so the
+// same station keeps its stationuuid across edits.
+type radioBrowser struct {
+	db     eventstore.Store
+	search *stationSearch
+	clicks *clickStore
+	live   *liveConfig
+}
+
+func newRadioBrowser(db eventstore.Store, search *stationSearch, clicks *clickStore, live *liveConfig) *radioBrowser {
+	return &radioBrowser{db: db, search: search, clicks: clicks, live: live}
+}
+
+func (rb *radioBrowser) register(mux *http.ServeMux) {
+	routes := map[string]http.HandlerFunc{
+		"/json/stations":                  rb.handleStations,
+		"/json/stations/search":           rb.handleSearch,
+		"/json/stations/byuuid":           rb.handleByUUIDs,
+		"/json/stations/topclick":         rb.handleTopClick,
+		"/json/stations/topclick/{count}": rb.handleTopClick,
+		"/json/stations/{by}/{term}":      rb.handleStationsBy,
+		"/json/tags":                      rb.handleTags,
+		"/json/tags/{filter}":             rb.handleTags,
+		"/json/countries":                 rb.handleCountries,
+		"/json/countries/{filter}":        rb.handleCountries,
+		"/json/countrycodes":              rb.handleCountryCodes,
+		"/json/countrycodes/{filter}":     rb.handleCountryCodes,
+		"/json/languages":                 rb.handleLanguages,
+		"/json/languages/{filter}":        rb.handleLanguages,
+		"/json/url/{uuid}":                rb.handleClick,
+	}
+	for pattern, h := range routes {
+		mux.HandleFunc("GET "+pattern, h)
+		mux.HandleFunc("POST "+pattern, h)
+	}
+}
+
+// rbStation is a Radio Browser station object. Fields we have no data for
+// (votes, check results) are filled with the values a healthy, never-voted
+// station would have, so clients with hidebroken logic don't drop them.
+type rbStation struct {
+	ChangeUUID            string   `json:"changeuuid"`
+	StationUUID           string   `json:"stationuuid"`
+	ServerUUID            *string  `json:"serveruuid"`
+	Name                  string   `json:"name"`
+	URL                   string   `json:"url"`
+	URLResolved           string   `json:"url_resolved"`
+	Homepage              string   `json:"homepage"`
+	Favicon               string   `json:"favicon"`
+	Tags                  string   `json:"tags"`
+	Country               string   `json:"country"`
+	CountryCode           string   `json:"countrycode"`
+	ISO31662              string   `json:"iso_3166_2"`
+	State                 string   `json:"state"`
+	Language              string   `json:"language"`
+	LanguageCodes         string   `json:"languagecodes"`
+	Votes                 int      `json:"votes"`
+	LastChangeTime        string   `json:"lastchangetime"`
+	LastChangeTimeISO8601 string   `json:"lastchangetime_iso8601"`
+	Codec                 string   `json:"codec"`
+	Bitrate               int      `json:"bitrate"`
+	HLS                   int      `json:"hls"`
+	LastCheckOK           int      `json:"lastcheckok"`
+	LastCheckTime         string   `json:"lastchecktime"`
+	LastCheckOKTime       string   `json:"lastcheckoktime"`
+	LastLocalCheckTime    string   `json:"lastlocalchecktime"`
+	ClickTimestamp        string   `json:"clicktimestamp"`
+	ClickCount            uint64   `json:"clickcount"`
+	ClickTrend            int      `json:"clicktrend"`
+	SSLError              int      `json:"ssl_error"`
+	GeoLat                *float64 `json:"geo_lat"`
+	GeoLong               *float64 `json:"geo_long"`
+	HasExtendedInfo       bool     `json:"has_extended_info"`
+}
+
+func newRBStation(st station, clicks uint64) rbStation {
+	changed := time.Unix(int64(st.Event.CreatedAt), 0).UTC()
+	out := rbStation{
+		ChangeUUID:            nameUUID("event:" + st.Event.ID.Hex()),
+		StationUUID:           rbStationUUID(st.Address()),
+		Name:                  st.Name,
+		Homepage:              st.Website,
+		Favicon:               st.Thumbnail,
+		CountryCode:           st.CountryCode,
+		Country:               countryName(st.CountryCode),
+		LastChangeTime:        changed.Format(time.DateTime),
+		LastChangeTimeISO8601: changed.Format(time.RFC3339),
+		LastCheckOK:           1,
+		ClickCount:            clicks,
+	}
+
+	tags := make([]string, len(st.Genres))
+	for i, g := range st.Genres {
+		tags[i] = strings.ToLower(g)
+	}
+	out.Tags = strings.Join(tags, ",")
+
+	names := make([]string, 0, len(st.Languages))
+	codes := make([]string, 0, len(st.Languages))
+	for _, l := range st.Languages {
+		code := strings.ToLower(l)
+		codes = append(codes, code)
+		names = append(names, languageName(code))
+	}
+	out.Language = strings.Join(names, ",")
+	out.LanguageCodes = strings.Join(codes, ",")
+
+	if stream, ok := st.primaryStream(); ok {
+		out.URL = stream.URL
+		out.URLResolved = stream.URL
+		out.Codec = stream.codec()
+		out.Bitrate = stream.Quality.Bitrate
+		if stream.isHLS() {
+			out.HLS = 1
+		}
+	}
+	if out.Codec == "" {
+		out.Codec = "UNKNOWN"
+	}
+
+	if lat, lon, ok := decodeGeohash(st.Geohash); ok {
+		out.GeoLat, out.GeoLong = &lat, &lon
+	}
+	return out
+}
+
+// rbNamespace is the UUIDv5 namespace for WaveFunc's Radio Browser IDs.
+var rbNamespace = [16]byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// rbStationUUID is the stationuuid of the station at addr.
+func rbStationUUID(addr string) string { return nameUUID("station:" + addr) }
+
+// nameUUID is an RFC 4122 version 5 UUID of name in rbNamespace.
+func nameUUID(name string) string {
+	h := sha1.New()
+	h.Write(rbNamespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// rbRequest is the paging and ordering part of a Radio Browser request.
+type rbRequest struct {
+	order   string
+	reverse bool
+	offset  int
+	limit   int
+}
+
+// rbOrders maps Radio Browser order values to index sort fields. clickcount
+// is handled separately since counts aren't in the index; anything else
+// (votes, random, ...) falls back to name.
+var rbOrders = map[string]string{
+	"name":            "name_sort",
+	"country":         "country",
+	"codec":           "codec",
+	"bitrate":         "bitrate",
+	"changetimestamp": "t",
+}
+
+func (rb *radioBrowser) parseRequest(r *http.Request) rbRequest {
+	maxLimit := rb.live.Load().Limits.MaxQueryLimit
+	req := rbRequest{
+		order:   strings.ToLower(r.FormValue("order")),
+		reverse: formBool(r.FormValue("reverse")),
+		limit:   maxLimit,
+	}
+	if n, err := strconv.Atoi(r.FormValue("offset")); err == nil && n > 0 {
+		req.offset = n
+	}
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil && n >= 0 {
+		req.limit = min(n, maxLimit)
+	}
+	return req
+}
+
+func (req rbRequest) sortBy() []string {
+	field, ok := rbOrders[req.order]
+	if !ok {
+		field = "name_sort"
+	}
+	if req.reverse {
+		field = "-" + field
+	}
+	return []string{field}
+}
+
+// listStations answers a station list request. An empty result is "[]", as
+// in Radio Browser, never 404.
+func (rb *radioBrowser) listStations(w http.ResponseWriter, q stationQuery, req rbRequest) {
+	var stations []rbStation
+	if req.order == "clickcount" {
+		// counts live outside the index: rank the first max_query_limit
+		// matches by clicks, then page through those.
+		events, _, err := rb.search.Find(q, 0, rb.live.Load().Limits.MaxQueryLimit)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		stations = rb.convert(events)
+		slices.SortStableFunc(stations, func(a, b rbStation) int {
+			if req.reverse {
+				return cmp.Compare(b.ClickCount, a.ClickCount)
+			}
+			return cmp.Compare(a.ClickCount, b.ClickCount)
+		})
+		stations = stations[min(req.offset, len(stations)):]
+		stations = stations[:min(req.limit, len(stations))]
+	} else {
+		q.Sort = req.sortBy()
+		events, _, err := rb.search.Find(q, req.offset, req.limit)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		stations = rb.convert(events)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, stations)
+}
+
+func (rb *radioBrowser) convert(events []nostr.Event) []rbStation {
+	parsed := make([]station, len(events))
+	addrs := make([]string, len(events))
+	for i, evt := range events {
+		parsed[i] = parseStation(evt)
+		addrs[i] = parsed[i].Address()
+	}
+	counts := rb.clicks.Count(addrs...)
+	out := make([]rbStation, len(parsed))
+	for i, st := range parsed {
+		out[i] = newRBStation(st, counts[addrs[i]])
+	}
+	return out
+}
+
+// handleStations is /json/stations: every station, paged.
+func (rb *radioBrowser) handleStations(w http.ResponseWriter, r *http.Request) {
+	rb.listStations(w, stationQuery{}, rb.parseRequest(r))
+}
+
+// handleSearch is /json/stations/search.
+func (rb *radioBrowser) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := stationQuery{
+		Name:      r.FormValue("name"),
+		NameExact: formBool(r.FormValue("nameExact")),
+	}
+	if v := r.FormValue("countrycode"); v != "" {
+		q.Countries = []string{v}
+	}
+	if v := r.FormValue("country"); v != "" {
+		codes := countryCodesMatching(v, formBool(r.FormValue("countryExact")))
+		if len(codes) == 0 {
+			writeJSON(w, http.StatusOK, []rbStation{})
+			return
+		}
+		q.Countries = append(q.Countries, codes...)
+	}
+	if v := r.FormValue("language"); v != "" {
+		q.Languages = languageCodesMatching(v, formBool(r.FormValue("languageExact")))
+		if len(q.Languages) == 0 {
+			writeJSON(w, http.StatusOK, []rbStation{})
+			return
+		}
+	}
+	if v := r.FormValue("tag"); v != "" {
+		if formBool(r.FormValue("tagExact")) {
+			q.Tags = []string{v}
+		} else {
+			q.Genres = []string{v}
+		}
+	}
+	if v := r.FormValue("tagList"); v != "" {
+		q.Tags = append(q.Tags, queryList([]string{v})...)
+	}
+	if v := r.FormValue("codec"); v != "" {
+		q.Codecs = []string{v}
+	}
+	q.MinBitrate, _ = strconv.Atoi(r.FormValue("bitrateMin"))
+	q.MaxBitrate, _ = strconv.Atoi(r.FormValue("bitrateMax"))
+	rb.listStations(w, q, rb.parseRequest(r))
+}
+
+// handleStationsBy is /json/stations/{by}/{term}, e.g. bycountry/germany or
+// bytagexact/jazz.
+func (rb *radioBrowser) handleStationsBy(w http.ResponseWriter, r *http.Request) {
+	by, term := r.PathValue("by"), r.PathValue("term")
+	var q stationQuery
+	switch by {
+	case "byname":
+		q.Name = term
+	case "bynameexact":
+		q.Name, q.NameExact = term, true
+	case "bycodec", "bycodecexact":
+		q.Codecs = []string{term}
+	case "bycountry", "bycountryexact":
+		q.Countries = countryCodesMatching(term, by == "bycountryexact")
+	case "bycountrycodeexact":
+		q.Countries = []string{term}
+	case "bylanguage", "bylanguageexact":
+		q.Languages = languageCodesMatching(term, by == "bylanguageexact")
+	case "bytag":
+		q.Genres = []string{term}
+	case "bytagexact":
+		q.Tags = []string{term}
+	case "byuuid":
+		q.UUIDs = queryList([]string{term})
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown station list")
+		return
+	}
+	// a country or language name that matched nothing must not turn into
+	// an unfiltered list
+	if (strings.HasPrefix(by, "bycountry") && len(q.Countries) == 0) ||
+		(strings.HasPrefix(by, "bylanguage") && len(q.Languages) == 0) {
+		writeJSON(w, http.StatusOK, []rbStation{})
+		return
+	}
+	rb.listStations(w, q, rb.parseRequest(r))
+}
+
+// handleByUUIDs is /json/stations/byuuid?uuids=a,b,c.
+func (rb *radioBrowser) handleByUUIDs(w http.ResponseWriter, r *http.Request) {
+	uuids := queryList([]string{r.FormValue("uuids")})
+	if len(uuids) == 0 {
+		writeJSON(w, http.StatusOK, []rbStation{})
+		return
+	}
+	rb.listStations(w, stationQuery{UUIDs: uuids}, rb.parseRequest(r))
+}
+
+// handleTopClick is /json/stations/topclick[/{count}].
+func (rb *radioBrowser) handleTopClick(w http.ResponseWriter, r *http.Request) {
+	req := rb.parseRequest(r)
+	if n, err := strconv.Atoi(r.PathValue("count")); err == nil && n >= 0 {
+		req.limit = min(n, req.limit)
+	}
+	stations := make([]rbStation, 0, req.limit)
+	for _, top := range rb.clicks.Top(req.offset + req.limit) {
+		kind, pk, d, ok := parseAddress(top.Address)
+		if !ok {
+			continue
+		}
+		if evt, found := fetchAddress(rb.db, kind, pk, d); found {
+			stations = append(stations, newRBStation(parseStation(evt), top.Count))
+		}
+	}
+	stations = stations[min(req.offset, len(stations)):]
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, stations)
+}
+
+// handleClick is /json/url/{uuid}: count a play and return the stream URL.
+func (rb *radioBrowser) handleClick(w http.ResponseWriter, r *http.Request) {
+	uuid := strings.ToLower(r.PathValue("uuid"))
+	events, _, err := rb.search.Find(stationQuery{UUIDs: []string{uuid}}, 0, 1)
+	if err != nil || len(events) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]any{
+			"ok":      false,
+			"message": "did not find station with matching uuid",
+		})
+		return
+	}
+	st := parseStation(events[0])
+	if _, err := rb.clicks.Click(st.Address(), khatru.GetIPFromRequest(r)); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"ok": false, "message": "could not count click"})
+		return
+	}
+	stream, _ := st.primaryStream()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ok":          true,
+		"message":     "retrieved station url",
+		"stationuuid": uuid,
+		"name":        st.Name,
+		"url":         stream.URL,
+	})
+}
+
+// rbCount is one row of /json/tags, /json/countries and friends.
+type rbCount struct {
+	Name         string `json:"name"`
+	ISO31661     string `json:"iso_3166_1,omitempty"`
+	ISO639       string `json:"iso_639,omitempty"`
+	StationCount int    `json:"stationcount"`
+}
+
+// handleTags is /json/tags[/{filter}].
+func (rb *radioBrowser) handleTags(w http.ResponseWriter, r *http.Request) {
+	rb.listCounts(w, r, "tag", func(term string) rbCount { return rbCount{Name: term} })
+}
+
+// handleCountries is /json/countries[/{filter}].
+func (rb *radioBrowser) handleCountries(w http.ResponseWriter, r *http.Request) {
+	rb.listCounts(w, r, "country", func(code string) rbCount {
+		return rbCount{Name: countryName(code), ISO31661: code}
+	})
+}
+
+// handleCountryCodes is /json/countrycodes[/{filter}].
+func (rb *radioBrowser) handleCountryCodes(w http.ResponseWriter, r *http.Request) {
+	rb.listCounts(w, r, "country", func(code string) rbCount { return rbCount{Name: code} })
+}
+
+// handleLanguages is /json/languages[/{filter}].
+func (rb *radioBrowser) handleLanguages(w http.ResponseWriter, r *http.Request) {
+	rb.listCounts(w, r, "lang", func(code string) rbCount {
+		return rbCount{Name: languageName(code), ISO639: code}
+	})
+}
+
+// maxFacetTerms bounds how many distinct values a facet list returns.
+const maxFacetTerms = 1 << 16
+
+// listCounts facets the whole index on field, names each term with row,
+// keeps the rows whose name contains {filter}, and orders them by name
+// (default) or stationcount.
+func (rb *radioBrowser) listCounts(w http.ResponseWriter, r *http.Request, field string, row func(string) rbCount) {
+	terms, err := rb.search.facet(field, maxFacetTerms)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	filter := strings.ToLower(r.PathValue("filter"))
+	rows := make([]rbCount, 0, len(terms))
+	for _, t := range terms {
+		c := row(t.Term)
+		if filter != "" && !strings.Contains(strings.ToLower(c.Name), filter) {
+			continue
+		}
+		c.StationCount = t.Count
+		rows = append(rows, c)
+	}
+
+	req := rb.parseRequest(r)
+	slices.SortFunc(rows, func(a, b rbCount) int {
+		var c int
+		if req.order == "stationcount" {
+			c = cmp.Or(cmp.Compare(a.StationCount, b.StationCount), strings.Compare(a.Name, b.Name))
+		} else {
+			c = strings.Compare(a.Name, b.Name)
+		}
+		if req.reverse {
+			return -c
+		}
+		return c
+	})
+	rows = rows[min(req.offset, len(rows)):]
+	rows = rows[:min(req.limit, len(rows))]
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, rows)
+}
+
+// facet returns the distinct values of a keyword field across all stations
+// with their station counts.
+func (s *stationSearch) facet(field string, size int) ([]*bleveSearch.TermFacet, error) {
+	req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), 0, 0, false)
+	req.AddFacet(field, bleve.NewFacetRequest(field, size))
+	result, err := s.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := result.Facets[field]; ok {
+		return f.Terms.Terms(), nil
+	}
+	return nil, nil
+}
+
+// formBool accepts the spellings Radio Browser clients send.
+func formBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "true", "1", "yes":
+		return true
+	}
+	return false
+}
+
+// countryName is the English name of an ISO 3166-1 code, or the code itself
+// when it isn't one.
+func countryName(code string) string {
+	if code == "" {
+		return ""
+	}
+	region, err := language.ParseRegion(code)
+	if err != nil {
+		return code
+	}
+	if name := display.English.Regions().Name(region); name != "" {
+		return name
+	}
+	return code
+}
+
+// languageName is the lower-case English name of a language code, matching
+// Radio Browser's "language" field, or the input itself when it isn't one.
+func languageName(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return strings.ToLower(code)
+	}
+	if name := display.English.Languages().Name(tag); name != "" {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(code)
+}
+
+// nameTables maps lower-case English country and language names to their
+// two-letter codes, for the name-based Radio Browser filters.
+var nameTables = sync.OnceValues(func() (countries, languages map[string]string) {
+	countries = make(map[string]string)
+	languages = make(map[string]string)
+	for a := 'A'; a <= 'Z'; a++ {
+		for b := 'A'; b <= 'Z'; b++ {
+			code := string([]rune{a, b})
+			// CLDR counts the UN and the eurozone as countries; Radio
+			// Browser doesn't, and neither do station countryCode tags.
+			if region, err := language.ParseRegion(code); err == nil && region.IsCountry() &&
+				region.Canonicalize().String() == code && code != "UN" && code != "EZ" {
+				if name := display.English.Regions().Name(region); name != "" {
+					countries[strings.ToLower(name)] = code
+				}
+			}
+			lc := strings.ToLower(code)
+			if base, err := language.ParseBase(lc); err == nil && base.String() == lc {
+				if name := display.English.Languages().Name(base); name != "" {
+					languages[strings.ToLower(name)] = lc
+				}
+			}
+		}
+	}
+	return countries, languages
+})
+
+// countryCodesMatching returns the codes of countries whose English name
+// contains name (or equals it, when exact).
+func countryCodesMatching(name string, exact bool) []string {
+	countries, _ := nameTables()
+	return codesMatching(countries, name, exact)
+}
+
+// languageCodesMatching is countryCodesMatching for languages. A value that
+// is itself a language code also matches stations tagged with that code.
+func languageCodesMatching(name string, exact bool) []string {
+	_, languages := nameTables()
+	codes := codesMatching(languages, name, exact)
+	if lc := strings.ToLower(name); len(lc) == 2 || len(lc) == 3 {
+		if !slices.Contains(codes, lc) {
+			codes = append(codes, lc)
+		}
+	}
+	return codes
+}
+
+func codesMatching(table map[string]string, name string, exact bool) []string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	var codes []string
+	for n, code := range table {
+		if n == name || (!exact && strings.Contains(n, name)) {
+			codes = append(codes, code)
+		}
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// decodeGeohash returns the centre of a geohash cell.
+func decodeGeohash(hash string) (lat, lon float64, ok bool) {
+	if hash == "" {
+		return 0, 0, false
+	}
+	latLo, latHi := -90.0, 90.0
+	lonLo, lonHi := -180.0, 180.0
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		idx := strings.IndexRune(geohashAlphabet, c)
+		if idx < 0 {
+			return 0, 0, false
+		}
+		for bit := 4; bit >= 0; bit-- {
+			on := idx&(1<<bit) != 0
+			if even {
+				mid := (lonLo + lonHi) / 2
+				if on {
+					lonLo = mid
+				} else {
+					lonHi = mid
+				}
+			} else {
+				mid := (latLo + latHi) / 2
+				if on {
+					latLo = mid
+				} else {
+					latHi = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return (latLo + latHi) / 2, (lonLo + lonHi) / 2, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fiatjaf.com/nostr"
+)
+
+// loadRelayKey reads the relay's own signing key from path, generating and
+// saving a new one on first start. The relay signs the events it publishes
+// itself (NIP-05 registrations made through the admin API, trending
+// rankings) with this key; its public half is NIP-11's self field.
+// It lives in a file rather than the config so --check-config never prints
+// it and it survives config edits.
+func loadRelayKey(path string) (nostr.SecretKey, error) {
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		sk, err := nostr.SecretKeyFromHex(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return sk, fmt.Errorf("relay key %s is not a 64-char hex secret key", path)
+		}
+		return sk, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nostr.SecretKey{}, fmt.Errorf("reading relay key: %w", err)
+	}
+
+	sk := nostr.Generate()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return sk, fmt.Errorf("creating relay key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(sk.Hex()+"\n"), 0600); err != nil {
+		return sk, fmt.Errorf("writing relay key: %w", err)
+	}
+	return sk, nil
+}
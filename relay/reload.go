@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/nip11"
+)
+
+// liveConfig owns the running configuration and everything derived from it
+// that can change without a restart: the write policy, the NIP-11 document,
+// the log level, the query-log thresholds and the genre taxonomy.
+//
+// Readers call Load() on every use and never hold on to the result, so a
+// reload takes effect for the next event/REQ/HTTP request. Reloads are
+// all-or-nothing: the new file is parsed and validated in full before a
+// single pointer is swapped, and any error leaves the old config in place.
+type liveConfig struct {
+	path     string
+	mu       sync.Mutex // serialises Reload
+	current  atomic.Pointer[Config]
+	policy   atomic.Pointer[policy]
+	logLevel *slog.LevelVar
+	queries  *queryLogger
+	// adminsChanged, if set, runs after a reload changes admin.pubkeys,
+	// so what only admins may publish can be re-checked.
+	adminsChanged func()
+}
+
+func newLiveConfig(path string, cfg Config, logLevel *slog.LevelVar, queries *queryLogger) *liveConfig {
+	lc := &liveConfig{path: path, logLevel: logLevel, queries: queries}
+	lc.apply(&cfg, nil)
+	return lc
+}
+
+func (lc *liveConfig) Load() *Config { return lc.current.Load() }
+
+func (lc *liveConfig) Policy() *policy { return lc.policy.Load() }
+
+// Reload re-reads the config file and environment and, if the result is
+// valid, swaps it in. Settings that are only read at startup (listen address,
+// storage paths, log format) keep their running values; a warning names any
+// that differ so the operator knows a restart is needed for them.
+func (lc *liveConfig) Reload() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	next, err := loadConfig(lc.path)
+	if err != nil {
+		return err
+	}
+	applyFlags(&next)
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	old := lc.Load()
+	var restartOnly []string
+	if next.Listen != old.Listen {
+		restartOnly = append(restartOnly, "listen")
+		next.Listen = old.Listen
+	}
+	if next.Storage != old.Storage {
+		restartOnly = append(restartOnly, "storage")
+		next.Storage = old.Storage
+	}
+	if next.Log.Format != old.Log.Format {
+		restartOnly = append(restartOnly, "log.format")
+		next.Log.Format = old.Log.Format
+	}
+	if len(restartOnly) > 0 {
+		slog.Warn("config reload ignored startup-only settings; restart to apply", "settings", restartOnly)
+	}
+
+	lc.apply(&next, old)
+	return nil
+}
+
+func (lc *liveConfig) apply(cfg *Config, old *Config) {
+	var prevLimiter *rateLimiter
+	if p := lc.policy.Load(); p != nil {
+		prevLimiter = p.limiter
+	}
+	next := newPolicy(*cfg)
+	// Keep per-IP bucket state across reloads unless the rate itself changed,
+	// otherwise every reload would hand each client a fresh burst.
+	if old != nil && prevLimiter != nil && next.limiter != nil &&
+		old.Policy.EventsPerMinute == cfg.Policy.EventsPerMinute &&
+		old.Policy.EventBurst == cfg.Policy.EventBurst {
+		next.limiter = prevLimiter
+	}
+
+	if lvl, err := parseLogLevel(cfg.Log.Level); err == nil && lc.logLevel != nil {
+		lc.logLevel.Set(lvl)
+	}
+	if lc.queries != nil {
+		lc.queries.configure(cfg.Log)
+	}
+	lc.policy.Store(next)
+	lc.current.Store(cfg)
+	activeTaxonomy.Store(newGenreTaxonomy(cfg.Genres))
+
+	if old != nil {
+		slog.Info("configuration reloaded", "changed", changedSections(old, cfg))
+		// Queries use the new taxonomy straight away, but stations keep
+		// the genre paths they were indexed with.
+		if !reflect.DeepEqual(old.Genres, cfg.Genres) {
+			slog.Warn("genre taxonomy changed; run --reindex to apply it to stored stations")
+		}
+		if lc.adminsChanged != nil && !slices.Equal(old.Admin.Pubkeys, cfg.Admin.Pubkeys) {
+			lc.adminsChanged()
+		}
+	}
+}
+
+// changedSections names the top-level config sections that differ, for the
+// reload log line.
+func changedSections(a, b *Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(*a), reflect.ValueOf(*b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, t.Field(i).Tag.Get("toml"))
+		}
+	}
+	return changed
+}
+
+// reloadOnSIGHUP reloads the config every time the process receives SIGHUP.
+// A failed reload is logged and the previous config stays active.
+func (lc *liveConfig) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := lc.Reload(); err != nil {
+				slog.Error("config reload rejected, keeping previous config", "trigger", "SIGHUP", "err", err)
+			}
+		}
+	}()
+}
+
+// handleReload is POST /admin/reload.
+func (lc *liveConfig) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := lc.Reload(); err != nil {
+		slog.Error("config reload rejected, keeping previous config", "trigger", "admin", "err", err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+// serveNIP11 answers NIP-11 requests from the live config and passes
+// everything else (websocket upgrades, HTTP routes) through to next. khatru
+// reads relay.Info directly, so swapping that pointer from the reload
+// goroutine would race with in-flight NIP-11 requests. self is the relay's
+// own key, which signs what the relay publishes (trending rankings, NIP-05
+// names), served as NIP-11's self field so clients can verify those events.
+func (lc *liveConfig) serveNIP11(next http.Handler, self nostr.PubKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" && r.Header.Get("Accept") == "application/nostr+json" {
+			w.Header().Set("Content-Type", "application/nostr+json")
+			json.NewEncoder(w).Encode(relayInfoDocument{lc.Load().relayInfo(), self.Hex()})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// relayInfoDocument is the NIP-11 document with its self field set.
+type relayInfoDocument struct {
+	*nip11.RelayInformationDocument
+	Self string `json:"self"`
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	bleve "github.com/blevesearch/bleve/v2"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+)
+
+// Search text grammar, for NIP-50 search strings and the HTTP API's q:
+//
+//	query   = clause { clause }            all clauses must match
+//	clause  = unary { "OR" unary }         any operand may match
+//	unary   = ( "-" | "NOT" ) unary | primary
+//	primary = word | "\"" phrase "\"" | field ":" ( word | "\"" phrase "\"" )
+//	        | "(" query ")"
+//
+// A word matches as a whole word or as a word prefix, so "enall" finds
+// "enallax", in any of the weighted text fields (searchFieldBoosts). Fields
+// scope a term to one part of the station (see
+// searchFields); other key:value words are NIP-50 extensions and are
+// ignored here. Text that doesn't parse (an unclosed quote, a dangling OR,
+// a negated OR operand) is searched the old way: every whitespace-separated
+// word must match.
+
+var errBadSearch = errors.New("unparseable search text")
+
+// searchFieldBoosts weight where an unscoped word or phrase matched, so a
+// station named "Jazz FM" outranks one that mentions jazz once in a long
+// description.
+var searchFieldBoosts = []struct {
+	field string
+	boost float64
+}{
+	{"name", 4},
+	{"genre", genreBoost},
+	{"location", 2},
+	{"description", 1},
+}
+
+// genreBoost is the "genre" weight in searchFieldBoosts, given to stations
+// found through the genre taxonomy.
+const genreBoost = 3
+
+// Station-name lookups are most searches, so a station whose whole name is
+// the search text comes first, then names starting with it.
+const (
+	exactNameBoost  = 20
+	namePrefixBoost = 12
+)
+
+type searchTokenKind int
+
+const (
+	tokWord searchTokenKind = iota
+	tokPhrase
+	tokField
+	tokOr
+	tokNot
+	tokOpen
+	tokClose
+)
+
+type searchToken struct {
+	kind  searchTokenKind
+	field string
+	text  string
+	// quoted marks a tokField whose value was a phrase.
+	quoted bool
+}
+
+// searchFields maps the field names the grammar accepts to the query each
+// builds.
+var searchFields = map[string]func(value string, quoted bool) bleveQuery.Query{
+	"name":        func(v string, quoted bool) bleveQuery.Query { return textQuery("name", v, quoted) },
+	"description": func(v string, quoted bool) bleveQuery.Query { return textQuery("description", v, quoted) },
+	"location":    func(v string, quoted bool) bleveQuery.Query { return textQuery("location", v, quoted) },
+	"genre":       func(v string, _ bool) bleveQuery.Query { return genreQuery(v) },
+	"tag":         func(v string, _ bool) bleveQuery.Query { return newKeywordTermQuery("tag", strings.ToLower(v)) },
+	"country":     func(v string, _ bool) bleveQuery.Query { return newKeywordTermQuery("country", strings.ToUpper(v)) },
+	"lang":        func(v string, _ bool) bleveQuery.Query { return newKeywordTermQuery("lang", strings.ToLower(v)) },
+	"codec":       func(v string, _ bool) bleveQuery.Query { return newKeywordTermQuery("codec", strings.ToUpper(v)) },
+	"stream":      func(v string, _ bool) bleveQuery.Query { return streamQuery(v) },
+}
+
+// searchFieldAliases are accepted spellings of searchFields keys.
+var searchFieldAliases = map[string]string{
+	"desc":     "description",
+	"language": "lang",
+}
+
+// compileSearchText turns search text into a bleve query. A nil query with
+// a nil error means the text held nothing to search for (only extensions).
+func compileSearchText(text string) (bleveQuery.Query, error) {
+	tokens, err := lexSearch(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchParser{tokens: tokens}
+	q, neg, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, errBadSearch
+	}
+	if q == nil {
+		return nil, nil
+	}
+	if neg {
+		return negate(q), nil
+	}
+	return q, nil
+}
+
+// searchExtensions returns the values of the name:value NIP-50 extension
+// words in text, in order. The grammar itself ignores them.
+func searchExtensions(text, name string) []string {
+	tokens, err := lexSearch(text)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, tok := range tokens {
+		if tok.kind == tokField && strings.EqualFold(tok.field, name) && tok.text != "" {
+			values = append(values, tok.text)
+		}
+	}
+	return values
+}
+
+// plainTextQueries is the fallback: every whitespace-separated word must
+// match, as in an unscoped word of the grammar.
+func plainTextQueries(text string) []bleveQuery.Query {
+	var out []bleveQuery.Query
+	for _, term := range strings.Fields(strings.ToLower(text)) {
+		out = append(out, weightedWordQuery(term))
+	}
+	return out
+}
+
+// plainSearchText is text lower-cased with quotes and extra whitespace
+// removed, if it is only words and phrases, for comparing with station
+// names. Text using operators or fields isn't a name lookup.
+func plainSearchText(text string) (string, bool) {
+	tokens, err := lexSearch(text)
+	if err != nil {
+		return "", false
+	}
+	var words []string
+	for _, tok := range tokens {
+		if tok.kind != tokWord && tok.kind != tokPhrase {
+			return "", false
+		}
+		words = append(words, strings.Fields(strings.ToLower(tok.text))...)
+	}
+	if len(words) == 0 {
+		return "", false
+	}
+	return strings.Join(words, " "), true
+}
+
+// boostNameMatches keeps base's matches and adds exactNameBoost and
+// namePrefixBoost to stations whose lower-cased name is or starts with name.
+func boostNameMatches(base bleveQuery.Query, name string) bleveQuery.Query {
+	exact := bleve.NewTermQuery(name)
+	exact.SetField("name_sort")
+	exact.SetBoost(exactNameBoost)
+	prefix := bleve.NewPrefixQuery(name)
+	prefix.SetField("name_sort")
+	prefix.SetBoost(namePrefixBoost)
+
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(base)
+	bq.AddShould(exact, prefix)
+	return bq
+}
+
+func lexSearch(text string) ([]searchToken, error) {
+	var tokens []searchToken
+	rs := []rune(text)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: tokOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: tokClose})
+			i++
+		case r == '"':
+			end := indexRune(rs, i+1, '"')
+			if end < 0 {
+				return nil, errBadSearch
+			}
+			tokens = append(tokens, searchToken{kind: tokPhrase, text: string(rs[i+1 : end])})
+			i = end + 1
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]):
+			tokens = append(tokens, searchToken{kind: tokNot})
+			i++
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && !strings.ContainsRune(`()"`, rs[i]) {
+				i++
+			}
+			word := string(rs[start:i])
+			switch {
+			case word == "OR":
+				tokens = append(tokens, searchToken{kind: tokOr})
+			case word == "NOT":
+				tokens = append(tokens, searchToken{kind: tokNot})
+			case word == "AND":
+				// implicit between clauses
+			case strings.HasSuffix(word, ":") && i < len(rs) && rs[i] == '"':
+				end := indexRune(rs, i+1, '"')
+				if end < 0 {
+					return nil, errBadSearch
+				}
+				tokens = append(tokens, searchToken{kind: tokField, field: strings.TrimSuffix(word, ":"), text: string(rs[i+1 : end]), quoted: true})
+				i = end + 1
+			default:
+				if field, value, ok := strings.Cut(word, ":"); ok && field != "" && value != "" {
+					tokens = append(tokens, searchToken{kind: tokField, field: field, text: value})
+				} else {
+					tokens = append(tokens, searchToken{kind: tokWord, text: word})
+				}
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func indexRune(rs []rune, from int, r rune) int {
+	for i := from; i < len(rs); i++ {
+		if rs[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// query parses clauses up to the end or a closing parenthesis. It reports
+// neg when the result is a lone negated clause, so the caller can fold it
+// into its own MustNot.
+func (p *searchParser) query() (q bleveQuery.Query, neg bool, err error) {
+	var must, mustNot []bleveQuery.Query
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokClose {
+			break
+		}
+		q, neg, err := p.clause()
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case q == nil:
+		case neg:
+			mustNot = append(mustNot, q)
+		default:
+			must = append(must, q)
+		}
+	}
+	switch {
+	case len(must) == 0 && len(mustNot) == 0:
+		return nil, false, nil
+	case len(must) == 0 && len(mustNot) == 1:
+		return mustNot[0], true, nil
+	case len(mustNot) == 0 && len(must) == 1:
+		return must[0], false, nil
+	case len(mustNot) == 0:
+		return bleve.NewConjunctionQuery(must...), false, nil
+	}
+	bq := bleve.NewBooleanQuery()
+	if len(must) == 0 {
+		must = append(must, bleve.NewMatchAllQuery())
+	}
+	bq.AddMust(must...)
+	bq.AddMustNot(mustNot...)
+	return bq, false, nil
+}
+
+// clause parses an OR chain. Negated operands can't be ORed.
+func (p *searchParser) clause() (bleveQuery.Query, bool, error) {
+	first, neg, err := p.unary()
+	if err != nil {
+		return nil, false, err
+	}
+	var disjuncts []bleveQuery.Query
+	if first != nil {
+		disjuncts = append(disjuncts, first)
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokOr {
+			break
+		}
+		p.pos++
+		next, nextNeg, err := p.unary()
+		if err != nil {
+			return nil, false, err
+		}
+		if neg || nextNeg {
+			return nil, false, errBadSearch
+		}
+		if next != nil {
+			disjuncts = append(disjuncts, next)
+		}
+	}
+	switch len(disjuncts) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return disjuncts[0], neg, nil
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...), false, nil
+}
+
+func (p *searchParser) unary() (bleveQuery.Query, bool, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, false, errBadSearch
+	}
+	p.pos++
+	switch tok.kind {
+	case tokNot:
+		q, neg, err := p.unary()
+		return q, !neg, err
+	case tokWord:
+		return weightedWordQuery(strings.ToLower(tok.text)), false, nil
+	case tokPhrase:
+		if strings.TrimSpace(tok.text) == "" {
+			return nil, false, nil
+		}
+		return weightedPhraseQuery(tok.text), false, nil
+	case tokField:
+		if strings.TrimSpace(tok.text) == "" {
+			return nil, false, nil
+		}
+		name := strings.ToLower(tok.field)
+		if alias, ok := searchFieldAliases[name]; ok {
+			name = alias
+		}
+		build, ok := searchFields[name]
+		if !ok {
+			// NIP-50: relays ignore extensions they don't support.
+			return nil, false, nil
+		}
+		return build(tok.text, tok.quoted), false, nil
+	case tokOpen:
+		q, neg, err := p.query()
+		if err != nil {
+			return nil, false, err
+		}
+		if tok, ok := p.peek(); !ok || tok.kind != tokClose {
+			return nil, false, errBadSearch
+		}
+		p.pos++
+		return q, neg, nil
+	}
+	return nil, false, errBadSearch
+}
+
+// wordQuery matches term as a word of field or as the prefix of one.
+// bleve applies boosts at the leaves, so both carry it.
+func wordQuery(field, term string, boost float64) bleveQuery.Query {
+	matchQ := bleve.NewMatchQuery(term)
+	matchQ.SetField(field)
+	matchQ.SetBoost(boost)
+	prefixQ := bleve.NewPrefixQuery(term)
+	prefixQ.SetField(field)
+	prefixQ.SetBoost(boost)
+	return bleve.NewDisjunctionQuery(matchQ, prefixQ)
+}
+
+// weightedWordQuery is wordQuery across every searchFieldBoosts field, plus
+// the genre term names, if any ("rap" finds hip hop stations).
+func weightedWordQuery(term string) bleveQuery.Query {
+	disjuncts := make([]bleveQuery.Query, 0, len(searchFieldBoosts))
+	for _, f := range searchFieldBoosts {
+		disjuncts = append(disjuncts, wordQuery(f.field, term, f.boost))
+	}
+	return genreTextQuery(bleve.NewDisjunctionQuery(disjuncts...), term, genreBoost)
+}
+
+func phraseQuery(field, phrase string) bleveQuery.Query {
+	pq := bleve.NewMatchPhraseQuery(phrase)
+	pq.SetField(field)
+	return pq
+}
+
+// weightedPhraseQuery is phraseQuery across every searchFieldBoosts field,
+// plus the genre phrase names, if any.
+func weightedPhraseQuery(phrase string) bleveQuery.Query {
+	disjuncts := make([]bleveQuery.Query, 0, len(searchFieldBoosts))
+	for _, f := range searchFieldBoosts {
+		pq := bleve.NewMatchPhraseQuery(phrase)
+		pq.SetField(f.field)
+		pq.SetBoost(f.boost)
+		disjuncts = append(disjuncts, pq)
+	}
+	return genreTextQuery(bleve.NewDisjunctionQuery(disjuncts...), phrase, genreBoost)
+}
+
+// textQuery is a phrase match for quoted values, otherwise every word of v
+// as a wordQuery.
+func textQuery(field, v string, quoted bool) bleveQuery.Query {
+	if quoted {
+		return phraseQuery(field, v)
+	}
+	var conjuncts []bleveQuery.Query
+	for _, term := range strings.Fields(strings.ToLower(v)) {
+		conjuncts = append(conjuncts, wordQuery(field, term, 1))
+	}
+	if len(conjuncts) == 1 {
+		return conjuncts[0]
+	}
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+func negate(q bleveQuery.Query) bleveQuery.Query {
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(bleve.NewMatchAllQuery())
+	bq.AddMustNot(q)
+	return bq
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	bleve "github.com/blevesearch/bleve/v2"
+)
+
+// searchTestDocs are indexed as buildSearchDoc would write them.
+var searchTestDocs = map[string]map[string]any{
+	"enallax": {
+		"name":        "Enallax Radio",
+		"name_sort":   "enallax radio",
+		"description": "deep techno all night",
+		"genre":       []string{"Techno"},
+		"tag":         []string{"techno"},
+		"genre_path":  []string{"techno", "electronic"},
+		"country":     "DE",
+		"lang":        []string{"de"},
+	},
+	"jazzfm": {
+		"name":        "Jazz FM",
+		"name_sort":   "jazz fm",
+		"description": "smooth jazz and soul from London",
+		"genre":       []string{"smooth jazz", "jazz"},
+		"tag":         []string{"smooth jazz", "jazz"},
+		"genre_path":  []string{"smooth jazz", "jazz"},
+		"location":    "London",
+		"country":     "GB",
+		"lang":        []string{"en"},
+	},
+	"rockberlin": {
+		"name":        "Classic Rock Berlin",
+		"name_sort":   "classic rock berlin",
+		"description": "the best rock of all time",
+		"genre":       []string{"classic rock", "rock"},
+		"tag":         []string{"classic rock", "rock"},
+		"genre_path":  []string{"classic rock", "rock"},
+		"location":    "Berlin",
+		"country":     "DE",
+		"lang":        []string{"de"},
+	},
+	"beats": {
+		"name":        "Street Beats",
+		"name_sort":   "street beats",
+		"description": "underground beats",
+		"genre":       []string{"Rap", "hip hop"},
+		"tag":         []string{"rap"},
+		"genre_path":  []string{"hip hop"},
+		"country":     "US",
+		"lang":        []string{"en"},
+	},
+}
+
+func newSearchTestIndex(t *testing.T) bleve.Index {
+	t.Helper()
+	prev := activeTaxonomy.Swap(newGenreTaxonomy(defaultGenres()))
+	t.Cleanup(func() { activeTaxonomy.Store(prev) })
+
+	idx, err := bleve.NewMemOnly(newStationIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	for id, doc := range searchTestDocs {
+		if err := idx.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return idx
+}
+
+func TestCompileSearchText(t *testing.T) {
+	idx := newSearchTestIndex(t)
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"enall", []string{"enallax"}},
+		{"Jazz", []string{"jazzfm"}},
+		{"rock berlin", []string{"rockberlin"}},
+		{"rock AND berlin", []string{"rockberlin"}},
+		{`"classic rock"`, []string{"rockberlin"}},
+		{`"rock classic"`, nil},
+		{"jazz OR techno", []string{"enallax", "jazzfm"}},
+		{"-jazz", []string{"beats", "enallax", "rockberlin"}},
+		{"NOT jazz", []string{"beats", "enallax", "rockberlin"}},
+		{"country:de -rock", []string{"enallax"}},
+		{"(jazz OR rock) -london", []string{"rockberlin"}},
+		{"name:berlin", []string{"rockberlin"}},
+		{"location:berlin", []string{"rockberlin"}},
+		{"desc:london", []string{"jazzfm"}},
+		{`description:"smooth jazz"`, []string{"jazzfm"}},
+		{"language:EN", []string{"beats", "jazzfm"}},
+		{"tag:rap", []string{"beats"}},
+		{"genre:electronic", []string{"enallax"}},
+		{"genre:hiphop", []string{"beats"}},
+		// an unscoped genre name finds the genre's stations too
+		{"rap", []string{"beats"}},
+		{"electronic", []string{"enallax"}},
+		// NIP-50 extensions are ignored
+		{"jazz include:spam", []string{"jazzfm"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			q, err := compileSearchText(tt.text)
+			if err != nil {
+				t.Fatalf("compileSearchText: %v", err)
+			}
+			res, err := idx.Search(bleve.NewSearchRequestOptions(q, 10, 0, false))
+			if err != nil {
+				t.Fatalf("search: %v", err)
+			}
+			var got []string
+			for _, hit := range res.Hits {
+				got = append(got, hit.ID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileSearchTextFallback(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+		wantNil bool
+	}{
+		{text: `"unclosed`, wantErr: true},
+		{text: `name:"unclosed`, wantErr: true},
+		{text: "jazz OR", wantErr: true},
+		{text: "-jazz OR rock", wantErr: true},
+		{text: "(jazz", wantErr: true},
+		{text: "jazz)", wantErr: true},
+		{text: "include:spam", wantNil: true},
+		{text: `""`, wantNil: true},
+		{text: "", wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			q, err := compileSearchText(tt.text)
+			if tt.wantErr {
+				if !errors.Is(err, errBadSearch) {
+					t.Errorf("err = %v, want errBadSearch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (q == nil) != tt.wantNil {
+				t.Errorf("query = %v, want nil: %v", q, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestSearchExtensions(t *testing.T) {
+	tests := []struct {
+		text, name string
+		want       []string
+	}{
+		{"jazz include:spam domain:example.com", "include", []string{"spam"}},
+		{"jazz Domain:a.com domain:b.com", "domain", []string{"a.com", "b.com"}},
+		{"jazz", "include", nil},
+		{`"unclosed domain:a.com`, "domain", nil},
+	}
+	for _, tt := range tests {
+		if got := searchExtensions(tt.text, tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("searchExtensions(%q, %q) = %v, want %v", tt.text, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlainSearchText(t *testing.T) {
+	tests := []struct {
+		text   string
+		want   string
+		wantOK bool
+	}{
+		{"Jazz  FM", "jazz fm", true},
+		{`"Jazz FM" london`, "jazz fm london", true},
+		{"jazz OR rock", "", false},
+		{"country:de", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := plainSearchText(tt.text)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("plainSearchText(%q) = %q, %v, want %q, %v", tt.text, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+const (
+	// sitemapPageSize is the number of station URLs per sitemap file. The
+	// protocol allows 50,000; smaller files keep each response quick.
+	sitemapPageSize = 10_000
+	sitemapMaxAge   = time.Hour
+	stationPageAge  = 5 * time.Minute
+)
+
+// seoPages serves sitemap.xml and a server-rendered HTML page per station,
+// so crawlers that don't run the SPA's JavaScript still see every station.
+// Caddy routes /sitemap.xml, /sitemaps/* and /stations/* on the main domain
+// here; the pages link into the SPA for listening.
+type seoPages struct {
+	db    eventstore.Store
+	live  *liveConfig
+	pages *pageCache
+
+	mu      sync.Mutex
+	entries []sitemapEntry
+	built   bool
+}
+
+type sitemapEntry struct {
+	Path    string
+	LastMod time.Time
+}
+
+func newSEOPages(db eventstore.Store, live *liveConfig) *seoPages {
+	return &seoPages{db: db, live: live, pages: newPageCache(sitemapMaxAge, 100)}
+}
+
+func (s *seoPages) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /sitemap.xml", s.handleSitemapIndex)
+	mux.HandleFunc("GET /sitemaps/{page}", s.handleSitemapPage)
+	mux.HandleFunc("GET /stations/{pubkey}/{d}", s.handleStationPage)
+}
+
+// stationPagePath is the relay-served HTML page for a station.
+func stationPagePath(pk nostr.PubKey, d string) string {
+	return "/stations/" + pk.Hex() + "/" + url.PathEscape(d)
+}
+
+// run rebuilds the sitemap entries at startup and then every
+// sitemapMaxAge, so no request waits on the LMDB walk.
+func (s *seoPages) run(ctx context.Context) {
+	for {
+		s.rebuild()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sitemapMaxAge):
+		}
+	}
+}
+
+func (s *seoPages) rebuild() {
+	start := time.Now()
+	var entries []sitemapEntry
+	for evt := range s.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{indexedKind}}, maxDirectoryStations) {
+		entries = append(entries, sitemapEntry{
+			Path:    stationPagePath(evt.PubKey, evt.Tags.GetD()),
+			LastMod: time.Unix(int64(evt.CreatedAt), 0).UTC(),
+		})
+	}
+	slices.SortFunc(entries, func(a, b sitemapEntry) int { return strings.Compare(a.Path, b.Path) })
+	s.mu.Lock()
+	s.entries, s.built = entries, true
+	s.mu.Unlock()
+	slog.Debug("sitemap rebuilt", "stations", len(entries), "took", time.Since(start).Round(time.Millisecond))
+}
+
+// sitemapEntries returns every station page as of the last rebuild,
+// ordered by path so pages keep the same members between rebuilds. It
+// fails with errSitemapPending until the first rebuild has finished.
+func (s *seoPages) sitemapEntries() ([]sitemapEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.built {
+		return nil, errSitemapPending
+	}
+	return s.entries, nil
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapLoc `xml:"url"`
+}
+
+type sitemapLoc struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// handleSitemapIndex is GET /sitemap.xml: an index of /sitemaps/{n}.xml.
+func (s *seoPages) handleSitemapIndex(w http.ResponseWriter, r *http.Request) {
+	base := requestBaseURL(r)
+	page, err := s.pages.get(base+r.URL.Path, func() ([]byte, time.Time, error) {
+		entries, err := s.sitemapEntries()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var index sitemapIndex
+		var newest time.Time
+		for n := 0; n*sitemapPageSize < len(entries); n++ {
+			chunk := entries[n*sitemapPageSize : min((n+1)*sitemapPageSize, len(entries))]
+			last := latestMod(chunk)
+			if last.After(newest) {
+				newest = last
+			}
+			index.Sitemaps = append(index.Sitemaps, sitemapLoc{
+				Loc:     base + "/sitemaps/" + strconv.Itoa(n+1) + ".xml",
+				LastMod: last.Format(time.RFC3339),
+			})
+		}
+		return marshalXML(index), newest, nil
+	})
+	if err == errSitemapPending {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, "sitemap is still being built")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to build sitemap")
+		return
+	}
+	servePage(w, r, page, "application/xml; charset=utf-8", sitemapMaxAge)
+}
+
+// handleSitemapPage is GET /sitemaps/{n}.xml, n counting from 1.
+func (s *seoPages) handleSitemapPage(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("page"), ".xml"))
+	if err != nil || n < 1 {
+		http.NotFound(w, r)
+		return
+	}
+	base := requestBaseURL(r)
+	page, err := s.pages.get(base+r.URL.Path, func() ([]byte, time.Time, error) {
+		entries, err := s.sitemapEntries()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		start := (n - 1) * sitemapPageSize
+		if start >= len(entries) {
+			return nil, time.Time{}, errNoSuchPage
+		}
+		chunk := entries[start:min(start+sitemapPageSize, len(entries))]
+		set := sitemapURLSet{URLs: make([]sitemapLoc, len(chunk))}
+		for i, e := range chunk {
+			set.URLs[i] = sitemapLoc{Loc: base + e.Path, LastMod: e.LastMod.Format(time.RFC3339)}
+		}
+		return marshalXML(set), latestMod(chunk), nil
+	})
+	if err == errNoSuchPage {
+		http.NotFound(w, r)
+		return
+	}
+	if err == errSitemapPending {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, "sitemap is still being built")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to build sitemap")
+		return
+	}
+	servePage(w, r, page, "application/xml; charset=utf-8", sitemapMaxAge)
+}
+
+var (
+	errNoSuchPage     = errors.New("no such sitemap page")
+	errSitemapPending = errors.New("sitemap not built yet")
+)
+
+func latestMod(entries []sitemapEntry) time.Time {
+	var t time.Time
+	for _, e := range entries {
+		if e.LastMod.After(t) {
+			t = e.LastMod
+		}
+	}
+	return t
+}
+
+// stationPageData feeds stationPageTemplate.
+type stationPageData struct {
+	Station     station
+	Lang        string
+	Title       string
+	Description string
+	Body        string
+	Canonical   string
+	ListenURL   string
+	Image       string
+	Country     string
+	JSONLD      map[string]any
+}
+
+var stationPageTemplate = template.Must(template.New("station").Parse(`<!doctype html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<link rel="canonical" href="{{.Canonical}}">
+<meta property="og:type" content="music.radio_station">
+<meta property="og:site_name" content="WaveFunc">
+<meta property="og:title" content="{{.Station.Name}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.Canonical}}">
+{{- if .Image}}
+<meta property="og:image" content="{{.Image}}">
+{{- end}}
+<meta name="twitter:card" content="summary">
+<script type="application/ld+json">{{.JSONLD}}</script>
+</head>
+<body>
+<main>
+<h1>{{.Station.Name}}</h1>
+{{- if .Station.Thumbnail}}
+<img src="{{.Station.Thumbnail}}" alt="{{.Station.Name}} logo" width="192" height="192">
+{{- end}}
+{{- if or .Station.Location .Country}}
+<p>{{.Station.Location}}{{if and .Station.Location .Country}} · {{end}}{{.Country}}</p>
+{{- end}}
+{{- if .Station.Genres}}
+<ul>{{range .Station.Genres}}<li>{{.}}</li>{{end}}</ul>
+{{- end}}
+{{- if .Body}}
+<p>{{.Body}}</p>
+{{- end}}
+<p><a href="{{.ListenURL}}">Listen on WaveFunc</a>{{if .Station.Website}} · <a href="{{.Station.Website}}" rel="nofollow">Station website</a>{{end}}</p>
+</main>
+</body>
+</html>
+`))
+
+// handleStationPage is GET /stations/{pubkey}/{d}.
+func (s *seoPages) handleStationPage(w http.ResponseWriter, r *http.Request) {
+	pk, err := nostr.PubKeyFromHex(r.PathValue("pubkey"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	evt, found := fetchAddress(s.db, indexedKind, pk, r.PathValue("d"))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	st := parseStation(evt)
+	cfg := s.live.Load()
+
+	data := stationPageData{
+		Station:     st,
+		Lang:        "en",
+		Title:       st.Name + " – WaveFunc",
+		Description: st.summary(160),
+		Body:        st.summary(5000),
+		Canonical:   requestBaseURL(r) + stationPagePath(pk, st.D),
+		ListenURL:   st.pageURL(cfg.Web.URL),
+		Image:       st.Thumbnail,
+		Country:     countryName(st.CountryCode),
+	}
+	if len(st.Languages) > 0 {
+		data.Lang = strings.ToLower(st.Languages[0])
+	}
+	if data.Description == "" {
+		data.Description = "Listen to " + st.Name + " on WaveFunc."
+	}
+	if data.Image == "" {
+		data.Image = strings.TrimRight(cfg.Web.URL, "/") + "/images/og-image.png"
+	}
+	data.JSONLD = stationJSONLD(st, data)
+
+	var buf bytes.Buffer
+	if err := stationPageTemplate.Execute(&buf, data); err != nil {
+		slog.Error("failed to render station page", "address", st.Address(), "err", err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	page := &renderedPage{
+		body:    buf.Bytes(),
+		modTime: time.Unix(int64(evt.CreatedAt), 0).UTC(),
+		etag:    strconv.Quote(evt.ID.Hex()[:16]),
+	}
+	servePage(w, r, page, "text/html; charset=utf-8", stationPageAge)
+}
+
+// stationJSONLD is the schema.org RadioStation description of st.
+func stationJSONLD(st station, data stationPageData) map[string]any {
+	ld := map[string]any{
+		"@context":    "https://schema.org",
+		"@type":       "RadioStation",
+		"name":        st.Name,
+		"url":         data.Canonical,
+		"description": data.Description,
+		"image":       data.Image,
+		"potentialAction": map[string]any{
+			"@type":  "ListenAction",
+			"target": data.ListenURL,
+		},
+	}
+	if st.Thumbnail != "" {
+		ld["logo"] = st.Thumbnail
+	}
+	if st.Website != "" {
+		ld["sameAs"] = st.Website
+	}
+	if len(st.Genres) > 0 {
+		ld["genre"] = st.Genres
+	}
+	if st.CountryCode != "" || st.Location != "" {
+		address := map[string]any{"@type": "PostalAddress"}
+		if st.CountryCode != "" {
+			address["addressCountry"] = st.CountryCode
+		}
+		if st.Location != "" {
+			address["addressLocality"] = st.Location
+		}
+		ld["address"] = address
+	}
+	if lat, lon, ok := decodeGeohash(st.Geohash); ok {
+		ld["geo"] = map[string]any{"@type": "GeoCoordinates", "latitude": lat, "longitude": lon}
+	}
+	return ld
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/khatru"
+)
+
+var errShuttingDown = errors.New("relay is shutting down")
+
+// lifecycle tracks what a clean shutdown has to wait for or notify: event
+// writes that are in the middle of touching LMDB and bleve, the background
+// workers that read and write the stores, and the subscriptions open on each
+// websocket.
+//
+// Subscriptions are recorded from OnRequest and dropped when their connection
+// goes away. khatru has no hook for CLOSE, so a connection may still list a
+// subscription the client already closed; sending CLOSED for it at shutdown
+// is harmless.
+type lifecycle struct {
+	mu      sync.Mutex
+	closing bool
+	writes  sync.WaitGroup
+	subs    map[*khatru.WebSocket]map[string]struct{}
+
+	workCtx  context.Context
+	stopWork context.CancelFunc
+	workers  sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{
+		subs:     make(map[*khatru.WebSocket]map[string]struct{}),
+		workCtx:  ctx,
+		stopWork: cancel,
+	}
+}
+
+// spawn runs a background worker with a context that stopWorkers cancels.
+// Workers must return soon after it ends: the stores close once they have.
+func (lc *lifecycle) spawn(worker func(context.Context)) {
+	lc.workers.Go(func() { worker(lc.workCtx) })
+}
+
+// beginWrite registers an in-flight write. It returns false once shutdown
+// has started; the caller must then refuse the write. Every true return must
+// be paired with endWrite.
+func (lc *lifecycle) beginWrite() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.closing {
+		return false
+	}
+	lc.writes.Add(1)
+	return true
+}
+
+func (lc *lifecycle) endWrite() { lc.writes.Done() }
+
+func (lc *lifecycle) isClosing() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.closing
+}
+
+// trackSubscription has the shape of relay.OnRequest. New REQs are refused
+// once shutdown has started.
+func (lc *lifecycle) trackSubscription(ctx context.Context, _ nostr.Filter) (reject bool, msg string) {
+	ws := khatru.GetConnection(ctx)
+	subID := safeGetSubscriptionID(ctx)
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.closing {
+		return true, "error: " + errShuttingDown.Error()
+	}
+	if ws == nil || subID == "internal" {
+		return false, ""
+	}
+	ids, ok := lc.subs[ws]
+	if !ok {
+		ids = make(map[string]struct{})
+		lc.subs[ws] = ids
+	}
+	ids[subID] = struct{}{}
+	return false, ""
+}
+
+// forgetConnection has the shape of relay.OnDisconnect.
+func (lc *lifecycle) forgetConnection(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	lc.mu.Lock()
+	delete(lc.subs, ws)
+	lc.mu.Unlock()
+}
+
+// startShutdown flips the relay into closing mode: from here on beginWrite
+// and trackSubscription refuse new work.
+func (lc *lifecycle) startShutdown() {
+	lc.mu.Lock()
+	lc.closing = true
+	lc.mu.Unlock()
+}
+
+// drainWrites waits for in-flight writes to finish or ctx to expire.
+func (lc *lifecycle) drainWrites(ctx context.Context) error {
+	return waitGroup(ctx, &lc.writes)
+}
+
+// stopWorkers cancels the background workers and waits for them to return
+// or ctx to expire.
+func (lc *lifecycle) stopWorkers(ctx context.Context) error {
+	lc.stopWork()
+	return waitGroup(ctx, &lc.workers)
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeSubscriptions sends CLOSED for every tracked subscription and
+// returns how many were notified.
+func (lc *lifecycle) closeSubscriptions(reason string) int {
+	// snapshot under the lock, write without it: a slow client must not
+	// block OnDisconnect for everyone else.
+	type sub struct {
+		ws *khatru.WebSocket
+		id string
+	}
+	lc.mu.Lock()
+	var subs []sub
+	for ws, ids := range lc.subs {
+		for id := range ids {
+			subs = append(subs, sub{ws, id})
+		}
+	}
+	lc.mu.Unlock()
+
+	n := 0
+	for _, s := range subs {
+		if err := s.ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: s.id, Reason: reason}); err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+
+	bleve "github.com/blevesearch/bleve/v2"
+	standardAnalyzer "github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+)
+
+// similarExtension is the NIP-50 extension asking for stations like the one
+// at an address: "similar:31237:<pubkey>:<d>".
+const similarExtension = "similar"
+
+// maxSimilarTerms is how many of a station's most frequent words are
+// compared with other stations; more only adds noise from long
+// descriptions.
+const maxSimilarTerms = 25
+
+// How much each thing a station shares with the one it's compared to adds
+// to its score. Shared words are scored by bleve, so rare words count for
+// more than common ones; genres are counted per level of the taxonomy, so a
+// station in the same sub-genre beats one that only shares the parent.
+const (
+	similarGenreBoost   = 3
+	similarTagBoost     = 2
+	similarLangBoost    = 2
+	similarCountryBoost = 1.5
+)
+
+// similarProfile is what stationQuery.compile compares other stations with:
+// the station's own words and the attributes it can share.
+type similarProfile struct {
+	id        string
+	terms     []string
+	genres    []string
+	tags      []string
+	languages []string
+	country   string
+	streams   []string
+}
+
+// similarTo builds the profile of st, with its words run through the
+// index's analyzer so they compare with the indexed terms.
+func (s *stationSearch) similarTo(st station) *similarProfile {
+	doc := buildSearchDoc(st.Event)
+	p := &similarProfile{id: st.Event.ID.Hex(), country: st.CountryCode}
+	p.genres, _ = doc["genre_path"].([]string)
+	p.tags, _ = doc["tag"].([]string)
+	p.languages, _ = doc["lang"].([]string)
+	p.streams, _ = doc["stream"].([]string)
+
+	analyzer := s.index.Mapping().AnalyzerNamed(standardAnalyzer.Name)
+	freq := make(map[string]int)
+	for _, text := range []string{st.Name, st.Location, st.Description} {
+		for _, tok := range analyzer.Analyze([]byte(text)) {
+			if len(tok.Term) > 2 {
+				freq[string(tok.Term)]++
+			}
+		}
+	}
+	for term := range freq {
+		p.terms = append(p.terms, term)
+	}
+	// Most frequent first, then longest, which tends to be the most
+	// specific.
+	slices.SortFunc(p.terms, func(a, b string) int {
+		return cmp.Or(cmp.Compare(freq[b], freq[a]), cmp.Compare(len(b), len(a)), strings.Compare(a, b))
+	})
+	p.terms = p.terms[:min(len(p.terms), maxSimilarTerms)]
+	return p
+}
+
+// query matches stations sharing any of p's words, genres, languages or
+// country, scored by how much they share, without the station itself or
+// stations playing the same stream.
+func (p *similarProfile) query() bleveQuery.Query {
+	var should []bleveQuery.Query
+	for _, term := range p.terms {
+		for _, f := range searchFieldBoosts {
+			tq := bleve.NewTermQuery(term)
+			tq.SetField(f.field)
+			tq.SetBoost(f.boost)
+			should = append(should, tq)
+		}
+	}
+	boosted := func(field, value string, boost float64) {
+		tq := bleve.NewTermQuery(value)
+		tq.SetField(field)
+		tq.SetBoost(boost)
+		should = append(should, tq)
+	}
+	for _, g := range p.genres {
+		boosted("genre_path", g, similarGenreBoost)
+	}
+	for _, t := range p.tags {
+		boosted("tag", t, similarTagBoost)
+	}
+	for _, l := range p.languages {
+		boosted("lang", l, similarLangBoost)
+	}
+	if p.country != "" {
+		boosted("country", p.country, similarCountryBoost)
+	}
+
+	if len(should) == 0 {
+		// Nothing to compare with: a station with no text, genre, language
+		// or country is like no other.
+		return bleve.NewMatchNoneQuery()
+	}
+	bq := bleve.NewBooleanQuery()
+	bq.AddShould(should...)
+	bq.AddMustNot(bleve.NewDocIDQuery([]string{p.id}))
+	for _, u := range p.streams {
+		bq.AddMustNot(newKeywordTermQuery("stream", u))
+	}
+	return bq
+}
+
+// resolveSimilar looks up the station named by q.Text's similar:
+// extension and sets q.Similar to its profile. It reports false when the
+// extension names no station the relay has, so the search has no results.
+// Text without the extension is left alone.
+func (s *stationSearch) resolveSimilar(q *stationQuery) bool {
+	addrs := searchExtensions(q.Text, similarExtension)
+	if len(addrs) == 0 {
+		return true
+	}
+	kind, pk, d, ok := parseAddress(addrs[0])
+	if !ok || kind != indexedKind {
+		return false
+	}
+	evt, found := fetchAddress(s.rawStore, kind, pk, d)
+	if !found {
+		return false
+	}
+	q.Similar = s.similarTo(parseStation(evt))
+	return true
+}
+
+// handleSimilar is GET /api/stations/{pubkey}/{d}/similar?limit=: stations
+// like this one, most similar first. genre and country narrow the results
+// as on search.
+func (a *stationAPI) handleSimilar(w http.ResponseWriter, r *http.Request) {
+	pk, d, ok := stationPathParams(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	limit, err := queryInt(params.Get("limit"), defaultAPISearchLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	limit = min(limit, a.live.Load().Limits.MaxSearchLimit)
+
+	evt, found := fetchAddress(a.db, indexedKind, pk, d)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "station not found")
+		return
+	}
+	q := stationQuery{
+		Genres:    queryList(params["genre"]),
+		Countries: queryList(params["country"]),
+		Similar:   a.search.similarTo(parseStation(evt)),
+	}
+	events, _, err := a.search.Find(q, 0, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{"events": events})
+}
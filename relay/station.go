@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"fiatjaf.com/nostr/nip19"
+)
+
+// station is the parsed view of a kind-31237 event: the tags and content
+// fields the search index and the HTTP APIs care about. The signed event is
+// kept alongside so handlers can always return it verbatim.
+type station struct {
+	Event       nostr.Event
+	D           string
+	Name        string
+	Description string
+	Genres      []string
+	Languages   []string
+	CountryCode string
+	Location    string
+	Geohash     string
+	Thumbnail   string
+	Website     string
+	Streams     []stationStream
+}
+
+type stationStream struct {
+	URL     string `json:"url"`
+	Format  string `json:"format"`
+	Quality struct {
+		Bitrate    int    `json:"bitrate"`
+		Codec      string `json:"codec"`
+		SampleRate int    `json:"sampleRate"`
+	} `json:"quality"`
+	Primary bool `json:"primary"`
+}
+
+// parseStation never fails: a station with unparseable content still has
+// its tags, which is enough to index and list it.
+func parseStation(evt nostr.Event) station {
+	st := station{Event: evt, D: evt.Tags.GetD()}
+	if tag := evt.Tags.Find("name"); tag != nil {
+		st.Name = tag[1]
+	}
+	for tag := range evt.Tags.FindAll("c") {
+		if len(tag) >= 2 && tag[1] != "" {
+			st.Genres = append(st.Genres, tag[1])
+		}
+	}
+	for tag := range evt.Tags.FindAll("l") {
+		if len(tag) >= 2 && tag[1] != "" {
+			st.Languages = append(st.Languages, tag[1])
+		}
+	}
+	if tag := evt.Tags.Find("countryCode"); tag != nil {
+		st.CountryCode = strings.ToUpper(strings.TrimSpace(tag[1]))
+	}
+	if tag := evt.Tags.Find("location"); tag != nil {
+		st.Location = tag[1]
+	}
+	if tag := evt.Tags.Find("g"); tag != nil {
+		st.Geohash = tag[1]
+	}
+	if tag := evt.Tags.Find("thumbnail"); tag != nil {
+		st.Thumbnail = tag[1]
+	}
+	if tag := evt.Tags.Find("website"); tag != nil {
+		st.Website = tag[1]
+	}
+
+	var content struct {
+		Description string          `json:"description"`
+		Streams     []stationStream `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(evt.Content), &content); err == nil {
+		st.Description = content.Description
+		st.Streams = content.Streams
+	}
+	return st
+}
+
+// Address is the NIP-01 coordinate "31237:<pubkey>:<d>".
+func (st station) Address() string {
+	return stationAddress(st.Event.PubKey, st.D)
+}
+
+// primaryStream is the stream flagged primary, else the first one.
+func (st station) primaryStream() (stationStream, bool) {
+	for _, s := range st.Streams {
+		if s.Primary && s.URL != "" {
+			return s, true
+		}
+	}
+	for _, s := range st.Streams {
+		if s.URL != "" {
+			return s, true
+		}
+	}
+	return stationStream{}, false
+}
+
+// formatCodecs maps stream MIME types to codec names, for streams that
+// don't state quality.codec.
+var formatCodecs = map[string]string{
+	"audio/mpeg":  "MP3",
+	"audio/mp3":   "MP3",
+	"audio/aac":   "AAC",
+	"audio/aacp":  "AAC+",
+	"audio/ogg":   "OGG",
+	"audio/opus":  "OPUS",
+	"audio/flac":  "FLAC",
+	"audio/x-wav": "WAV",
+}
+
+// codec is the stream's codec in upper case, or "" if unknown.
+func (s stationStream) codec() string {
+	if c := strings.TrimSpace(s.Quality.Codec); c != "" {
+		return strings.ToUpper(c)
+	}
+	return formatCodecs[strings.ToLower(strings.TrimSpace(s.Format))]
+}
+
+// isHLS reports whether the stream is an HLS playlist rather than a plain
+// audio stream.
+func (s stationStream) isHLS() bool {
+	format := strings.ToLower(s.Format)
+	if strings.Contains(format, "mpegurl") {
+		return true
+	}
+	path := strings.ToLower(s.URL)
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	return strings.HasSuffix(path, ".m3u8")
+}
+
+// pageURL is the station's page in the web app at base.
+func (st station) pageURL(base string) string {
+	return strings.TrimRight(base, "/") + "/station/" + nip19.EncodeNaddr(st.Event.PubKey, indexedKind, st.D, nil)
+}
+
+// markdownMarks are stripped from descriptions shown outside the web app.
+var markdownMarks = strings.NewReplacer("**", "", "__", "", "*", "", "`", "", "#", "")
+
+// summary is the description as plain text, cut to at most n runes.
+func (st station) summary(n int) string {
+	text := strings.Join(strings.Fields(markdownMarks.Replace(st.Description)), " ")
+	if r := []rune(text); len(r) > n {
+		return strings.TrimSpace(string(r[:n-1])) + "…"
+	}
+	return text
+}
+
+func stationAddress(pk nostr.PubKey, d string) string {
+	return fmt.Sprintf("%d:%s:%s", indexedKind, pk.Hex(), d)
+}
+
+// parseAddress splits a "<kind>:<pubkey>:<d>" coordinate. The d part may
+// itself contain colons.
+func parseAddress(addr string) (kind nostr.Kind, pk nostr.PubKey, d string, ok bool) {
+	parts := strings.SplitN(addr, ":", 3)
+	if len(parts) != 3 {
+		return 0, pk, "", false
+	}
+	var k int
+	if _, err := fmt.Sscanf(parts[0], "%d", &k); err != nil || k < 0 || k > 65535 {
+		return 0, pk, "", false
+	}
+	pk, err := nostr.PubKeyFromHex(parts[1])
+	if err != nil {
+		return 0, pk, "", false
+	}
+	return nostr.Kind(k), pk, parts[2], true
+}
+
+// addressFilter selects the current event at an addressable coordinate.
+func addressFilter(kind nostr.Kind, pk nostr.PubKey, d string) nostr.Filter {
+	return nostr.Filter{
+		Kinds:   []nostr.Kind{kind},
+		Authors: []nostr.PubKey{pk},
+		Tags:    nostr.TagMap{"d": []string{d}},
+	}
+}
+
+// fetchAddress returns the current event at a coordinate, if LMDB has one.
+func fetchAddress(store eventstore.Store, kind nostr.Kind, pk nostr.PubKey, d string) (nostr.Event, bool) {
+	for evt := range store.QueryEvents(addressFilter(kind, pk, d), 1) {
+		return evt, true
+	}
+	return nostr.Event{}, false
+}
+
+// fetchReplaced returns the event evt would replace, if LMDB has one: the
+// same address for addressable kinds, the same kind and author for the
+// other replaceable ones.
+func fetchReplaced(store eventstore.Store, evt nostr.Event) (nostr.Event, bool) {
+	if evt.Kind.IsAddressable() {
+		return fetchAddress(store, evt.Kind, evt.PubKey, evt.Tags.GetD())
+	}
+	for prior := range store.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{evt.Kind}, Authors: []nostr.PubKey{evt.PubKey}}, 1) {
+		return prior, true
+	}
+	return nostr.Event{}, false
+}
+
+// fetchEvent returns the event with id, if LMDB has it.
+func fetchEvent(store eventstore.Store, id nostr.ID) (nostr.Event, bool) {
+	for evt := range store.QueryEvents(nostr.Filter{IDs: []nostr.ID{id}}, 1) {
+		return evt, true
+	}
+	return nostr.Event{}, false
+}
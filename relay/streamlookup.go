@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	bleve "github.com/blevesearch/bleve/v2"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+)
+
+// streamQuery matches stations by one of their streams. A URL, with or
+// without its scheme, matches stations playing that stream, compared by
+// streamKey so http/https, "www.", tokens and mirror hosts don't matter. A
+// bare host matches every station with a stream on it, on any port.
+func streamQuery(v string) bleveQuery.Query {
+	v = strings.TrimSpace(v)
+	if !strings.Contains(v, "://") {
+		if !strings.Contains(v, "/") {
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			if v == "" {
+				return bleve.NewMatchNoneQuery()
+			}
+			return newKeywordTermQuery("stream_host", streamHost(v))
+		}
+		v = "http://" + v
+	}
+	key := streamKey(v)
+	if key == "" {
+		return bleve.NewMatchNoneQuery()
+	}
+	return newKeywordTermQuery("stream", key)
+}
+
+// handleByStream is GET /api/stations/by-stream?url=|host=&limit=: the
+// stations playing a stream URL, or with a stream on a host, newest first.
+// Each station comes with its address, so callers that only know a stream
+// can name the station it belongs to.
+func (a *stationAPI) handleByStream(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	raw, host := params.Get("url"), params.Get("host")
+	if (raw == "") == (host == "") {
+		writeJSONError(w, http.StatusBadRequest, "exactly one of url and host is required")
+		return
+	}
+	if raw != "" {
+		if u, err := url.Parse(raw); err != nil || (u.Host == "" && !strings.Contains(raw, "/")) {
+			writeJSONError(w, http.StatusBadRequest, "url must be a stream URL")
+			return
+		}
+	} else if strings.Contains(host, "/") {
+		writeJSONError(w, http.StatusBadRequest, "host must be a host name")
+		return
+	}
+	limit, err := queryInt(params.Get("limit"), defaultAPISearchLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	limit = min(limit, a.live.Load().Limits.MaxSearchLimit)
+
+	events, total, err := a.search.Find(stationQuery{Streams: []string{cmp.Or(raw, host)}}, 0, limit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+	stations := make([]duplicateStation, len(events))
+	for i, evt := range events {
+		st := parseStation(evt)
+		stations[i] = duplicateStation{Address: st.Address(), Name: st.Name, ID: evt.ID.Hex()}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":    total,
+		"stations": stations,
+		"events":   events,
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	bleve "github.com/blevesearch/bleve/v2"
+)
+
+func TestStreamQuery(t *testing.T) {
+	idx, err := bleve.NewMemOnly(newStationIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	docs := map[string][]string{
+		"groovesalad": {"https://ice2.somafm.com/groovesalad-256-mp3", "http://ice4.somafm.com/groovesalad-128-aac"},
+		"dronezone":   {"https://ice1.somafm.com/dronezone-256-mp3"},
+		"local":       {"http://radio.example.com:8000/live", "http://radio.example.com/mobile"},
+		"other":       {"http://stream.example.org/live"},
+		"play1":       {"http://radio.example.net/play.php?id=1"},
+		"play2":       {"http://radio.example.net/play.php?id=2"},
+	}
+	for id, urls := range docs {
+		st := station{}
+		for _, u := range urls {
+			st.Streams = append(st.Streams, stationStream{URL: u})
+		}
+		doc := map[string]any{"stream": stationStreamKeys(st), "stream_host": stationStreamHosts(st)}
+		if err := idx.Index(id, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		v    string
+		want []string
+	}{
+		{"http://ice6.somafm.com/groovesalad-256-mp3?token=x", []string{"groovesalad"}},
+		{"ice1.somafm.com/dronezone-256-mp3", []string{"dronezone"}},
+		{"https://radio.example.com:8000/live/", []string{"local"}},
+		{"http://radio.example.com/live", nil},
+		{"somafm.com", []string{"dronezone", "groovesalad"}},
+		{"WWW.Radio.Example.com:8000", []string{"local"}},
+		{" stream.example.org ", []string{"other"}},
+		{"example.com", nil},
+		{"https://radio.example.net/play.php?token=x&id=2", []string{"play2"}},
+		{"http://radio.example.net/play.php", nil},
+		{"radio.example.net", []string{"play1", "play2"}},
+		{":8000", nil},
+		{"http:///nohost", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			res, err := idx.Search(bleve.NewSearchRequestOptions(streamQuery(tt.v), 10, 0, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, hit := range res.Hits {
+				got = append(got, hit.ID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the stream: search field is the same lookup
+	q, err := compileSearchText("stream:somafm.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Search(bleve.NewSearchRequestOptions(q, 10, 0, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 {
+		t.Errorf("stream:somafm.com matched %d stations, want 2", res.Total)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+	"github.com/blevesearch/vellum"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// suggestRebuildCheck is how often the suggester looks for station
+	// changes to rebuild for. It waits until no station has been written
+	// for suggestSettle, so an import doesn't rebuild every tick;
+	// suggestMaxAge rebuilds regardless, so favorites counts stay current
+	// and a long import still shows up.
+	suggestRebuildCheck = 30 * time.Second
+	suggestSettle       = 30 * time.Second
+	suggestMaxAge       = 10 * time.Minute
+
+	defaultSuggestLimit = 8
+	maxSuggestLimit     = 20
+	// suggestHeavyPrefix is how many keys a prefix may match before its
+	// best completions are worked out at build time instead of per
+	// request, so a one-letter prefix stays as fast as a long one.
+	suggestHeavyPrefix = 1_000
+)
+
+// suggester answers typeahead queries from in-memory FSTs of station names
+// and genres, without touching bleve or LMDB. Every word-suffix of a name is
+// a key ("somafm drone zone", "drone zone", "zone"), so typing any word of a
+// name finds it. Stations are ranked by favorites, taken from the HLL
+// registers; genres by how many stations carry them.
+//
+// The FSTs are rebuilt in the background from LMDB once station writes
+// have settled, checked every suggestRebuildCheck, and at least every
+// suggestMaxAge.
+type suggester struct {
+	db     eventstore.Store
+	counts *hllCounts
+
+	index atomic.Pointer[suggestIndex]
+	dirty atomic.Bool
+	// lastChange is when a station was last written, in Unix nanoseconds.
+	lastChange atomic.Int64
+	// mu serialises rebuilds.
+	mu sync.Mutex
+}
+
+type suggestIndex struct {
+	builtAt time.Time
+
+	names    *suggestFST
+	stations []stationSuggestion
+
+	genres    *suggestFST
+	genreList []genreSuggestion
+}
+
+// suggestFST maps keys to groups of members, stations or genres, each with
+// a rank: 0 is the best.
+type suggestFST struct {
+	fst *vellum.FST
+	// groups[v] are the members whose key maps to FST value v.
+	groups [][]int32
+	rank   []int32
+	// top holds the best maxSuggestLimit members, best first, of every
+	// prefix matching more than suggestHeavyPrefix keys.
+	top map[string][]int32
+}
+
+type stationSuggestion struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Favorites uint32 `json:"favorites"`
+}
+
+type genreSuggestion struct {
+	Name     string `json:"name"`
+	Stations int    `json:"stations"`
+}
+
+func newSuggester(db eventstore.Store, counts *hllCounts) *suggester {
+	s := &suggester{db: db, counts: counts}
+	s.dirty.Store(true)
+	return s
+}
+
+// observe marks the index stale when a station is written or deleted.
+func (s *suggester) observe(evt nostr.Event) {
+	if evt.Kind == indexedKind {
+		s.lastChange.Store(time.Now().UnixNano())
+		s.dirty.Store(true)
+	}
+}
+
+// run builds the index and keeps it fresh until ctx is done.
+func (s *suggester) run(ctx context.Context) {
+	ticker := time.NewTicker(suggestRebuildCheck)
+	defer ticker.Stop()
+	for {
+		idx := s.index.Load()
+		settled := time.Since(time.Unix(0, s.lastChange.Load())) >= suggestSettle
+		if idx == nil || time.Since(idx.builtAt) > suggestMaxAge || (s.dirty.Load() && settled) {
+			s.rebuild()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *suggester) rebuild() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty.Store(false)
+	start := time.Now()
+
+	var stations []stationSuggestion
+	nameKeys := make(map[string][]int32)
+	genreStations := make(map[string]map[string]int) // folded → display name → count
+	tax := taxonomy()
+	for evt := range s.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{indexedKind}}, maxDirectoryStations) {
+		st := parseStation(evt)
+		if st.Name == "" {
+			continue
+		}
+		i := int32(len(stations))
+		stations = append(stations, stationSuggestion{Name: st.Name, Address: st.Address()})
+		words := strings.Fields(foldSuggest(st.Name))
+		for j := range words {
+			key := strings.Join(words[j:], " ")
+			if g := nameKeys[key]; len(g) == 0 || g[len(g)-1] != i {
+				nameKeys[key] = append(g, i)
+			}
+		}
+		for _, g := range st.Genres {
+			// Spellings the taxonomy knows are suggested as their genre.
+			if c, ok := tax.canonicalize(g); ok {
+				g = c
+			}
+			key := strings.Join(strings.Fields(foldSuggest(g)), " ")
+			if key == "" {
+				continue
+			}
+			if genreStations[key] == nil {
+				genreStations[key] = make(map[string]int)
+			}
+			genreStations[key][strings.TrimSpace(g)]++
+		}
+	}
+
+	addrs := make([]string, len(stations))
+	for i, st := range stations {
+		addrs[i] = st.Address
+	}
+	for i, n := range s.counts.estimates(listKind, "a", addrs) {
+		stations[i].Favorites = n
+	}
+
+	idx := &suggestIndex{builtAt: time.Now(), stations: stations}
+	stationRank := suggestRanks(len(stations), func(a, b int32) int {
+		x, y := stations[a], stations[b]
+		return cmp.Or(cmp.Compare(y.Favorites, x.Favorites), cmp.Compare(len(x.Name), len(y.Name)), strings.Compare(x.Name, y.Name))
+	})
+	var err error
+	if idx.names, err = buildSuggestFST(nameKeys, stationRank); err != nil {
+		slog.Warn("failed to build station name suggestions", "err", err)
+		return
+	}
+
+	// Each genre is shown in its most common spelling.
+	genreKeys := make(map[string][]int32, len(genreStations))
+	for key, spellings := range genreStations {
+		g := genreSuggestion{}
+		for name, n := range spellings {
+			g.Stations += n
+			if n > spellings[g.Name] || (n == spellings[g.Name] && name < g.Name) {
+				g.Name = name
+			}
+		}
+		genreKeys[key] = []int32{int32(len(idx.genreList))}
+		idx.genreList = append(idx.genreList, g)
+	}
+	genreRank := suggestRanks(len(idx.genreList), func(a, b int32) int {
+		x, y := idx.genreList[a], idx.genreList[b]
+		return cmp.Or(cmp.Compare(y.Stations, x.Stations), strings.Compare(x.Name, y.Name))
+	})
+	if idx.genres, err = buildSuggestFST(genreKeys, genreRank); err != nil {
+		slog.Warn("failed to build genre suggestions", "err", err)
+		return
+	}
+
+	s.index.Store(idx)
+	slog.Debug("rebuilt suggestions", "stations", len(stations), "genres", len(idx.genreList),
+		"took", time.Since(start).Round(time.Millisecond))
+}
+
+// suggestRanks ranks n members by compare: rank[i] is member i's position
+// in sorted order.
+func suggestRanks(n int, compare func(a, b int32) int) []int32 {
+	order := make([]int32, n)
+	for i := range order {
+		order[i] = int32(i)
+	}
+	slices.SortFunc(order, compare)
+	rank := make([]int32, n)
+	for r, i := range order {
+		rank[i] = int32(r)
+	}
+	return rank
+}
+
+// buildSuggestFST builds an FST over keys whose values index the groups,
+// and the top completions of its heavy prefixes.
+func buildSuggestFST(keys map[string][]int32, rank []int32) (*suggestFST, error) {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	slices.Sort(sorted)
+
+	var buf bytes.Buffer
+	b, err := vellum.New(&buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	f := &suggestFST{groups: make([][]int32, 0, len(sorted)), rank: rank}
+	for _, k := range sorted {
+		if err := b.Insert([]byte(k), uint64(len(f.groups))); err != nil {
+			return nil, err
+		}
+		f.groups = append(f.groups, keys[k])
+	}
+	if err := b.Close(); err != nil {
+		return nil, err
+	}
+	if f.fst, err = vellum.Load(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	f.top = f.heavyPrefixes(sorted)
+	return f, nil
+}
+
+// heavyPrefixes works out the best maxSuggestLimit members of every prefix
+// of sorted matching more than suggestHeavyPrefix keys. The keys sharing a
+// prefix are consecutive, so one pass keeps a running top list per prefix
+// length of the current key and settles it when the next key no longer
+// shares that prefix.
+func (f *suggestFST) heavyPrefixes(sorted []string) map[string][]int32 {
+	type open struct {
+		keys int
+		best []int32
+	}
+	top := make(map[string][]int32)
+	var stack []open // stack[l] is the prefix of length l+1
+	prev := ""
+	settle := func(shared int) {
+		for l := len(stack) - 1; l >= shared; l-- {
+			if stack[l].keys > suggestHeavyPrefix {
+				top[prev[:l+1]] = stack[l].best
+			}
+		}
+		stack = stack[:min(shared, len(stack))]
+	}
+	for v, key := range sorted {
+		shared := 0
+		for shared < min(len(prev), len(key)) && prev[shared] == key[shared] {
+			shared++
+		}
+		settle(shared)
+		for len(stack) < len(key) {
+			stack = append(stack, open{})
+		}
+		for l := range stack {
+			stack[l].keys++
+			for _, i := range f.groups[v] {
+				stack[l].best = f.insertRanked(stack[l].best, i, maxSuggestLimit)
+			}
+		}
+		prev = key
+	}
+	settle(0)
+	return top
+}
+
+// insertRanked adds member i to best, kept in rank order and at most limit
+// long, unless it is already there.
+func (f *suggestFST) insertRanked(best []int32, i int32, limit int) []int32 {
+	if slices.Contains(best, i) || (len(best) == limit && f.rank[i] >= f.rank[best[limit-1]]) {
+		return best
+	}
+	pos, _ := slices.BinarySearchFunc(best, i, func(a, b int32) int { return cmp.Compare(f.rank[a], f.rank[b]) })
+	best = slices.Insert(best, pos, i)
+	return best[:min(len(best), limit)]
+}
+
+// complete returns the best limit members of the keys starting with
+// prefix, best first.
+func (f *suggestFST) complete(prefix string, limit int) []int32 {
+	if best, ok := f.top[prefix]; ok {
+		return best[:min(limit, len(best))]
+	}
+	var best []int32
+	itr, err := f.fst.Iterator([]byte(prefix), prefixEnd([]byte(prefix)))
+	for err == nil {
+		_, v := itr.Current()
+		for _, i := range f.groups[v] {
+			best = f.insertRanked(best, i, limit)
+		}
+		err = itr.Next()
+	}
+	return best
+}
+
+// prefixEnd is the first key after every key starting with prefix, or nil
+// when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// suggest returns the limit most favourited stations and most common
+// genres with a key starting with q.
+func (s *suggester) suggest(q string, limit int) ([]stationSuggestion, []genreSuggestion) {
+	idx := s.index.Load()
+	prefix := strings.Join(strings.Fields(foldSuggest(q)), " ")
+	stations, genres := []stationSuggestion{}, []genreSuggestion{}
+	if idx == nil || prefix == "" {
+		return stations, genres
+	}
+
+	for _, i := range idx.names.complete(prefix, limit) {
+		stations = append(stations, idx.stations[i])
+	}
+	for _, i := range idx.genres.complete(prefix, limit) {
+		genres = append(genres, idx.genreList[i])
+	}
+	return stations, genres
+}
+
+// handleSuggest is GET /api/suggest?q=&limit=: typeahead for the search
+// box. Each word of a station name is matched as a prefix, so "zon" finds
+// "Drone Zone".
+func (s *suggester) handleSuggest(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, err := queryInt(params.Get("limit"), defaultSuggestLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	stations, genres := s.suggest(params.Get("q"), min(limit, maxSuggestLimit))
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"stations": stations,
+		"genres":   genres,
+	})
+}
+
+// foldSuggest lower-cases s and strips diacritics, so "Café" completes
+// "cafe" and the other way round.
+func foldSuggest(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSuggestComplete(t *testing.T) {
+	// enough keys on a small alphabet that short prefixes are heavy
+	rng := rand.New(rand.NewPCG(3, 4))
+	const members = 10_000
+	keys := make(map[string][]int32)
+	for i := range int32(members) {
+		for range 1 + rng.IntN(3) {
+			var b strings.Builder
+			for range 1 + rng.IntN(6) {
+				b.WriteByte("abcd "[rng.IntN(5)])
+			}
+			k := b.String()
+			if !slices.Contains(keys[k], i) {
+				keys[k] = append(keys[k], i)
+			}
+		}
+	}
+	favorites := make([]int, members)
+	for i := range favorites {
+		favorites[i] = rng.IntN(50)
+	}
+	rank := suggestRanks(members, func(a, b int32) int {
+		return cmp.Or(cmp.Compare(favorites[b], favorites[a]), cmp.Compare(a, b))
+	})
+	f, err := buildSuggestFST(keys, rank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.top) == 0 {
+		t.Fatal("no heavy prefixes; the test doesn't cover them")
+	}
+
+	brute := func(prefix string, limit int) []int32 {
+		var all []int32
+		for k, group := range keys {
+			if strings.HasPrefix(k, prefix) {
+				for _, i := range group {
+					if !slices.Contains(all, i) {
+						all = append(all, i)
+					}
+				}
+			}
+		}
+		slices.SortFunc(all, func(a, b int32) int { return cmp.Compare(rank[a], rank[b]) })
+		return all[:min(limit, len(all))]
+	}
+	prefixes := []string{"", "zz", "a b c d"}
+	for _, a := range "abcd " {
+		prefixes = append(prefixes, string(a))
+		for _, b := range "abcd " {
+			prefixes = append(prefixes, string(a)+string(b), string(a)+string(b)+"c")
+		}
+	}
+	for _, prefix := range prefixes {
+		for _, limit := range []int{1, defaultSuggestLimit, maxSuggestLimit} {
+			got, want := f.complete(prefix, limit), brute(prefix, limit)
+			if !slices.Equal(got, want) {
+				_, heavy := f.top[prefix]
+				t.Errorf("complete(%q, %d) = %v, want %v (heavy: %v)", prefix, limit, got, want, heavy)
+			}
+		}
+	}
+}
+
+func TestSuggestRanks(t *testing.T) {
+	scores := []int{5, 9, 1, 9}
+	rank := suggestRanks(len(scores), func(a, b int32) int {
+		return cmp.Or(cmp.Compare(scores[b], scores[a]), cmp.Compare(a, b))
+	})
+	if want := []int32{2, 0, 3, 1}; !slices.Equal(rank, want) {
+		t.Errorf("ranks = %v, want %v", rank, want)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []byte
+	}{
+		{"abc", []byte("abd")},
+		{"a\xff", []byte("b")},
+		{"\xff\xff", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd([]byte(tt.prefix)); !slices.Equal(got, tt.want) {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestFoldSuggest(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Café Del Mar", "cafe del mar"},
+		{"RÁDIO Ñandú", "radio nandu"},
+		{"Ørsted FM", "ørsted fm"},
+		{"Радио Рекорд", "радио рекорд"},
+	}
+	for _, tt := range tests {
+		if got := foldSuggest(tt.in); got != tt.want {
+			t.Errorf("foldSuggest(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
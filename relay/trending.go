@@ -0,0 +1,429 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"fiatjaf.com/nostr/eventstore"
+)
+
+const (
+	reactionKind = nostr.Kind(7)
+	// commentKind is the NIP-22 comment, which names the station it's on
+	// in an `A` (root) or `a` (parent) tag.
+	commentKind = nostr.Kind(1111)
+	// rankingKind is the ranking snapshot the observer publishes too (see
+	// docs/STATION_OBSERVABILITY_PLAN.md).
+	rankingKind = nostr.Kind(31240)
+
+	trendingMetric = "trending"
+	// maxTrendingSize is the most entries a ranking snapshot may hold.
+	maxTrendingSize = 50
+	// trendingHorizon is how many half-lives an interaction counts for;
+	// after ten it is worth less than a thousandth of its weight.
+	trendingHorizon = 10
+	// minTrendingScore is the score below which a station is forgotten.
+	minTrendingScore    = 0.001
+	maxTrendingBackfill = 1_000_000
+	// trendingCheck is how often run prunes, looks for a reload that turned
+	// trending on, and checks whether a ranking is due.
+	trendingCheck = time.Minute
+)
+
+// trendingKinds are the interactions that make a station trend.
+var trendingKinds = []nostr.Kind{reactionKind, zapReceiptKind, listKind, commentKind}
+
+// trendingEngine scores stations by recent interactions: reactions, zaps,
+// additions to favorites lists and comments. Each interaction adds its
+// kind's weight, which then halves every trending.half_life, so a station
+// liked by twenty people this morning outranks one liked by a hundred last
+// month. Each author counts once per station and kind, so reacting again or
+// re-saving a favorites list doesn't add more.
+//
+// Scores live in memory, rebuilt from LMDB over the last trendingHorizon
+// half-lives at startup, and again when a reload turns trending on, since
+// nothing is counted while it is off.
+type trendingEngine struct {
+	db   eventstore.Store
+	live *liveConfig
+
+	mu     sync.Mutex
+	scores map[string]trendingScore
+	// seen is when each kind:author:station interaction was counted. run
+	// prunes entries past the horizon every trendingCheck, whether or not
+	// rankings are published, so until then an old interaction may linger
+	// for up to a minute.
+	seen map[string]nostr.Timestamp
+
+	// publish stores and broadcasts a signed ranking; see main.
+	publish  func(context.Context, nostr.Event) error
+	relayKey nostr.SecretKey
+	// lastPublished avoids two snapshots in the same second, which LMDB
+	// would not replace.
+	lastPublished nostr.Timestamp
+}
+
+// trendingScore is a score as of a time; it decays from there.
+type trendingScore struct {
+	value float64
+	at    nostr.Timestamp
+}
+
+type trendingEntry struct {
+	Address string  `json:"address"`
+	Score   float64 `json:"score"`
+}
+
+func newTrendingEngine(db eventstore.Store, live *liveConfig, relayKey nostr.SecretKey) *trendingEngine {
+	return &trendingEngine{
+		db:       db,
+		live:     live,
+		relayKey: relayKey,
+		scores:   make(map[string]trendingScore),
+		seen:     make(map[string]nostr.Timestamp),
+	}
+}
+
+// decay is how much of a score is left after d seconds.
+func decay(d float64, halfLife time.Duration) float64 {
+	return math.Exp2(-d / halfLife.Seconds())
+}
+
+// Backfill scores the interactions already in LMDB within the horizon.
+// Interactions already counted are skipped, so running it again only adds
+// what was missed. It gives up when ctx ends.
+func (t *trendingEngine) Backfill(ctx context.Context) {
+	cfg := t.live.Load().Trending
+	if !cfg.Enabled {
+		return
+	}
+	start := time.Now()
+	halfLife := cfg.HalfLife.Duration
+	since := nostr.Now() - nostr.Timestamp(trendingHorizon*halfLife.Seconds())
+	n := 0
+	for _, kind := range trendingKinds {
+		for evt := range t.db.QueryEvents(nostr.Filter{Kinds: []nostr.Kind{kind}, Since: since}, maxTrendingBackfill) {
+			if ctx.Err() != nil {
+				return
+			}
+			t.observe(evt)
+			n++
+		}
+	}
+	t.mu.Lock()
+	stations := len(t.scores)
+	t.mu.Unlock()
+	slog.Info("built trending scores", "events", n, "stations", stations,
+		"took", time.Since(start).Round(time.Millisecond))
+}
+
+// observe counts evt if it is an interaction with one or more stations.
+func (t *trendingEngine) observe(evt nostr.Event) {
+	cfg := t.live.Load().Trending
+	if !cfg.Enabled {
+		return
+	}
+	var weight float64
+	author := evt.PubKey
+	var targets []string
+	var times []nostr.Timestamp
+	switch evt.Kind {
+	case reactionKind:
+		// "-" is a dislike.
+		if evt.Content == "-" {
+			return
+		}
+		weight = cfg.ReactionWeight
+		targets = stationTargets(evt, "a")
+	case zapReceiptKind:
+		weight = cfg.ZapWeight
+		author = zapSender(evt)
+		targets = stationTargets(evt, "a")
+	case commentKind:
+		weight = cfg.CommentWeight
+		targets = stationTargets(evt, "A", "a")
+	case listKind:
+		if isNIP05Registration(evt) {
+			return
+		}
+		l := parseStationList(evt)
+		if l.Label == featuredListLabel {
+			return
+		}
+		weight = cfg.FavoriteWeight
+		for _, e := range l.Entries {
+			targets = append(targets, e.Address)
+			// A favorites entry's fifth element is when it was added.
+			added := nostr.Timestamp(e.Order)
+			if added <= 0 || added > evt.CreatedAt {
+				added = evt.CreatedAt
+			}
+			times = append(times, added)
+		}
+	default:
+		return
+	}
+	if weight == 0 || len(targets) == 0 {
+		return
+	}
+
+	now := nostr.Now()
+	horizon := now - nostr.Timestamp(trendingHorizon*cfg.HalfLife.Seconds())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, addr := range targets {
+		at := evt.CreatedAt
+		if times != nil {
+			at = times[i]
+		}
+		if at > now {
+			at = now
+		}
+		if at < horizon {
+			continue
+		}
+		// A re-saved favorites list repeats every entry; only additions
+		// are new.
+		key := strconv.Itoa(int(evt.Kind)) + ":" + author.Hex() + ":" + addr
+		if _, ok := t.seen[key]; ok {
+			continue
+		}
+		t.seen[key] = at
+
+		s := t.scores[addr]
+		if at >= s.at {
+			s.value = s.value*decay(float64(at-s.at), cfg.HalfLife.Duration) + weight
+			s.at = at
+		} else {
+			s.value += weight * decay(float64(s.at-at), cfg.HalfLife.Duration)
+		}
+		t.scores[addr] = s
+	}
+}
+
+// zapRequestKind is the NIP-57 zap request a receipt carries in its
+// description tag.
+const zapRequestKind = nostr.Kind(9734)
+
+// zapSender is who sent a zap receipt: the author of the zap request in its
+// "description" tag, rather than the receipt's signer, which is the
+// recipient's lightning service and the same for every zap. The request is
+// only believed if its signature checks out; otherwise anyone could mint
+// receipts naming as many zappers as they like, so the zap counts for the
+// signer. Trending counts zaps per sender; NIP-45 registers use the signer
+// like every other event.
+func zapSender(evt nostr.Event) nostr.PubKey {
+	tag := evt.Tags.Find("description")
+	if tag == nil {
+		return evt.PubKey
+	}
+	var req nostr.Event
+	if err := json.Unmarshal([]byte(tag[1]), &req); err != nil {
+		return evt.PubKey
+	}
+	if req.Kind != zapRequestKind || !req.CheckID() || !req.VerifySignature() {
+		return evt.PubKey
+	}
+	return req.PubKey
+}
+
+// stationTargets are the station addresses in evt's tags of the given
+// names, without repeats.
+func stationTargets(evt nostr.Event, names ...string) []string {
+	prefix := strconv.Itoa(int(indexedKind)) + ":"
+	var out []string
+	for _, name := range names {
+		for tag := range evt.Tags.FindAll(name) {
+			if len(tag) >= 2 && strings.HasPrefix(tag[1], prefix) && !slices.Contains(out, tag[1]) {
+				out = append(out, tag[1])
+			}
+		}
+	}
+	return out
+}
+
+// top returns every station's score as of now, highest first, forgetting
+// stations whose score has decayed away.
+func (t *trendingEngine) top() []trendingEntry {
+	halfLife := t.live.Load().Trending.HalfLife.Duration
+	now := nostr.Now()
+
+	t.mu.Lock()
+	entries := make([]trendingEntry, 0, len(t.scores))
+	for addr, s := range t.scores {
+		v := s.value * decay(float64(now-s.at), halfLife)
+		if v < minTrendingScore {
+			delete(t.scores, addr)
+			continue
+		}
+		entries = append(entries, trendingEntry{Address: addr, Score: v})
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b trendingEntry) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), strings.Compare(a.Address, b.Address))
+	})
+	return entries
+}
+
+// prune forgets interactions older than the horizon; they no longer
+// count, so the same author may count again.
+func (t *trendingEngine) prune() {
+	halfLife := t.live.Load().Trending.HalfLife.Duration
+	horizon := nostr.Now() - nostr.Timestamp(trendingHorizon*halfLife.Seconds())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, at := range t.seen {
+		if at < horizon {
+			delete(t.seen, key)
+		}
+	}
+}
+
+// trending returns up to limit stations the relay still has, with their
+// events, highest score first.
+func (t *trendingEngine) trending(limit int) ([]trendingEntry, []nostr.Event) {
+	var entries []trendingEntry
+	var events []nostr.Event
+	for _, e := range t.top() {
+		if len(entries) == limit {
+			break
+		}
+		kind, pk, d, ok := parseAddress(e.Address)
+		if !ok {
+			continue
+		}
+		if evt, found := fetchAddress(t.db, kind, pk, d); found {
+			e.Score = math.Round(e.Score*1000) / 1000
+			entries = append(entries, e)
+			events = append(events, evt)
+		}
+	}
+	return entries, events
+}
+
+// run keeps the scores current and publishes the ranking every
+// trending.publish_interval until ctx is done. Every trendingCheck it prunes
+// seen and, if a reload has turned trending on, backfills what was missed
+// while it was off. Config changes take effect at the next check.
+func (t *trendingEngine) run(ctx context.Context) {
+	enabled := t.live.Load().Trending.Enabled
+	lastPublished := time.Now()
+	ticker := time.NewTicker(trendingCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.prune()
+		cfg := t.live.Load().Trending
+		if cfg.Enabled && !enabled {
+			slog.Info("trending enabled by reload, backfilling scores")
+			t.Backfill(ctx)
+		}
+		enabled = cfg.Enabled
+		if !cfg.Enabled || cfg.PublishInterval.Duration <= 0 || time.Since(lastPublished) < cfg.PublishInterval.Duration {
+			continue
+		}
+		lastPublished = time.Now()
+		if err := t.publishRanking(ctx); err != nil {
+			slog.Warn("failed to publish trending ranking", "err", err)
+		}
+	}
+}
+
+// trendingWindow names the ranking by its half-life, as "24h" or "7d".
+func trendingWindow(halfLife time.Duration) string {
+	if halfLife >= 48*time.Hour && halfLife%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", halfLife/(24*time.Hour))
+	}
+	if halfLife%time.Hour == 0 {
+		return fmt.Sprintf("%dh", halfLife/time.Hour)
+	}
+	return fmt.Sprintf("%dm", halfLife/time.Minute)
+}
+
+// publishRanking signs the current ranking as a kind-31240 snapshot,
+// d "trending:<window>", in the shape the landing page already reads. It
+// expires after two publish intervals, so a stopped relay's ranking doesn't
+// linger. Nothing is published while no station is trending.
+func (t *trendingEngine) publishRanking(ctx context.Context) error {
+	cfg := t.live.Load().Trending
+	entries, _ := t.trending(cfg.Size)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	type rankingEntry struct {
+		StationAddress string  `json:"stationAddress"`
+		Value          float64 `json:"value"`
+	}
+	now := nostr.Now()
+	if now <= t.lastPublished {
+		now = t.lastPublished + 1
+	}
+	window := trendingWindow(cfg.HalfLife.Duration)
+	snapshot := struct {
+		Metric      string         `json:"metric"`
+		Window      string         `json:"window"`
+		GeneratedAt int64          `json:"generatedAt"`
+		Entries     []rankingEntry `json:"entries"`
+	}{Metric: trendingMetric, Window: window, GeneratedAt: int64(now)}
+	tags := nostr.Tags{
+		{"d", trendingMetric + ":" + window},
+		{"metric", trendingMetric},
+		{"window", window},
+	}
+	for _, e := range entries {
+		snapshot.Entries = append(snapshot.Entries, rankingEntry{StationAddress: e.Address, Value: e.Score})
+		tags = append(tags, nostr.Tag{"a", e.Address})
+	}
+	expires := now + nostr.Timestamp(2*cfg.PublishInterval.Seconds())
+	tags = append(tags, nostr.Tag{"expiration", strconv.FormatInt(int64(expires), 10)}, nostr.Tag{"t", "wavefunc"})
+
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	evt := nostr.Event{Kind: rankingKind, CreatedAt: now, Tags: tags, Content: string(content)}
+	if err := evt.Sign(t.relayKey); err != nil {
+		return err
+	}
+	if err := t.publish(ctx, evt); err != nil {
+		return err
+	}
+	t.lastPublished = now
+	return nil
+}
+
+// handleTrending is GET /api/trending?limit=: the stations trending now,
+// with their scores and events in the same order.
+func (t *trendingEngine) handleTrending(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r.URL.Query().Get("limit"), defaultAPISearchLimit)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	entries, events := t.trending(min(limit, maxTrendingSize))
+	if entries == nil {
+		entries, events = []trendingEntry{}, []nostr.Event{}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"stations": entries,
+		"events":   events,
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+func TestZapSender(t *testing.T) {
+	zapper, service := nostr.Generate(), nostr.Generate()
+	request := func(kind nostr.Kind) string {
+		req := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", service.Public().Hex()}}}
+		if err := req.Sign(zapper); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := json.Marshal(req)
+		return string(raw)
+	}
+	forged := func() string {
+		req := nostr.Event{Kind: zapRequestKind, CreatedAt: nostr.Now()}
+		req.Sign(service)
+		req.PubKey = zapper.Public()
+		raw, _ := json.Marshal(req)
+		return string(raw)
+	}()
+
+	tests := []struct {
+		name string
+		tags nostr.Tags
+		want nostr.PubKey
+	}{
+		{"signed request", nostr.Tags{{"description", request(zapRequestKind)}}, zapper.Public()},
+		{"no description", nostr.Tags{{"P", zapper.Public().Hex()}}, service.Public()},
+		{"not json", nostr.Tags{{"description", "{"}}, service.Public()},
+		{"not a zap request", nostr.Tags{{"description", request(1)}}, service.Public()},
+		{"forged request", nostr.Tags{{"description", forged}, {"P", zapper.Public().Hex()}}, service.Public()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := nostr.Event{Kind: zapReceiptKind, PubKey: service.Public(), Tags: tt.tags}
+			if got := zapSender(receipt); got != tt.want {
+				t.Errorf("zapSender = %s, want %s", got.Hex(), tt.want.Hex())
+			}
+		})
+	}
+}
+
+func TestTrendingWindow(t *testing.T) {
+	tests := []struct {
+		halfLife time.Duration
+		want     string
+	}{
+		{24 * time.Hour, "24h"},
+		{48 * time.Hour, "2d"},
+		{7 * 24 * time.Hour, "7d"},
+		{36 * time.Hour, "36h"},
+		{time.Hour, "1h"},
+		{90 * time.Minute, "90m"},
+	}
+	for _, tt := range tests {
+		if got := trendingWindow(tt.halfLife); got != tt.want {
+			t.Errorf("trendingWindow(%v) = %q, want %q", tt.halfLife, got, tt.want)
+		}
+	}
+}
+
+func TestDecay(t *testing.T) {
+	tests := []struct {
+		d    float64
+		want float64
+	}{
+		{0, 1},
+		{3600, 0.5},
+		{7200, 0.25},
+		{trendingHorizon * 3600, 1.0 / 1024},
+	}
+	for _, tt := range tests {
+		if got := decay(tt.d, time.Hour); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("decay(%v, 1h) = %v, want %v", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTrendingObserve(t *testing.T) {
+	alice, bob := nostr.Generate(), nostr.Generate()
+	const a, b = "31237:pk:a", "31237:pk:b"
+	const halfLife = time.Hour
+	now := nostr.Now()
+	ago := func(halfLives float64) nostr.Timestamp {
+		return now - nostr.Timestamp(halfLives*halfLife.Seconds())
+	}
+	reaction := func(sk nostr.SecretKey, at nostr.Timestamp, content, addr string) nostr.Event {
+		return nostr.Event{Kind: reactionKind, PubKey: sk.Public(), CreatedAt: at, Content: content, Tags: nostr.Tags{{"a", addr}}}
+	}
+	list := func(sk nostr.SecretKey, at nostr.Timestamp, entries ...nostr.Tag) nostr.Event {
+		return nostr.Event{Kind: listKind, PubKey: sk.Public(), CreatedAt: at, Tags: append(nostr.Tags{{"d", "fav"}}, entries...)}
+	}
+	entry := func(addr string, added nostr.Timestamp) nostr.Tag {
+		return nostr.Tag{"a", addr, "", "", strconv.Itoa(int(added))}
+	}
+
+	// reactions weigh 1, favourites 2
+	tests := []struct {
+		name   string
+		events []nostr.Event
+		want   map[string]float64
+	}{
+		{
+			name:   "one reaction",
+			events: []nostr.Event{reaction(alice, now, "+", a)},
+			want:   map[string]float64{a: 1},
+		},
+		{
+			name:   "two authors",
+			events: []nostr.Event{reaction(alice, now, "+", a), reaction(bob, now, "🔥", a)},
+			want:   map[string]float64{a: 2},
+		},
+		{
+			name:   "an author counts once per station and kind",
+			events: []nostr.Event{reaction(alice, now, "+", a), reaction(alice, now, "+", a), reaction(alice, now, "+", b)},
+			want:   map[string]float64{a: 1, b: 1},
+		},
+		{
+			name:   "dislikes don't count",
+			events: []nostr.Event{reaction(alice, now, "-", a)},
+			want:   map[string]float64{},
+		},
+		{
+			name:   "decayed by age",
+			events: []nostr.Event{reaction(alice, ago(1), "+", a), reaction(bob, ago(2), "+", a)},
+			want:   map[string]float64{a: 0.75},
+		},
+		{
+			name:   "older than the horizon",
+			events: []nostr.Event{reaction(alice, ago(trendingHorizon+1), "+", a)},
+			want:   map[string]float64{},
+		},
+		{
+			name:   "future timestamps count as now",
+			events: []nostr.Event{reaction(alice, now+3600, "+", a)},
+			want:   map[string]float64{a: 1},
+		},
+		{
+			name: "favourites dated by when they were added",
+			events: []nostr.Event{
+				list(alice, now, entry(a, ago(1)), entry(b, 0)),
+			},
+			want: map[string]float64{a: 1, b: 2},
+		},
+		{
+			name: "a re-saved list only adds new entries",
+			events: []nostr.Event{
+				list(alice, ago(1), entry(a, ago(1))),
+				list(alice, now, entry(a, ago(1)), entry(b, now)),
+			},
+			want: map[string]float64{a: 1, b: 2},
+		},
+		{
+			name: "different kinds from one author both count",
+			events: []nostr.Event{
+				reaction(alice, now, "+", a),
+				list(alice, now, entry(a, now)),
+			},
+			want: map[string]float64{a: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Trending.HalfLife = Duration{halfLife}
+			cfg.Trending.ReactionWeight = 1
+			cfg.Trending.FavoriteWeight = 2
+			te := newTrendingEngine(nil, newLiveConfig("", cfg, nil, nil), nostr.Generate())
+			for _, evt := range tt.events {
+				te.observe(evt)
+			}
+			got := make(map[string]float64)
+			for _, e := range te.top() {
+				got[e.Address] = e.Score
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("scores = %v, want %v", got, tt.want)
+			}
+			for addr, want := range tt.want {
+				// top decays to the current second; allow for a tick
+				if math.Abs(got[addr]-want) > 0.01*want {
+					t.Errorf("score of %s = %v, want %v", addr, got[addr], want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrendingPrune(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Trending.HalfLife = Duration{time.Hour}
+	te := newTrendingEngine(nil, newLiveConfig("", cfg, nil, nil), nostr.Generate())
+	alice := nostr.Generate()
+	evt := nostr.Event{Kind: reactionKind, PubKey: alice.Public(), CreatedAt: nostr.Now(), Content: "+", Tags: nostr.Tags{{"a", "31237:pk:a"}}}
+	te.observe(evt)
+	if len(te.seen) != 1 {
+		t.Fatalf("seen = %v", te.seen)
+	}
+	te.prune()
+	if len(te.seen) != 1 {
+		t.Fatal("pruned an interaction within the horizon")
+	}
+	// once the interaction is past the horizon the author may count again
+	for key := range te.seen {
+		te.seen[key] = nostr.Now() - trendingHorizon*3600 - 1
+	}
+	te.prune()
+	if len(te.seen) != 0 {
+		t.Fatalf("kept %v past the horizon", te.seen)
+	}
+	te.observe(evt)
+	if len(te.seen) != 1 {
+		t.Error("the author wasn't counted again after pruning")
+	}
+}
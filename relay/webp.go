@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"slices"
+)
+
+// encodeWebP writes img as a lossless WebP (VP8L, RFC 9649). There's no
+// WebP encoder in the standard library or x/image, and logos are small, so
+// this is a deliberately simple one: a subtract-green transform, a predictor
+// transform choosing per 16x16 tile between a few modes, and one set of
+// Huffman codes for the whole image. No backward references or color cache.
+func encodeWebP(img image.Image) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+
+	argb := make([]uint32, w*h)
+	opaque := true
+	for i := range argb {
+		p := nrgba.Pix[i*4 : i*4+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		opaque = opaque && p[3] == 0xff
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	if opaque {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3) // version
+
+	// subtract-green transform
+	bw.write(1, 1)
+	bw.write(2, 2)
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := ((p>>16)&0xff - g) & 0xff
+		bl := (p&0xff - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | bl
+	}
+
+	// predictor transform
+	const tileBits = 4
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(tileBits-2, 3)
+	modes, residuals := predict(argb, w, h, tileBits)
+	writeImageData(&bw, modes, false)
+
+	bw.write(0, 1) // no more transforms
+	writeImageData(&bw, residuals, true)
+
+	data := bw.bytes()
+	var out bytes.Buffer
+	pad := len(data) & 1
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+8+len(data)+pad))
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, uint32(len(data)))
+	out.Write(data)
+	if pad == 1 {
+		out.WriteByte(0)
+	}
+	return out.Bytes()
+}
+
+// webpPredictors are the VP8L predictor modes we try per tile.
+var webpPredictors = []uint32{1, 2, 11, 12}
+
+// predict picks, for each tile, the predictor with the smallest residuals
+// and returns the mode image (mode in the green channel) and the residuals.
+func predict(argb []uint32, w, h, tileBits int) (modes, residuals []uint32) {
+	tile := 1 << tileBits
+	tw, th := (w+tile-1)/tile, (h+tile-1)/tile
+	modes = make([]uint32, tw*th)
+	residuals = make([]uint32, len(argb))
+
+	for ty := range th {
+		for tx := range tw {
+			best, bestCost := webpPredictors[0], -1
+			for _, mode := range webpPredictors {
+				cost := 0
+				for y := ty * tile; y < min((ty+1)*tile, h); y++ {
+					for x := tx * tile; x < min((tx+1)*tile, w); x++ {
+						cost += residualCost(argb[y*w+x], predictPixel(argb, w, x, y, mode))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tw+tx] = 0xff000000 | best<<8
+			for y := ty * tile; y < min((ty+1)*tile, h); y++ {
+				for x := tx * tile; x < min((tx+1)*tile, w); x++ {
+					residuals[y*w+x] = subPixels(argb[y*w+x], predictPixel(argb, w, x, y, best))
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// predictPixel applies mode at (x, y), including the spec's fixed rules for
+// the first row and column.
+func predictPixel(argb []uint32, w, x, y int, mode uint32) uint32 {
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[x-1]
+	case x == 0:
+		return argb[(y-1)*w]
+	}
+	l, t, tl := argb[y*w+x-1], argb[(y-1)*w+x], argb[(y-1)*w+x-1]
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	case 11:
+		// the spec's Select: whichever of L and T is closer to L+T-TL
+		pl, pt := 0, 0
+		for shift := 0; shift < 32; shift += 8 {
+			cl, ct, ctl := int(l>>shift&0xff), int(t>>shift&0xff), int(tl>>shift&0xff)
+			pl += abs(ct - ctl)
+			pt += abs(cl - ctl)
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	default: // 12: ClampAddSubtractFull
+		var out uint32
+		for shift := 0; shift < 32; shift += 8 {
+			c := int(l>>shift&0xff) + int(t>>shift&0xff) - int(tl>>shift&0xff)
+			out |= uint32(min(max(c, 0), 255)) << shift
+		}
+		return out
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// subPixels subtracts per channel, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= ((a>>shift&0xff - b>>shift&0xff) & 0xff) << shift
+	}
+	return out
+}
+
+// residualCost estimates how well a residual compresses: small values in
+// either direction are cheap.
+func residualCost(p, pred uint32) int {
+	r := subPixels(p, pred)
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		c := int(r >> shift & 0xff)
+		cost += min(c, 256-c)
+	}
+	return cost
+}
+
+// writeImageData writes an entropy-coded image: no color cache, optionally
+// the "no meta prefix codes" bit (main image only), the five prefix codes
+// and the pixels as literals.
+func writeImageData(bw *bitWriter, pixels []uint32, main bool) {
+	bw.write(0, 1) // no color cache
+	if main {
+		bw.write(0, 1) // one prefix code group
+	}
+	var hist [4][]int
+	for i, size := range []int{280, 256, 256, 256} {
+		hist[i] = make([]int, size)
+	}
+	for _, p := range pixels {
+		hist[0][p>>8&0xff]++
+		hist[1][p>>16&0xff]++
+		hist[2][p&0xff]++
+		hist[3][p>>24]++
+	}
+	var codes [4]prefixCode
+	for i := range hist {
+		codes[i] = writePrefixCode(bw, hist[i])
+	}
+	writePrefixCode(bw, make([]int, 40)) // distances: unused
+
+	for _, p := range pixels {
+		codes[0].write(bw, int(p>>8&0xff))
+		codes[1].write(bw, int(p>>16&0xff))
+		codes[2].write(bw, int(p&0xff))
+		codes[3].write(bw, int(p>>24))
+	}
+}
+
+// prefixCode is a canonical Huffman code. A code with a single symbol is
+// written with zero bits, as the format specifies.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+	single  bool
+}
+
+func (c prefixCode) write(bw *bitWriter, symbol int) {
+	if c.single {
+		return
+	}
+	bw.write(uint32(c.codes[symbol]), uint(c.lengths[symbol]))
+}
+
+// codeLengthOrder is the order code length code lengths are written in.
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writePrefixCode writes the code for hist and returns it. Up to two
+// symbols below 256 use the compact "simple" form.
+func writePrefixCode(bw *bitWriter, hist []int) prefixCode {
+	var used []int
+	for sym, n := range hist {
+		if n > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		code := prefixCode{lengths: make([]uint8, len(hist)), codes: make([]uint16, len(hist)), single: len(used) == 1}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	code := newPrefixCode(hist, 15)
+	bw.write(0, 1)
+
+	// code lengths as tokens: 0-15 literal, 17/18 runs of zeros
+	type token struct{ sym, extra, extraBits int }
+	var tokens []token
+	for i := 0; i < len(code.lengths); {
+		if code.lengths[i] != 0 {
+			tokens = append(tokens, token{sym: int(code.lengths[i])})
+			i++
+			continue
+		}
+		run := 1
+		for i+run < len(code.lengths) && code.lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			tokens = append(tokens, token{18, run - 11, 7})
+		case run >= 3:
+			tokens = append(tokens, token{17, run - 3, 3})
+		default:
+			for range run {
+				tokens = append(tokens, token{sym: 0})
+			}
+		}
+		i += run
+	}
+	lhist := make([]int, 19)
+	for _, t := range tokens {
+		lhist[t.sym]++
+	}
+	lcode := newPrefixCode(lhist, 7)
+	n := 4
+	for i, sym := range codeLengthOrder {
+		if lcode.lengths[sym] != 0 {
+			n = max(n, i+1)
+		}
+	}
+	bw.write(uint32(n-4), 4)
+	for _, sym := range codeLengthOrder[:n] {
+		bw.write(uint32(lcode.lengths[sym]), 3)
+	}
+	bw.write(0, 1) // max_symbol is the alphabet size
+	for _, t := range tokens {
+		lcode.write(bw, t.sym)
+		if t.extraBits > 0 {
+			bw.write(uint32(t.extra), uint(t.extraBits))
+		}
+	}
+	return code
+}
+
+// newPrefixCode builds a canonical Huffman code for hist with lengths of at
+// most maxLen. Codes are stored bit-reversed, ready for the LSB-first writer.
+func newPrefixCode(hist []int, maxLen int) prefixCode {
+	code := prefixCode{lengths: make([]uint8, len(hist)), codes: make([]uint16, len(hist))}
+	counts := slices.Clone(hist)
+	for {
+		if huffmanLengths(counts, code.lengths) <= maxLen {
+			break
+		}
+		// too deep: flatten the distribution and try again
+		for i, n := range counts {
+			if n > 0 {
+				counts[i] = (n + 1) / 2
+			}
+		}
+	}
+
+	used := 0
+	for _, l := range code.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used == 1 {
+		code.single = true
+		return code
+	}
+
+	var blCount [16]int
+	for _, l := range code.lengths {
+		blCount[l]++
+	}
+	blCount[0] = 0
+	var next [16]int
+	c := 0
+	for bits := 1; bits < 16; bits++ {
+		c = (c + blCount[bits-1]) << 1
+		next[bits] = c
+	}
+	for sym, l := range code.lengths {
+		if l == 0 {
+			continue
+		}
+		v := next[l]
+		next[l]++
+		var rev uint16
+		for i := 0; i < int(l); i++ {
+			rev = rev<<1 | uint16(v>>i&1)
+		}
+		code.codes[sym] = rev
+	}
+	return code
+}
+
+// huffmanLengths fills lengths with Huffman code lengths for counts and
+// returns the longest. A lone symbol gets length 1.
+func huffmanLengths(counts []int, lengths []uint8) int {
+	clear(lengths)
+	h := &huffmanHeap{}
+	for sym, n := range counts {
+		if n > 0 {
+			*h = append(*h, &huffmanNode{count: n, symbol: sym})
+		}
+	}
+	if h.Len() == 1 {
+		lengths[(*h)[0].symbol] = 1
+		return 1
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a, b := heap.Pop(h).(*huffmanNode), heap.Pop(h).(*huffmanNode)
+		heap.Push(h, &huffmanNode{count: a.count + b.count, symbol: -1, left: a, right: b})
+	}
+	longest := 0
+	var walk func(n *huffmanNode, depth int)
+	walk = func(n *huffmanNode, depth int) {
+		if n.symbol >= 0 {
+			lengths[n.symbol] = uint8(min(depth, 255))
+			longest = max(longest, depth)
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	if h.Len() == 1 {
+		walk((*h)[0], 0)
+	}
+	return longest
+}
+
+type huffmanNode struct {
+	count       int
+	symbol      int
+	left, right *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffmanHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x any)   { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// bitWriter packs values least-significant bit first, as VP8L reads them.
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.acc |= uint64(v&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc, bw.nbits = 0, 0
+	}
+	return bw.buf
+}
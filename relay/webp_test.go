@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand/v2"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	fill := func(w, h int, at func(x, y int) color.NRGBA) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				img.SetNRGBA(x, y, at(x, y))
+			}
+		}
+		return img
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"one pixel", fill(1, 1, func(x, y int) color.NRGBA { return color.NRGBA{200, 100, 50, 255} })},
+		{"solid", fill(64, 64, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} })},
+		{"gradient", fill(192, 192, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255} })},
+		{"odd size across tiles", fill(17, 33, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x * 15), uint8(y * 7), 0, 255} })},
+		{"wide", fill(300, 2, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), 0, uint8(y), 255} })},
+		{"alpha", fill(40, 40, func(x, y int) color.NRGBA { return color.NRGBA{255, uint8(x * 6), 0, uint8(y * 6)} })},
+		{"transparent border", fill(32, 32, func(x, y int) color.NRGBA {
+			if x < 4 || y < 4 || x >= 28 || y >= 28 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{0, 0, 255, 255}
+		})},
+		{"noise", fill(50, 50, func(x, y int) color.NRGBA {
+			v := rng.Uint32()
+			return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)}
+		})},
+		{"non-zero origin", image.NewRGBA(image.Rect(5, 5, 25, 15))},
+		{"paletted", func() image.Image {
+			img := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{color.Black, color.White})
+			for i := range img.Pix {
+				img.Pix[i] = uint8(i % 3 % 2)
+			}
+			return img
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeWebP(tt.img)
+			cfg, err := webp.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("DecodeConfig: %v", err)
+			}
+			b := tt.img.Bounds()
+			if cfg.Width != b.Dx() || cfg.Height != b.Dy() {
+				t.Fatalf("size %dx%d, want %dx%d", cfg.Width, cfg.Height, b.Dx(), b.Dy())
+			}
+			got, err := webp.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			want := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(want, want.Bounds(), tt.img, b.Min, draw.Src)
+			for y := range b.Dy() {
+				for x := range b.Dx() {
+					g := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+					if w := want.NRGBAAt(x, y); g != w {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeWebPContainer(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {2, 3}, {64, 64}} {
+		data := encodeWebP(image.NewRGBA(image.Rectangle{Max: size}))
+		if len(data)%2 != 0 {
+			t.Errorf("%v: RIFF file has odd length %d", size, len(data))
+		}
+		if string(data[:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+			t.Errorf("%v: header %q", size, data[:16])
+		}
+		if riff := int(data[4]) | int(data[5])<<8 | int(data[6])<<16 | int(data[7])<<24; riff != len(data)-8 {
+			t.Errorf("%v: RIFF size %d, want %d", size, riff, len(data)-8)
+		}
+	}
+}
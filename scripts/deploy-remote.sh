@@ -67,7 +67,8 @@ bun install --production --frozen-lockfile
 # Build Go relay (must be built on VPS for correct architecture)
 echo "🔧 Building Go relay (this may take a few minutes on first run)..."
 cd relay
-CGO_ENABLED=1 GOTOOLCHAIN=local go build -v -o relay -ldflags="-s -w" . 2>&1
+RELAY_VERSION=$(node -p "require('../package.json').version" 2>/dev/null || echo dev)
+CGO_ENABLED=1 GOTOOLCHAIN=local go build -v -o relay -ldflags="-s -w -X main.version=$RELAY_VERSION" . 2>&1
 echo "✅ Relay binary built"
 cd ..
 
@@ -133,6 +134,7 @@ NODE_ENV=production PORT=3000 pm2 start src/index.tsx \
 PORT=3334 pm2 start relay/relay \
     --name wavefunc-relay \
     --max-memory-restart 500M \
+    --kill-timeout 15000 \
     --log-date-format 'YYYY-MM-DD HH:mm:ss Z' \
     -e logs/relay-error.log \
     -o logs/relay-out.log \
@@ -151,12 +153,29 @@ pm2 start contextvm/server.ts \
 
 pm2 save
 
+# Block until the relay's /readyz passes (LMDB readable, index open, index in
+# sync with LMDB) instead of guessing with a fixed sleep.
+wait_for_relay_ready() {
+    local tries=${1:-30}
+    for _ in $(seq 1 "$tries"); do
+        if curl -fsS http://localhost:3334/readyz >/dev/null 2>&1; then
+            return 0
+        fi
+        sleep 1
+    done
+    return 1
+}
+
 # Run migration if this is a fresh database (format change or first deploy)
 if [ "$NEEDS_MIGRATION" = "true" ]; then
     echo ""
     echo "🔄 Running station migration (500 stations)..."
     echo "   Waiting for relay to be ready..."
-    sleep 3
+    if ! wait_for_relay_ready 30; then
+        echo "⚠️  Relay did not report ready within 30s:"
+        curl -sS http://localhost:3334/readyz || true
+        echo ""
+    fi
 
     # Load env to get APP_PRIVATE_KEY
     if [ -f ".env" ]; then
@@ -189,6 +208,26 @@ if [ "$NEEDS_REINDEX" = "true" ]; then
     echo "   Monitor: tail -f logs/reindex.log"
 fi
 
+if [ "$NEEDS_MIGRATION" = "false" ] && [ "$NEEDS_REINDEX" = "false" ]; then
+    echo ""
+    echo "🩺 Waiting for relay readiness..."
+    if wait_for_relay_ready 30; then
+        echo "✅ Relay is ready"
+        # The index still serves while its schema is outdated, but new
+        # fields (country, genre, ...) only exist after a rebuild.
+        if curl -fsS http://localhost:3334/readyz 2>/dev/null | grep -q '"schema":"outdated"'; then
+            echo "🔄 Search index schema is outdated, rebuilding in background..."
+            nohup ./scripts/reindex-search.sh > logs/reindex.log 2>&1 &
+            echo "   Monitor: tail -f logs/reindex.log"
+        fi
+    else
+        echo "❌ Relay did not report ready within 30s:"
+        curl -sS http://localhost:3334/readyz || true
+        echo ""
+        exit 1
+    fi
+fi
+
 echo ""
 echo "✅ Deployment complete!"
 pm2 list
@@ -59,6 +59,7 @@ export const StationRankingMetricSchema = z.enum([
   "most-liked",
   "most-zapped",
   "on-air-now",
+  "trending",
 ]);
 export type StationRankingMetric = z.infer<typeof StationRankingMetricSchema>;
 